@@ -0,0 +1,79 @@
+package cdl
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// byteSizeUnits gives the multiplier of each suffix of a `bytesize`; SI
+// suffixes are powers of 1000, and IEC suffixes powers of 1024
+var byteSizeUnits = map[string]uint64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"pb":  1e15,
+	"eb":  1e18,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+	"pib": 1 << 50,
+	"eib": 1 << 60,
+}
+
+var byteSizeRegexp = regexp.MustCompile(`^\s*(\d+(?:\.\d+)?)\s*([A-Za-z]*)\s*$`)
+
+// toByteSize returns the number of bytes represented by an object
+//
+// A number must be a non-negative whole number; a string is a number followed
+// by an optional SI or IEC suffix, e.g. `10MB` or `1.5GiB`. Suffixes are not
+// case sensitive.
+func toByteSize(o interface{}) (int64, *CdlError) {
+	if f, ok := toFloat64(o); ok {
+		if f < 0 || f != math.Trunc(f) {
+			return 0, NewError("ErrBadValue").SetSupplementary(fmt.Sprintf("got %v expected a whole number of bytes", o)).WithField("got", o)
+		}
+		// float64(math.MaxInt64) is 2^63, which does not fit
+		if f >= math.MaxInt64 {
+			return 0, NewError("ErrValueOutOfRange").SetSupplementary(fmt.Sprintf("got %v, too large", o)).WithField("got", o)
+		}
+		return int64(f), nil
+	}
+	s, ok := o.(string)
+	if !ok {
+		return 0, newPseudoTypeError(o, "bytesize")
+	}
+	m := byteSizeRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return 0, newPseudoTypeError(o, "bytesize")
+	}
+	unit, ok := byteSizeUnits[strings.ToLower(m[2])]
+	if !ok {
+		return 0, NewError("ErrBadType").SetSupplementary(fmt.Sprintf("got '%s', unknown size suffix '%s'", s, m[2])).
+			WithField("got", s).
+			WithField("expected", "bytesize")
+	}
+	tooLarge := NewError("ErrValueOutOfRange").SetSupplementary(fmt.Sprintf("got '%s', too large", s)).WithField("got", s)
+	if !strings.Contains(m[1], ".") {
+		n, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil || n > math.MaxInt64/unit {
+			return 0, tooLarge
+		}
+		return int64(n * unit), nil
+	}
+	f, _ := strconv.ParseFloat(m[1], 64)
+	f *= float64(unit)
+	if f != math.Trunc(f) {
+		return 0, NewError("ErrBadValue").SetSupplementary(fmt.Sprintf("got '%s' expected a whole number of bytes", s)).WithField("got", s)
+	}
+	if f >= math.MaxInt64 {
+		return 0, tooLarge
+	}
+	return int64(f), nil
+}
@@ -0,0 +1,143 @@
+package cdl
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxCacheEntries is the number of results held by the validation cache
+// before it is emptied
+const maxCacheEntries = 1024
+
+type validationCache struct {
+	sync.RWMutex
+	results map[string]*CdlError
+}
+
+// func ValidateCached validates an object against a cdl template, caching the result.
+//
+// The result of validating each distinct object is remembered, so validating
+// an identical object again returns the same result without walking the
+// object. Objects are identified by a canonical encoding of their contents;
+// objects which cannot be encoded (such as structs) are validated without
+// being cached. As a configurator may have side effects, none may be passed.
+// ValidateCached is safe for concurrent use.
+func (ct *CompiledTemplate) ValidateCached(o interface{}) error {
+	key, ok := cacheKey(o)
+	if !ok {
+		return ct.Validate(o, nil)
+	}
+	ct.cacheLock.Lock()
+	if ct.cache == nil {
+		ct.cache = &validationCache{results: make(map[string]*CdlError)}
+	}
+	cache := ct.cache
+	ct.cacheLock.Unlock()
+
+	cache.RLock()
+	err, ok := cache.results[key]
+	cache.RUnlock()
+	if !ok {
+		if e := ct.Validate(o, nil); e != nil {
+			err = e.(*CdlError)
+		}
+		cache.Lock()
+		if len(cache.results) >= maxCacheEntries {
+			cache.results = make(map[string]*CdlError)
+		}
+		cache.results[key] = err
+		cache.Unlock()
+	}
+	if err == nil {
+		return nil
+	}
+	// the caller may add context, so return a copy
+	e := *err
+	e.Context = append([]string(nil), err.Context...)
+	return &e
+}
+
+// cacheKey returns a canonical encoding of the contents of an object, by which
+// it is identified in the cache, or false if the object cannot be encoded
+//
+// Maps are encoded independently of their iteration order. Only the values
+// produced by decoding JSON, ordered maps and numbers of other types can be
+// encoded.
+func cacheKey(o interface{}) (string, bool) {
+	var b strings.Builder
+	ok := writeCacheKey(&b, o)
+	return b.String(), ok
+}
+
+func writeCacheKey(b *strings.Builder, o interface{}) bool {
+	writeString := func(tag byte, s string) {
+		b.WriteByte(tag)
+		b.WriteString(strconv.Itoa(len(s)))
+		b.WriteByte(':')
+		b.WriteString(s)
+	}
+	switch n := o.(type) {
+	case nil:
+		b.WriteByte('z')
+	case string:
+		writeString('s', n)
+	case bool:
+		if n {
+			b.WriteByte('t')
+		} else {
+			b.WriteByte('f')
+		}
+	case float64:
+		b.WriteByte('n')
+		b.WriteString(strconv.FormatUint(math.Float64bits(n), 16))
+		b.WriteByte(';')
+	case []interface{}:
+		b.WriteByte('a')
+		b.WriteString(strconv.Itoa(len(n)))
+		b.WriteByte('[')
+		for _, v := range n {
+			if !writeCacheKey(b, v) {
+				return false
+			}
+		}
+		b.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(n))
+		for k := range n {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteByte('m')
+		b.WriteString(strconv.Itoa(len(n)))
+		b.WriteByte('{')
+		for _, k := range keys {
+			writeString('k', k)
+			if !writeCacheKey(b, n[k]) {
+				return false
+			}
+		}
+		b.WriteByte('}')
+	case *OrderedMap:
+		b.WriteByte('o')
+		b.WriteString(strconv.Itoa(len(n.Keys)))
+		b.WriteByte('{')
+		for _, k := range n.Keys {
+			writeString('k', k)
+			if !writeCacheKey(b, n.Values[k]) {
+				return false
+			}
+		}
+		b.WriteByte('}')
+	default:
+		if !isNumber(o) {
+			return false
+		}
+		// distinguish types, as validation may
+		writeString('N', fmt.Sprintf("%T:%v", o, o))
+	}
+	return true
+}
@@ -1,12 +1,20 @@
 package cdl
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/mail"
+	"net/url"
+	"os"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 )
 
@@ -22,144 +30,984 @@ type Configurator map[string]interface{}
 //
 // It is opaque to the user in operations.
 type CompiledTemplate struct {
-	s map[string]interface{}
+	s         map[string]interface{}
+	source    Template // the template compiled, for AddKey and RemoveKey
+	opts      CompileOptions
+	cache     *validationCache
+	cacheLock sync.Mutex
+	qualified bool // keys qualified by their parent are present
 }
 
-type options map[string]interface{}
+// type CompileOptions holds options which alter the behaviour of a compiled template.
+//
+// The zero value gives the default behaviour.
+type CompileOptions struct {
+	// Interpolate, if set, is used to look up variables referenced as `${name}`
+	// or `$name` within string values, which are expanded (as per os.Expand)
+	// before they are validated or passed to a configurator. os.LookupEnv is
+	// a suitable function to expand environment variables.
+	Interpolate func(name string) (string, bool)
+
+	// AllowUndefined, if set, expands variables Interpolate cannot find to an
+	// empty string rather than producing ErrUndefinedVariable.
+	AllowUndefined bool
+
+	// Strict, if set, causes Compile to reject any type name which is neither
+	// a pseudotype, the name of a built-in Go type, nor the name of a composite
+	// or package qualified type (e.g. `[]interface {}` or `time.Time`). This
+	// catches misspelt pseudotypes, which would otherwise never match.
+	Strict bool
+
+	// Enums holds named enum types, which may be referred to in a template
+	// as `@name`, e.g. for templates loaded from data.
+	Enums map[string]EnumType
+
+	// TypeResolver, if set, is used to look up type names which are neither
+	// pseudotypes nor match the Go type of the data exactly, so that a
+	// template may use an alias (e.g. `mytime`) for a Go type (e.g.
+	// time.Time). Names it resolves are accepted by Strict.
+	TypeResolver func(name string) (reflect.Type, bool)
+
+	// LengthMatches maps the key of an array to the key of a number in the
+	// same map giving its length, e.g. {"items": "count"}. Where both are
+	// present in a map, an array of a different length produces
+	// ErrOutOfRange.
+	LengthMatches map[string]string
+
+	// Defaults maps the keys of optional map elements to default values,
+	// which may be whole subtrees. Where such a key is absent from a map, its
+	// default is validated (and any configurators called) as if it were
+	// present. A key qualified by its parent (e.g. `planet.moons`) may be
+	// used to give a default for that parent only.
+	Defaults map[string]interface{}
+
+	// SecretKeys lists keys whose values are secret, e.g. passwords. Any
+	// error validating such a key (or anything within it) has its
+	// supplementary text and the value it got replaced by `***`.
+	SecretKeys []string
+
+	// Sets holds named sets of strings, which may be referred to in a
+	// template as `#name` wherever a named enum may be referred to, e.g.
+	// `"country": "#countries"` or `"countries": "[]#countries"`
+	Sets map[string][]string
+}
+
+type options struct {
+	keys      map[string]requirement
+	patterns  []pattern
+	extra     *pattern
+	extraType string
+	ignore    bool // ignore extra keys
+	present   OptRange
+	groups    []group
+	shared    bool     // every value is validated as extra, from `{}:spec`
+	order     []string // keys in the order declared
+}
+
+// group is a set of mutually exclusive keys, exactly one of which must be
+// present, or if optional, at most one of which may be present
+type group struct {
+	keys     []string
+	optional bool
+}
+
+// pattern is a map element applying to any key matching a regexp
+type pattern struct {
+	re   *regexp.Regexp
+	name string
+	req  requirement
+}
 
-type optrange struct {
+// type OptRange is a range of lengths or counts, as given by `{n,m}` in a
+// template. A Min or Max of -1 means the range is open at that end.
+type OptRange struct {
 	Min int
 	Max int
 }
 
+// func Contains returns true if value lies within the range
+func (r OptRange) Contains(value int) bool {
+	return (value >= r.Min || r.Min == -1) && (value <= r.Max || r.Max == -1)
+}
+
+// func String renders the range as `{n,m}`, `{n,}`, `{,m}` or, where the
+// range admits only one value, `{n}`
+func (r OptRange) String() string {
+	if r.Min >= 0 && r.Min == r.Max {
+		return fmt.Sprintf("{%d}", r.Min)
+	}
+	return r.spec()
+}
+
+// spec renders the range in template syntax
+func (r OptRange) spec() string {
+	switch {
+	case r.Min < 0 && r.Max < 0:
+		return "{0,}"
+	case r.Max < 0:
+		return fmt.Sprintf("{%d,}", r.Min)
+	case r.Min < 0:
+		return fmt.Sprintf("{,%d}", r.Max)
+	}
+	return fmt.Sprintf("{%d,%d}", r.Min, r.Max)
+}
+
 type array struct {
-	name string
-	r    optrange
+	name   string
+	r      OptRange
+	order  int  // 1 if sorted ascending, -1 if sorted descending
+	unique bool // elements may not be repeated
+}
+
+// literal is a value which must be matched exactly, or if negate is set, must not be matched
+type literal struct {
+	value  string      // as given in the template
+	want   interface{} // a string, float64 or bool
+	negate bool
+}
+
+// newLiteral returns a literal, which is a number if the value is numeric, a
+// bool if it is true or false, and otherwise a string
+//
+// A value in double quotes is always a string, so `="2"` matches only the
+// string "2".
+func newLiteral(value string, negate bool) *literal {
+	l := &literal{value: value, want: value, negate: negate}
+	if s, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+		l.want = s
+	} else if f, err := strconv.ParseFloat(value, 64); err == nil && strings.ContainsAny(value[:1], "+-.0123456789") {
+		l.want = f
+	} else if value == "true" || value == "false" {
+		l.want = value == "true"
+	}
+	return l
+}
+
+// tuple is a fixed length array each position of which has its own specification
+type tuple struct {
+	names []string
 }
 
 type requirement struct {
 	mandatory bool
+	forbidden bool
+	nonzero   bool
 	array     bool
-	r         optrange
+	r         OptRange
 }
 
 // type ValidatorFunc allows user specified validation functions to be passed to cdl.
 type ValidatorFunc func(obj interface{}) (err *CdlError)
 
+// type TransformFunc allows user specified validation functions which transform the value to be passed to cdl.
+//
+// The value returned replaces the original value for any configurator.
+type TransformFunc func(obj interface{}) (result interface{}, err *CdlError)
+
 // type ConfiguratorFunc allows user specified configurator functions to be passed to cdl.
 type ConfiguratorFunc func(obj interface{}, path Path) (err *CdlError)
 
-func (r *optrange) contains(value int) bool {
-	return (value >= r.Min || r.Min == -1) && (value <= r.Max || r.Max == -1)
+// type ReplacingConfiguratorFunc allows user specified configurator functions which replace the value configured.
+//
+// The value returned replaces the original value wherever it is passed to the
+// configurator of a map or array containing it.
+type ReplacingConfiguratorFunc func(obj interface{}, path Path) (result interface{}, err *CdlError)
+
+// type Warning is an advisory message produced during validation
+//
+// Warnings are produced by validator functions returning an error created with
+// NewWarning. They do not cause validation to fail.
+type Warning struct {
+	Path Path
+	Err  *CdlError
+}
+
+// type Result holds information gathered during a successful validation
+type Result struct {
+	Warnings []Warning
+
+	// PresentOptional maps the path (as given by Path.String) of each map
+	// validated to the sorted names of the optional keys present in it. It
+	// is only populated if the PresentOptional validate option is set.
+	PresentOptional map[string][]string
+}
+
+// merge adds the warnings and present optional keys of another result
+func (r *Result) merge(other Result) {
+	r.Warnings = append(r.Warnings, other.Warnings...)
+	for k, v := range other.PresentOptional {
+		if r.PresentOptional == nil {
+			r.PresentOptional = make(map[string][]string)
+		}
+		r.PresentOptional[k] = v
+	}
+}
+
+// type Stats holds the number of items of each kind visited during validation
+type Stats struct {
+	Maps     int // maps, including the root if it is a map
+	Arrays   int // arrays and tuples
+	Leaves   int // items which are neither maps nor arrays
+	MaxDepth int // the depth of the deepest item visited, the root being 0
+}
+
+// DefaultMaxDepth is the maximum depth of nesting permitted in a validated
+// object if ValidateOptions does not specify one.
+const DefaultMaxDepth = 1000
+
+// type ValidateOptions holds options which alter the behaviour of validation.
+//
+// The zero value gives the default behaviour.
+type ValidateOptions struct {
+	// MaxDepth is the maximum depth of nesting of maps and arrays permitted.
+	// Deeper objects produce ErrMaxDepth. If zero, DefaultMaxDepth is used.
+	MaxDepth int
+
+	// AllUnknownKeys, if set, causes all the unknown keys in a map to be
+	// reported together in a single ErrBadKey, rather than just the first
+	// found.
+	AllUnknownKeys bool
+
+	// Partial, if set, skips the check for missing mandatory keys, so that a
+	// partial document (such as a merge patch) may be validated.
+	Partial bool
+
+	// AssignOnce, if set, causes ErrBadConfigurator to be returned if a
+	// configurator would assign to the same variable more than once, e.g.
+	// because two keys are bound to the same pointer.
+	AssignOnce bool
+
+	// OnEnter, if set, is called before each map, array, tuple or leaf is
+	// validated, with kind being "map", "array", "tuple" or "leaf" respectively.
+	OnEnter func(path Path, kind string)
+
+	// OnExit, if set, is called after each map, array, tuple or leaf is
+	// validated, with the error (if any) produced.
+	OnExit func(path Path, kind string, err *CdlError)
+
+	// MaxContextDepth, if non-zero, limits the context shown in the text of
+	// an error to the innermost MaxContextDepth elements, followed by an
+	// ellipsis. The full context remains available through Context and
+	// ContextPath.
+	MaxContextDepth int
+
+	// StringifyKeys, if set, causes map keys which are not strings (such as
+	// the numeric keys produced by some YAML decoders) to be converted to
+	// their string form before being matched against the template. If not
+	// set, such keys produce ErrBadKey.
+	StringifyKeys bool
+
+	// PresentOptional, if set, causes the optional keys present in each map
+	// to be recorded in the PresentOptional field of the Result.
+	PresentOptional bool
+
+	// StringNumbers, if set, permits a string to be given where a number,
+	// integer or sized numeric type is expected, provided it can be parsed
+	// as one. Integers may be written as Go integer literals, so prefixes
+	// such as `0x`, `0o` and `0b` are accepted. The parsed value is then
+	// validated and configured as if it had been given as a number.
+	StringNumbers bool
+
+	// WidenNumbers, if set, permits data of any numeric type to be given
+	// where one of the types int, uint or float64 is expected, provided its
+	// value can be represented exactly in that type. The value is converted
+	// to that type before being passed to any configurator. For instance, the
+	// float64 3 produced by encoding/json is then accepted as an int, but the
+	// int64 2^53+1 is not accepted as a float64.
+	WidenNumbers bool
+
+	// MutateInPlace, if set, causes each item validated within a
+	// map[string]interface{} or []interface{} to be replaced by the value
+	// which would be passed to a configurator, e.g. an `integer` by an int
+	// and a `duration` by a time.Duration. This modifies the object passed.
+	// Other slices, such as a []string, cannot hold such values, so are
+	// validated but left unchanged.
+	MutateInPlace bool
+
+	// IgnoreUnknownKeys, if set, causes keys in a map which are not permitted
+	// by the template to be ignored, as if each map specifier ended in `...`.
+	IgnoreUnknownKeys bool
+
+	// OnUnknownKey, if set, is called with the path of the map and the key
+	// for each unknown key found in a map, whether it is to be ignored or
+	// reported as an error.
+	OnUnknownKey func(path Path, key string)
+
+	// ValidatorTimeout, if non-zero, limits the time each validator function
+	// may take; one taking longer produces ErrValidatorTimeout. A validator
+	// function cannot be cancelled, so it continues to run in the background
+	// after the timeout, and its result is discarded. With MutateInPlace, each
+	// validator is therefore given a copy of the maps and arrays within its
+	// object. A validator which panics produces ErrInternal.
+	ValidatorTimeout time.Duration
+
+	// Skip, if set, is called with the path and value of each item within a
+	// map, array or tuple before it is validated. If it returns true, the item
+	// (and anything within it) is treated as valid without being validated,
+	// and no configurator is called for it.
+	Skip func(path Path, value interface{}) bool
+
+	// AllowEmptyArrays, if set, permits an empty array where the template
+	// requires a minimum number of elements (e.g. `plum+` or `plum{1,}`).
+	// Instead of failing, an ErrOutOfRange warning is added to the result.
+	AllowEmptyArrays bool
+
+	// WrapScalars, if set, causes a scalar (i.e. neither a map nor an array)
+	// given where an array is expected to be treated as an array holding
+	// just that scalar, rather than producing ErrExpectedArray. With
+	// MutateInPlace, the scalar is replaced by the array.
+	WrapScalars bool
+
+	// TrimTrailingNulls, if set, causes nil elements at the end of an array
+	// to be ignored, so that `[1, 2, null]` is treated as `[1, 2]`. With
+	// MutateInPlace, the array is replaced by the shortened array.
+	TrimTrailingNulls bool
+
+	// EnforceOrder, if set, requires the keys of each OrderedMap validated
+	// to appear in the order in which they are declared in the template,
+	// producing ErrBadOrder otherwise. Other maps are unaffected.
+	EnforceOrder bool
+}
+
+// state is the state of a single validation
+type state struct {
+	configurator Configurator
+	opts         ValidateOptions
+	result       Result
+	assigned     map[interface{}]string // pointers assigned, to the path assigned from
+	patterns     []string               // configurator keys which are path patterns, sorted
+	value        interface{}            // the value of the item last validated, if MutateInPlace is set
+	validated    interface{}            // the item last validated, after any conversion (e.g. by StringNumbers)
+	replacement  interface{}            // the value replacing the item last validated, if replaced is set
+	replaced     bool                   // whether a configurator replaced the item last validated or anything within it
+	chosen       map[choice]string      // the alternative chosen by each union validated
+	stats        Stats
+}
+
+func newState(configurator Configurator, opts ValidateOptions) *state {
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = DefaultMaxDepth
+	}
+	st := &state{configurator: configurator, opts: opts}
+	for k, cnf := range configurator {
+		if isPathPattern(k) {
+			st.patterns = append(st.patterns, k)
+		}
+		if a, ok := cnf.(sliceAppender); ok {
+			a.reset()
+		}
+	}
+	// the most specific pattern, having the fewest wildcards, is tried first
+	sort.Slice(st.patterns, func(i, j int) bool {
+		wi, wj := strings.Count(st.patterns[i], "*"), strings.Count(st.patterns[j], "*")
+		if wi != wj {
+			return wi < wj
+		}
+		return st.patterns[i] < st.patterns[j]
+	})
+	return st
+}
+
+// configuratorFor returns the configurator for an item, if any
+//
+// The most specific configurator is used: one keyed by a path pattern matching
+// the item's path (that with the fewest wildcards, if several match), then one
+// keyed by the item's name qualified by the key of the map containing it (e.g.
+// `limits.min`), then one keyed by its name alone. A nil configurator is
+// ignored.
+func (st *state) configuratorFor(pos string, path Path) interface{} {
+	for _, p := range st.patterns {
+		if cnf := st.configurator[p]; cnf != nil && path.matches(p) {
+			return cnf
+		}
+	}
+	if !strings.Contains(pos, ".") {
+		if parent, ok := path.parentKey(); ok {
+			if cnf := st.configurator[parent+"."+pos]; cnf != nil {
+				return cnf
+			}
+		}
+	}
+	if cnf := st.configurator[pos]; cnf != nil {
+		return cnf
+	}
+	if i := strings.LastIndex(pos, "."); i >= 0 {
+		// a key qualified by its parent
+		return st.configurator[pos[i+1:]]
+	}
+	return nil
+}
+
+// func String produces a string representation of a warning including its path
+func (w Warning) String() string {
+	return fmt.Sprintf("%s at %s", w.Err.Error(), w.Path.String())
+}
+
+func (st *state) enter(path Path, kind string) {
+	if st.opts.OnEnter != nil {
+		st.opts.OnEnter(path, kind)
+	}
+}
+
+func (st *state) exit(path Path, kind string, err *CdlError) {
+	if st.opts.OnExit != nil {
+		st.opts.OnExit(path, kind, err)
+	}
+}
+
+// assignOnce checks whether a configurator pointer has already been assigned,
+// if the AssignOnce option is set
+func (st *state) assignOnce(cnf interface{}, path Path) *CdlError {
+	if !st.opts.AssignOnce || reflect.ValueOf(cnf).Kind() != reflect.Ptr {
+		return nil
+	}
+	if st.assigned == nil {
+		st.assigned = make(map[interface{}]string)
+	}
+	if previous, ok := st.assigned[cnf]; ok {
+		return NewError("ErrBadConfigurator").SetSupplementary(fmt.Sprintf("variable already assigned from %s", previous)).
+			WithField("previous", previous)
+	}
+	st.assigned[cnf] = path.String()
+	return nil
+}
+
+// replace replaces an item in a map with the value of the item last validated,
+// if the MutateInPlace option is set
+func (st *state) replace(o interface{}, k string) {
+	if !st.opts.MutateInPlace {
+		return
+	}
+	switch m := o.(type) {
+	case map[string]interface{}:
+		m[k] = st.value
+	case *OrderedMap:
+		m.Set(k, st.value)
+	}
+}
+
+// setReplacement records the value replacing the item being validated, for use
+// by the configurators of the maps and arrays containing it
+func (st *state) setReplacement(o interface{}) {
+	st.replacement, st.replaced = o, true
+}
+
+// takeReplacement returns the value replacing the item last validated, if it
+// or anything within it was replaced by a configurator, and forgets it
+func (st *state) takeReplacement() (interface{}, bool) {
+	o, ok := st.replacement, st.replaced
+	st.replacement, st.replaced = nil, false
+	return o, ok
+}
+
+// wrap returns a scalar wrapped in an array if the WrapScalars option is set
+func (st *state) wrap(o interface{}) interface{} {
+	if !st.opts.WrapScalars || o == nil {
+		return o
+	}
+	switch t := reflect.TypeOf(o); t.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		return o
+	case reflect.Ptr:
+		// e.g. an *OrderedMap
+		if k := t.Elem().Kind(); k == reflect.Map || k == reflect.Struct {
+			return o
+		}
+	}
+	return []interface{}{o}
+}
+
+// skip returns true if the Skip option says an item is not to be validated
+func (st *state) skip(path Path, v interface{}) bool {
+	return st.opts.Skip != nil && st.opts.Skip(path, v)
+}
+
+func (st *state) unknownKey(path Path, k string) {
+	if st.opts.OnUnknownKey != nil {
+		st.opts.OnUnknownKey(path, k)
+	}
+}
+
+// visit counts an item visited, of kind "map", "array" or "leaf"
+func (st *state) visit(path Path, kind string) {
+	switch kind {
+	case "map":
+		st.stats.Maps++
+	case "array":
+		st.stats.Arrays++
+	default:
+		st.stats.Leaves++
+	}
+	if d := path.Depth(); d > st.stats.MaxDepth {
+		st.stats.MaxDepth = d
+	}
+}
+
+func (st *state) check(err *CdlError, path Path) *CdlError {
+	if err != nil && err.warning {
+		st.result.Warnings = append(st.result.Warnings, Warning{Path: path, Err: err})
+		return nil
+	}
+	return err
+}
+
+// splitOptions splits a map specifier into its elements
+//
+// Elements are separated by spaces or '|', save within a /pattern/ or a
+// (group). A '#' at the start of an element begins a comment, which runs to the
+// end of the line.
+func splitOptions(optString string) ([]string, *CdlError) {
+	var elements []string
+	var current []rune
+	inPattern := false
+	inGroup := false
+	inComment := false
+	escaped := false
+	for _, r := range optString {
+		switch {
+		case inComment:
+			inComment = r != '\n'
+		case inGroup:
+			current = append(current, r)
+			inGroup = r != ')'
+		case inPattern:
+			current = append(current, r)
+			if escaped {
+				escaped = false
+			} else if r == '\\' {
+				escaped = true
+			} else if r == '/' {
+				inPattern = false
+			}
+		case unicode.IsSpace(r) || r == '|':
+			if len(current) > 0 {
+				elements = append(elements, string(current))
+				current = nil
+			}
+		case r == '/' && len(current) == 0:
+			current = append(current, r)
+			inPattern = true
+		case r == '#' && len(current) == 0:
+			inComment = true
+		case r == '(' && len(current) == 0:
+			current = append(current, r)
+			inGroup = true
+		default:
+			current = append(current, r)
+		}
+	}
+	if inPattern {
+		return nil, NewErrorContextQuoted("ErrBadOptionValue", string(current)).SetSupplementary("unterminated pattern")
+	}
+	if inGroup {
+		return nil, NewErrorContextQuoted("ErrBadOptionValue", string(current)).SetSupplementary("unterminated group")
+	}
+	if len(current) > 0 {
+		elements = append(elements, string(current))
+	}
+	return elements, nil
+}
+
+// parseRange parses the minimum and maximum of a range, either of which may be
+// empty meaning unbounded, though not both
+func parseRange(minStr string, maxStr string) (OptRange, bool) {
+	if minStr == "" && maxStr == "" {
+		return OptRange{-1, -1}, false
+	}
+	r := OptRange{-1, -1}
+	var err error
+	if minStr != "" {
+		if r.Min, err = strconv.Atoi(minStr); err != nil {
+			return r, false
+		}
+	}
+	if maxStr != "" {
+		if r.Max, err = strconv.Atoi(maxStr); err != nil || (r.Min > r.Max) {
+			return r, false
+		}
+	}
+	return r, true
+}
+
+func parseModifiers(o string, modifiers string) (requirement, *CdlError) {
+	req := requirement{mandatory: true, array: false, r: OptRange{-1, -1}}
+	if modifiers == "" {
+		return req, nil
+	}
+	if !regexp.MustCompile("^([*+!?=-]|\\{\\d*,\\d*\\})+$").MatchString(modifiers) {
+		return req, NewErrorContextQuoted("ErrBadOptionModifier", o)
+	}
+	optslice := regexp.MustCompile("[*+!?=-]|\\{\\d*,\\d*\\}").FindAllStringSubmatch(modifiers, -1)
+	if len(optslice) == 0 {
+		return req, NewErrorContextQuoted("ErrBadOptionModifier", o)
+	}
+	presence, cardinality := "", ""
+	for _, c := range optslice {
+		if len(c) != 1 {
+			return req, NewErrorContextQuoted("ErrBadOptionModifier", o)
+		}
+		// at most one modifier may give each of presence and cardinality
+		switch {
+		case strings.ContainsAny(c[0], "?!-"):
+			if presence != "" {
+				return req, NewErrorContextQuoted("ErrBadOptionModifier", o).
+					SetSupplementary(fmt.Sprintf("conflicting modifiers '%s' and '%s'", presence, c[0]))
+			}
+			presence = c[0]
+		case c[0] != "=":
+			if cardinality != "" {
+				return req, NewErrorContextQuoted("ErrBadOptionModifier", o).
+					SetSupplementary(fmt.Sprintf("conflicting modifiers '%s' and '%s'", cardinality, c[0]))
+			}
+			cardinality = c[0]
+		}
+		switch {
+		case c[0] == "?":
+			req.mandatory = false
+		case c[0] == "!":
+			req.mandatory = true
+			req.forbidden = false
+		case c[0] == "-":
+			req.mandatory = false
+			req.forbidden = true
+		case c[0] == "=":
+			req.nonzero = true
+		case c[0] == "+":
+			req.r = OptRange{1, -1}
+			req.array = true
+		case c[0] == "*":
+			req.array = true
+			req.r = OptRange{0, -1}
+		case strings.HasPrefix(c[0], "{"):
+			minMax := regexp.MustCompile("^\\{(\\d*),(\\d*)\\}$").FindStringSubmatch(c[0])
+			if len(minMax) != 3 {
+				return req, NewErrorContextQuoted("ErrBadRangeOptionModifier", o)
+			}
+			r, ok := parseRange(minMax[1], minMax[2])
+			if !ok {
+				return req, NewErrorContextQuoted("ErrBadRangeOptionModifierValue", o)
+			}
+			req.array = true
+			req.r = r
+		default:
+			return req, NewErrorContextQuoted("ErrBadOptionModifier", o)
+		}
+	}
+	return req, nil
 }
 
 func makeOptions(optString string) (*options, *CdlError) {
-	opts := make(options)
-	spaceOrBar := func(r rune) bool {
-		return unicode.IsSpace(r) || (r == '|')
+	opts := options{keys: make(map[string]requirement), present: OptRange{-1, -1}}
+	if present := regexp.MustCompile("^\\s*(\\[[^\\]]*\\])").FindStringSubmatch(optString); len(present) == 2 {
+		minMax := regexp.MustCompile("^\\[(\\d*),(\\d*)\\]$").FindStringSubmatch(present[1])
+		if len(minMax) != 3 {
+			return nil, NewErrorContextQuoted("ErrBadRangeOptionModifier", present[1])
+		}
+		r, ok := parseRange(minMax[1], minMax[2])
+		if !ok {
+			return nil, NewErrorContextQuoted("ErrBadRangeOptionModifierValue", present[1])
+		}
+		opts.present = r
+		optString = strings.TrimPrefix(strings.TrimSpace(optString), present[1])
+	}
+	elements, err := splitOptions(optString)
+	if err != nil {
+		return nil, err
 	}
-	for _, o := range strings.FieldsFunc(optString, spaceOrBar) {
+	for _, o := range elements {
+		if o == "..." {
+			opts.ignore = true
+			continue
+		}
+		if strings.HasPrefix(o, "...") {
+			s := regexp.MustCompile("^\\.\\.\\.(\\w+)(?::([@#]?\\w+))?$").FindStringSubmatch(o)
+			if len(s) != 3 || opts.extra != nil {
+				return nil, NewErrorContextQuoted("ErrBadOptionValue", o)
+			}
+			opts.extra = &pattern{name: s[1], req: requirement{mandatory: false, r: OptRange{-1, -1}}}
+			opts.extraType = s[2]
+			continue
+		}
+		if strings.HasPrefix(o, "/") {
+			s := regexp.MustCompile("^/((?:[^/\\\\]|\\\\.)*)/(\\w+)(.*)$").FindStringSubmatch(o)
+			if len(s) != 4 {
+				return nil, NewErrorContextQuoted("ErrBadOptionValue", o)
+			}
+			re, rerr := regexp.Compile(strings.Replace(s[1], "\\/", "/", -1))
+			if rerr != nil {
+				return nil, NewErrorContextQuoted("ErrBadOptionValue", o).SetSupplementary(rerr.Error())
+			}
+			req, err := parseModifiers(o, s[3])
+			if err != nil {
+				return nil, err
+			}
+			opts.patterns = append(opts.patterns, pattern{re: re, name: s[2], req: req})
+			continue
+		}
+		if strings.HasPrefix(o, "(") {
+			s := regexp.MustCompile("^\\(([^)]*)\\)(\\??)$").FindStringSubmatch(o)
+			if len(s) != 3 {
+				return nil, NewErrorContextQuoted("ErrBadOptionValue", o)
+			}
+			g := group{optional: s[2] == "?"}
+			for _, m := range strings.Split(s[1], "|") {
+				ks := regexp.MustCompile("^(\\w+)([*+=]|\\{\\d*,\\d*\\})*$").FindStringSubmatch(strings.TrimSpace(m))
+				if ks == nil {
+					return nil, NewErrorContextQuoted("ErrBadOptionValue", o)
+				}
+				req, err := parseModifiers(o, strings.TrimPrefix(strings.TrimSpace(m), ks[1]))
+				if err != nil {
+					return nil, err
+				}
+				// presence is governed by the group
+				req.mandatory = false
+				opts.keys[ks[1]] = req
+				opts.order = append(opts.order, ks[1])
+				g.keys = append(g.keys, ks[1])
+			}
+			if len(g.keys) < 2 {
+				return nil, NewErrorContextQuoted("ErrBadOptionValue", o).SetSupplementary("a group needs at least two keys")
+			}
+			opts.groups = append(opts.groups, g)
+			continue
+		}
 		s := regexp.MustCompile("^(\\w+)(.*)$").FindStringSubmatch(o)
 		if len(s) < 3 || s[1] == "" {
 			return nil, NewErrorContextQuoted("ErrBadOptionValue", o)
 		}
-		req := requirement{mandatory: true, array: false, r: optrange{-1, -1}}
-		if s[2] != "" {
-			optslice := regexp.MustCompile("[*+!?]|\\{\\d+,\\d*\\}").FindAllStringSubmatch(s[2], -1)
-			if len(optslice) == 0 {
-				return nil, NewErrorContextQuoted("ErrBadOptionModifier", o)
-			}
-			for _, c := range optslice {
-				if len(c) != 1 {
-					return nil, NewErrorContextQuoted("ErrBadOptionModifier", o)
-				}
-				switch {
-				case c[0] == "?":
-					req.mandatory = false
-				case c[0] == "!":
-					req.mandatory = true
-				case c[0] == "+":
-					req.r = optrange{1, -1}
-					req.array = true
-				case c[0] == "*":
-					req.array = true
-					req.r = optrange{0, -1}
-				case strings.HasPrefix(c[0], "{"):
-					minMax := regexp.MustCompile("^\\{(\\d+),(\\d*)\\}$").FindStringSubmatch(c[0])
-					if len(minMax) != 3 {
-						return nil, NewErrorContextQuoted("ErrBadRangeOptionModifier", o)
-					}
-					min, err1 := strconv.Atoi(minMax[1])
-					if err1 != nil {
-						return nil, NewErrorContextQuoted("ErrBadRangeOptionModifierValue", o)
-					}
-					max := -1
-					if minMax[2] != "" {
-						max, err2 := strconv.Atoi(minMax[2])
-						if (err2 != nil) || (min > max) {
-							return nil, NewErrorContextQuoted("ErrBadRangeOptionModifierValue", o)
-						}
-					}
-					req.array = true
-					req.r = optrange{min, max}
-				default:
-					return nil, NewErrorContextQuoted("ErrBadOptionModifier", o)
-				}
-			}
+		req, err := parseModifiers(o, s[2])
+		if err != nil {
+			return nil, err
 		}
-		opts[s[1]] = req
+		opts.keys[s[1]] = req
+		opts.order = append(opts.order, s[1])
 	}
 
 	return &opts, nil
 }
 
-func newCompiledTemplate() *CompiledTemplate {
-	return &CompiledTemplate{s: make(map[string]interface{})}
+func newCompiledTemplate(opts CompileOptions) *CompiledTemplate {
+	return &CompiledTemplate{s: make(map[string]interface{}), opts: opts}
 }
 
+// enum returns the named enum given as `@name`
+func (opts CompileOptions) enum(name string) (EnumType, *CdlError) {
+	if e, ok := opts.Enums[strings.TrimPrefix(name, "@")]; ok {
+		return e, nil
+	}
+	return EnumType{}, NewError("ErrUnknownType").SetSupplementary(fmt.Sprintf("unknown enum '%s'", name))
+}
+
+// set looks up a named set, e.g. `#countries`
+func (opts CompileOptions) set(name string) (*stringSet, *CdlError) {
+	if values, ok := opts.Sets[strings.TrimPrefix(name, "#")]; ok {
+		return newStringSet(strings.TrimPrefix(name, "#"), values), nil
+	}
+	return nil, NewError("ErrUnknownType").SetSupplementary(fmt.Sprintf("unknown set '%s'", name))
+}
+
+// named looks up a named enum (e.g. `@palette`) or a named set (e.g.
+// `#countries`)
+func (opts CompileOptions) named(name string) (interface{}, *CdlError) {
+	if strings.HasPrefix(name, "#") {
+		return opts.set(name)
+	}
+	return opts.enum(name)
+}
+
+// isSecret returns true if the key at pos is listed in SecretKeys, either
+// as it is or, for a qualified key, without its parent
+func (opts CompileOptions) isSecret(pos string) bool {
+	for _, k := range opts.SecretKeys {
+		if k == pos || strings.HasSuffix(pos, "."+k) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveType looks up a type name with the TypeResolver, if any
+func (opts CompileOptions) resolveType(name string) (reflect.Type, bool) {
+	if opts.TypeResolver == nil {
+		return nil, false
+	}
+	return opts.TypeResolver(name)
+}
+
+// var DefaultCompileOptions holds the options used by Compile.
+//
+// An application may set this once to change the behaviour of all subsequent
+// calls to Compile; CompileWithOptions ignores it.
+var DefaultCompileOptions CompileOptions
+
 // func Compile compiles a specified cdl template.
+//
+// The template is compiled with DefaultCompileOptions.
 func Compile(t Template) (*CompiledTemplate, error) {
-	ct := newCompiledTemplate()
+	return CompileWithOptions(t, DefaultCompileOptions)
+}
+
+// func CompileWithOptions compiles a specified cdl template using the specified options.
+func CompileWithOptions(t Template, opts CompileOptions) (*CompiledTemplate, error) {
+	ct := newCompiledTemplate(opts)
+	ct.source = make(Template, len(t))
 	for k, v := range t {
-		if match, err := regexp.MatchString("^(/|(\\w+))?$", k); !match || err != nil {
+		ct.source[k] = v
+	}
+	for k, v := range t {
+		if match, err := regexp.MatchString("^(/|(\\w+)|(\\w+\\.\\w+))?$", k); !match || err != nil {
 			return nil, NewErrorContextQuoted("ErrBadKey", k)
 		}
+		if strings.Contains(k, ".") {
+			ct.qualified = true
+		}
 		switch t := v.(type) {
 		case string:
 			if t == "" {
 				t = "/"
 			}
 			switch {
+			case strings.HasPrefix(t, "{}:"):
+				// a map whose values share a single specification
+				name := strings.TrimPrefix(t, "{}:")
+				if !regexp.MustCompile("^[@#]?\\w+$").MatchString(name) {
+					return nil, NewErrorContextQuoted("ErrBadOptionValue", t).AddContextQuoted(k)
+				}
+				if strings.HasPrefix(name, "@") || strings.HasPrefix(name, "#") {
+					// an inline enum or set
+					if spec, err := opts.named(name); err != nil {
+						return nil, err.AddContextQuoted(k)
+					} else {
+						ct.s[":"+name] = spec
+					}
+					name = ":" + name
+				} else if isTypeName(name) {
+					// an inline type rather than a key
+					ct.s[":"+name] = name
+					name = ":" + name
+				}
+				ct.s[k] = &options{
+					keys:    make(map[string]requirement),
+					extra:   &pattern{name: name, req: requirement{r: OptRange{-1, -1}}},
+					present: OptRange{-1, -1},
+					shared:  true,
+				}
 			case strings.HasPrefix(t, "{}"):
 				if o, err := makeOptions(strings.TrimPrefix(t, "{}")); err != nil {
 					return nil, err.AddContextQuoted(k)
 				} else {
 					ct.s[k] = o
 				}
+			case strings.HasPrefix(t, "oneof(") && strings.HasSuffix(t, ")"):
+				u := &union{}
+				for _, e := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(t, "oneof("), ")"), "|") {
+					e = strings.TrimSpace(e)
+					if !regexp.MustCompile("^[@#]?\\w+$").MatchString(e) {
+						return nil, NewErrorContextQuoted("ErrBadOptionValue", e).AddContextQuoted(k)
+					}
+					if strings.HasPrefix(e, "@") || strings.HasPrefix(e, "#") {
+						// an inline enum or set
+						if spec, err := opts.named(e); err != nil {
+							return nil, err.AddContextQuoted(k)
+						} else {
+							ct.s[":"+e] = spec
+						}
+						e = ":" + e
+					} else if isTypeName(e) {
+						// an inline type rather than a key
+						ct.s[":"+e] = e
+						e = ":" + e
+					}
+					u.names = append(u.names, e)
+				}
+				ct.s[k] = u
+			case strings.HasPrefix(t, "(") && strings.HasSuffix(t, ")"):
+				tup := &tuple{}
+				for _, e := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(t, "("), ")"), ",") {
+					e = strings.TrimSpace(e)
+					if !regexp.MustCompile("^[@#]?\\w+$").MatchString(e) {
+						return nil, NewErrorContextQuoted("ErrBadOptionValue", e).AddContextQuoted(k)
+					}
+					if strings.HasPrefix(e, "@") || strings.HasPrefix(e, "#") {
+						// an inline enum or set
+						if spec, err := opts.named(e); err != nil {
+							return nil, err.AddContextQuoted(k)
+						} else {
+							ct.s[":"+e] = spec
+						}
+						e = ":" + e
+					} else if isTypeName(e) {
+						// an inline type rather than a key
+						ct.s[":"+e] = e
+						e = ":" + e
+					}
+					tup.names = append(tup.names, e)
+				}
+				ct.s[k] = tup
 			case strings.HasPrefix(t, "[]"):
 				arr := strings.TrimPrefix(t, "[]")
-				rng := optrange{-1, -1}
-				minMax := regexp.MustCompile("^(\\w+)(\\{(\\d+),(\\d*)\\})?$").FindStringSubmatch(arr)
-				if len(minMax) != 5 {
+				rng := OptRange{-1, -1}
+				minMax := regexp.MustCompile("^([@#]?\\w+)(\\{(\\d*),(\\d*)\\})?( sorted(-?))?( unique)?$").FindStringSubmatch(arr)
+				if len(minMax) != 8 {
 					return nil, NewErrorContextQuoted("ErrBadRangeOptionModifier", arr)
 				}
-				if minMax[3] != "" {
-					min, err1 := strconv.Atoi(minMax[3])
-					if err1 != nil {
+				if minMax[2] != "" {
+					r, ok := parseRange(minMax[3], minMax[4])
+					if !ok {
 						return nil, NewErrorContextQuoted("ErrBadRangeOptionModifierValue", arr)
 					}
-					max := -1
-					if minMax[4] != "" {
-						var err2 error
-						max, err2 = strconv.Atoi(minMax[4])
-						if (err2 != nil) || (min > max) {
-							return nil, NewErrorContextQuoted("ErrBadRangeOptionModifierValue", arr)
-						}
+					rng = r
+				}
+				name := minMax[1]
+				if strings.HasPrefix(name, "@") || strings.HasPrefix(name, "#") {
+					// an inline enum or set
+					if spec, err := opts.named(name); err != nil {
+						return nil, err.AddContextQuoted(k)
+					} else {
+						ct.s[":"+name] = spec
+					}
+					name = ":" + name
+				} else if isTypeName(name) {
+					// an inline type rather than a key
+					ct.s[":"+name] = name
+					name = ":" + name
+				}
+				a := &array{name: name, r: rng, unique: minMax[7] != ""}
+				if minMax[5] != "" {
+					a.order = 1
+					if minMax[6] != "" {
+						a.order = -1
 					}
-					rng = optrange{min, max}
 				}
-				ct.s[k] = &array{name: minMax[1], r: rng}
+				ct.s[k] = a
+			case strings.HasPrefix(t, "#"):
+				if set, err := opts.set(t); err != nil {
+					return nil, err.AddContextQuoted(k)
+				} else {
+					ct.s[k] = set
+				}
+			case strings.HasPrefix(t, "@"):
+				if e, err := opts.enum(t); err != nil {
+					return nil, err.AddContextQuoted(k)
+				} else {
+					ct.s[k] = e
+				}
+			case isStringSpec(t):
+				if ss, err := makeStringSpec(t); err != nil {
+					return nil, err.AddContextQuoted(k)
+				} else {
+					ct.s[k] = ss
+				}
+			case strings.HasPrefix(t, "!="):
+				ct.s[k] = newLiteral(strings.TrimPrefix(t, "!="), true)
+			case strings.HasPrefix(t, "="):
+				ct.s[k] = newLiteral(strings.TrimPrefix(t, "="), false)
 			default:
+				if _, resolved := opts.resolveType(t); opts.Strict && !resolved {
+					if err := checkTypeName(t); err != nil {
+						return nil, err.AddContextQuoted(k)
+					}
+				}
 				ct.s[k] = t
 			}
 		case EnumType:
@@ -168,6 +1016,10 @@ func Compile(t Template) (*CompiledTemplate, error) {
 			ct.s[k] = t
 		case func(interface{}) *CdlError: // in case they didn't cast it
 			ct.s[k] = ValidatorFunc(t)
+		case TransformFunc:
+			ct.s[k] = t
+		case func(interface{}) (interface{}, *CdlError): // in case they didn't cast it
+			ct.s[k] = TransformFunc(t)
 		default:
 			return nil, NewErrorContextQuoted("ErrBadValue", fmt.Sprintf("%T", t)).AddContextQuoted(k)
 		}
@@ -175,16 +1027,63 @@ func Compile(t Template) (*CompiledTemplate, error) {
 	for _, v := range ct.s {
 		switch t := v.(type) {
 		case *options:
-			for optk, _ := range *t {
+			for optk, _ := range t.keys {
 				if _, ok := ct.s[optk]; !ok {
 					ct.s[optk] = 0 // autodiscovered
 				}
 			}
+			for _, p := range t.patterns {
+				if _, ok := ct.s[p.name]; !ok {
+					ct.s[p.name] = 0 // autodiscovered
+				}
+			}
+			if t.extra != nil {
+				if t.extraType != "" {
+					var extraSpec interface{} = t.extraType
+					if strings.HasPrefix(t.extraType, "@") || strings.HasPrefix(t.extraType, "#") {
+						if spec, err := opts.named(t.extraType); err != nil {
+							return nil, err.AddContextQuoted("..." + t.extra.name + ":" + t.extraType)
+						} else {
+							extraSpec = spec
+						}
+					}
+					if spec, ok := ct.s[t.extra.name]; ok && spec != 0 && !reflect.DeepEqual(spec, extraSpec) {
+						return nil, NewErrorContextQuoted("ErrBadOptionValue", "..."+t.extra.name+":"+t.extraType).
+							SetSupplementary("key already has a different specification")
+					}
+					ct.s[t.extra.name] = extraSpec
+				} else if _, ok := ct.s[t.extra.name]; !ok {
+					ct.s[t.extra.name] = 0 // autodiscovered
+				}
+			}
+		case *tuple:
+			for _, name := range t.names {
+				if _, ok := ct.s[name]; !ok {
+					ct.s[name] = 0 // autodiscovered
+				}
+			}
+		case *union:
+			for _, name := range t.names {
+				if _, ok := ct.s[name]; !ok {
+					ct.s[name] = 0 // autodiscovered
+				}
+			}
 		}
 	}
 	if _, ok := ct.s["/"]; !ok {
 		return nil, NewError("ErrMissingRoot")
 	}
+	if err := ct.checkSortable(); err != nil {
+		return nil, err
+	}
+	if err := ct.checkUnions(); err != nil {
+		return nil, err
+	}
+	for _, v := range ct.s {
+		if u, ok := v.(*union); ok {
+			u.reach = ct.reachable(u.names)
+		}
+	}
 	return ct, nil
 }
 
@@ -195,92 +1094,453 @@ func MustCompile(t Template) *CompiledTemplate {
 	if error != nil {
 		panic(`cdl: Compile failed: ` + error.Error())
 	}
-	return ct
+	return ct
+}
+
+func (ct *CompiledTemplate) validateRange(o interface{}, a *array, st *state, path Path) (err *CdlError) {
+	st.visit(path, "array")
+	if st.opts.OnEnter != nil || st.opts.OnExit != nil {
+		st.enter(path, "array")
+		defer func() { st.exit(path, "array", err) }()
+	}
+	slice, ok := asSlice(o)
+	if !ok {
+		return NewError("ErrExpectedArray")
+	}
+	if st.opts.TrimTrailingNulls {
+		for len(slice) > 0 && slice[len(slice)-1] == nil {
+			slice = slice[:len(slice)-1]
+		}
+	}
+	if !a.r.Contains(len(slice)) {
+		err := a.r.newError("ErrOutOfRange", len(slice))
+		if len(slice) != 0 || !st.opts.AllowEmptyArrays {
+			return err
+		}
+		err.warning = true
+		st.check(err, path)
+	}
+	var replaced []interface{}
+	var validated []interface{} // the elements as validated, for comparison
+	if a.order != 0 || a.unique {
+		validated = append([]interface{}(nil), slice...)
+	}
+	for i, v := range slice {
+		if st.skip(path.push(i), v) {
+			continue
+		}
+		if err := ct.validateAndConfigureItem(v, a.name, st, path.push(i)); err != nil {
+			return err.AddContext(fmt.Sprintf("index %d", i))
+		}
+		if validated != nil {
+			validated[i] = st.validated
+		}
+		if st.opts.MutateInPlace {
+			slice[i] = st.value
+		}
+		replaced = replaceElement(replaced, slice, i, st)
+	}
+	if a.order != 0 {
+		if err := ct.checkOrder(validated, a.name, a.order); err != nil {
+			return err
+		}
+	}
+	if a.unique {
+		if err := checkUnique(validated); err != nil {
+			return err
+		}
+	}
+	st.mutated(o, slice)
+	if replaced != nil {
+		st.setReplacement(replaced)
+	}
+	return nil
+}
+
+// mutated records the value of an array validated with MutateInPlace, which is
+// the slice whose elements were replaced, unless it is a copy of a typed slice
+func (st *state) mutated(o interface{}, slice []interface{}) {
+	if !st.opts.MutateInPlace {
+		return
+	}
+	if _, ok := o.([]interface{}); ok {
+		st.value = slice
+	} else {
+		// a typed slice was validated as a copy, and is left unchanged
+		st.value = o
+	}
+}
+
+// replaceElement records the replacement of element i of a slice by a
+// configurator, if any, in a copy of the slice, returning the copy
+func replaceElement(replaced []interface{}, slice []interface{}, i int, st *state) []interface{} {
+	if r, ok := st.takeReplacement(); ok {
+		if replaced == nil {
+			replaced = append([]interface{}(nil), slice...)
+		}
+		replaced[i] = r
+	}
+	return replaced
+}
+
+func (ct *CompiledTemplate) validateTuple(o interface{}, t *tuple, st *state, path Path) (err *CdlError) {
+	st.visit(path, "array")
+	if st.opts.OnEnter != nil || st.opts.OnExit != nil {
+		st.enter(path, "tuple")
+		defer func() { st.exit(path, "tuple", err) }()
+	}
+	slice, ok := asSlice(o)
+	if !ok {
+		return NewError("ErrExpectedArray")
+	}
+	r := OptRange{len(t.names), len(t.names)}
+	if !r.Contains(len(slice)) {
+		return r.newError("ErrOutOfRange", len(slice))
+	}
+	var replaced []interface{}
+	for i, v := range slice {
+		if st.skip(path.push(i), v) {
+			continue
+		}
+		if err := ct.validateAndConfigureItem(v, t.names[i], st, path.push(i)); err != nil {
+			return err.AddContext(fmt.Sprintf("index %d", i))
+		}
+		if st.opts.MutateInPlace {
+			slice[i] = st.value
+		}
+		replaced = replaceElement(replaced, slice, i, st)
+	}
+	st.mutated(o, slice)
+	if replaced != nil {
+		st.setReplacement(replaced)
+	}
+	return nil
+}
+
+func (l *literal) validate(o interface{}) *CdlError {
+	// only values of the literal's type match, so "2" does not match =2
+	ok := false
+	switch want := l.want.(type) {
+	case string:
+		s, isString := o.(string)
+		ok = isString && s == want
+	case float64:
+		f, isNumber := toFloat64(o)
+		ok = isNumber && f == want
+	case bool:
+		b, isBool := o.(bool)
+		ok = isBool && b == want
+	}
+	if l.negate {
+		if ok {
+			return NewError("ErrBadValue").SetSupplementary(fmt.Sprintf("got %v expected anything but %s", o, l.value)).
+				WithField("got", o).
+				WithField("forbidden", l.value)
+		}
+		return nil
+	}
+	if !ok {
+		return NewError("ErrBadValue").SetSupplementary(fmt.Sprintf("got %v expected %s", o, l.value)).
+			WithField("got", o).
+			WithField("expected", l.value)
+	}
+	return nil
+}
+
+// isZero returns true if an object is nil, an empty string, zero, or an empty array or map
+func isZero(o interface{}) bool {
+	if o == nil {
+		return true
+	}
+	if f, ok := toFloat64(o); ok {
+		return f == 0
+	}
+	switch v := reflect.ValueOf(o); v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	}
+	return false
+}
+
+// match returns the first pattern matching a key, failing which the catch-all
+// for extra keys, or nil
+func (opts *options) match(k string) *pattern {
+	for i := range opts.patterns {
+		if opts.patterns[i].re.MatchString(k) {
+			return &opts.patterns[i]
+		}
+	}
+	return opts.extra
+}
+
+func (ct *CompiledTemplate) validateElement(v interface{}, pos string, req requirement, st *state, path Path) *CdlError {
+	if req.forbidden {
+		return NewError("ErrBadKey").SetSupplementary("key is forbidden")
+	}
+	if req.nonzero && isZero(v) {
+		return NewError("ErrEmptyValue").SetSupplementary(fmt.Sprintf("got %#v", v)).WithField("got", v)
+	}
+	if req.array {
+		return ct.validateRange(st.wrap(v), &array{name: pos, r: req.r}, st, path)
+	}
+	return ct.validateAndConfigureItem(v, pos, st, path)
+}
+
+// qualify returns the key qualified by its parent (e.g. `planet.name`) if the
+// template specifies it, else the key itself
+func (ct *CompiledTemplate) qualify(parent string, k string) string {
+	if ct.qualified {
+		if q := parent + "." + k; ct.s[q] != nil {
+			return q
+		}
+	}
+	return k
+}
+
+// checkLengths checks the lengths of arrays in a map against the numbers
+// given by the LengthMatches compile option
+func (ct *CompiledTemplate) checkLengths(m map[string]interface{}) *CdlError {
+	if len(ct.opts.LengthMatches) == 0 {
+		return nil
+	}
+	arrays := make([]string, 0, len(ct.opts.LengthMatches))
+	for k := range ct.opts.LengthMatches {
+		arrays = append(arrays, k)
+	}
+	sort.Strings(arrays)
+	for _, k := range arrays {
+		countKey := ct.opts.LengthMatches[k]
+		a, ok := asSlice(m[k])
+		if !ok {
+			continue
+		}
+		count, ok := toFloat64(m[countKey])
+		if !ok {
+			continue
+		}
+		if float64(len(a)) != count {
+			return NewErrorContextQuoted("ErrOutOfRange", k).SetSupplementary(fmt.Sprintf("got %d entries, expecting %v as given by '%s'", len(a), count, countKey)).
+				WithField("got", len(a)).
+				WithField("expected", count)
+		}
+	}
+	return nil
 }
 
-func (ct *CompiledTemplate) validateRange(o interface{}, pos string, r optrange, configurator Configurator, path Path) *CdlError {
-	slice, ok := o.([]interface{})
-	if !ok {
-		return NewError("ErrExpectedArray")
+// applyDefaults validates the defaults for optional keys absent from a map
+func (ct *CompiledTemplate) applyDefaults(o interface{}, m map[string]interface{}, pos string, opts *options, st *state, path Path) *CdlError {
+	if len(ct.opts.Defaults) == 0 {
+		return nil
 	}
-	if !r.contains(len(slice)) {
-		return NewError("ErrOutOfRange").SetSupplementary(r.describeError(len(slice)))
+	var absent []string
+	for k, req := range opts.keys {
+		if _, ok := m[k]; !ok && !req.mandatory && !req.forbidden {
+			absent = append(absent, k)
+		}
 	}
-	for i, v := range slice {
-		if err := ct.validateAndConfigureItem(v, pos, configurator, path.push(i)); err != nil {
-			return err.AddContext(fmt.Sprintf("index %d", i))
+	sort.Strings(absent)
+	for _, k := range absent {
+		d, ok := ct.opts.Defaults[pos+"."+k]
+		if !ok {
+			if d, ok = ct.opts.Defaults[k]; !ok {
+				continue
+			}
+		}
+		// each document receives its own copy of the default
+		d = copyTree(d)
+		if err := ct.validateElement(d, ct.qualify(pos, k), opts.keys[k], st, path.push(k)); err != nil {
+			return err.AddContextQuoted(k)
+		}
+		// a default is not part of the map passed to its configurator
+		st.takeReplacement()
+		if st.opts.MutateInPlace {
+			switch mm := o.(type) {
+			case map[string]interface{}:
+				mm[k] = d
+			case *OrderedMap:
+				mm.Set(k, d)
+			}
+			st.replace(o, k)
 		}
 	}
 	return nil
 }
 
-func (ct *CompiledTemplate) validateMap(o interface{}, pos string, opts *options, configurator Configurator, path Path) *CdlError {
-	m, ok := o.(map[string]interface{})
-	if !ok {
-		return NewError("ErrExpectedMap")
+func (ct *CompiledTemplate) validateMap(o interface{}, pos string, opts *options, st *state, path Path) (err *CdlError) {
+	st.visit(path, "map")
+	if st.opts.OnEnter != nil || st.opts.OnExit != nil {
+		st.enter(path, "map")
+		defer func() { st.exit(path, "map", err) }()
 	}
-	mand := make(map[string]bool)
-	for k, v := range *opts {
-		switch t := v.(type) {
-		case requirement:
-			if t.mandatory {
-				mand[k] = true
+	m, err := asMap(o, st.opts.StringifyKeys)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	// iterate in sorted order so the error reported is deterministic
+	sort.Strings(keys)
+	ignore := opts.ignore || st.opts.IgnoreUnknownKeys
+	if st.opts.AllUnknownKeys && !ignore {
+		var unknown []string
+		for _, k := range keys {
+			if _, ok := opts.keys[k]; !ok && opts.match(k) == nil && !st.skip(path.push(k), m[k]) {
+				st.unknownKey(path, k)
+				unknown = append(unknown, fmt.Sprintf("'%s'", k))
 			}
 		}
+		if len(unknown) != 0 {
+			sort.Strings(unknown)
+			return NewError("ErrBadKey").SetSupplementary(fmt.Sprintf("unknown keys: %s", strings.Join(unknown, ", "))).WithField("unknown", unknown)
+		}
 	}
-	for k, v := range m {
-		if o, ok := (*opts)[k]; !ok {
-			return NewErrorContextQuoted("ErrBadKey", k)
-		} else {
-			switch t := o.(type) {
-			case requirement:
-				if t.array {
-					if err := ct.validateRange(v, k, t.r, configurator, path.push(k)); err != nil {
-						return err.AddContextQuoted(k)
-					}
-				} else {
-					if err := ct.validateAndConfigureItem(v, k, configurator, path.push(k)); err != nil {
-						return err.AddContextQuoted(k)
-					}
+	var replaced map[string]interface{} // a copy of the map, if a configurator replaced any value
+	mand := make(map[string]bool)
+	for k, t := range opts.keys {
+		if t.mandatory {
+			mand[k] = true
+		}
+	}
+	for _, k := range keys {
+		v := m[k]
+		if st.skip(path.push(k), v) {
+			delete(mand, k)
+			continue
+		}
+		if t, ok := opts.keys[k]; !ok {
+			p := opts.match(k)
+			if p == nil {
+				st.unknownKey(path, k)
+				if ignore {
+					continue
 				}
-				if t.mandatory {
-					delete(mand, k)
+				if len(opts.patterns) != 0 {
+					return NewErrorContextQuoted("ErrBadKey", k).SetSupplementary("key does not match any pattern")
+				}
+				return NewErrorContextQuoted("ErrBadKey", k)
+			}
+			if err := ct.validateElement(v, ct.qualify(pos, p.name), p.req, st, path.push(k)); err != nil {
+				return err.AddContextQuoted(k)
+			}
+			st.replace(o, k)
+		} else {
+			if err := ct.validateElement(v, ct.qualify(pos, k), t, st, path.push(k)); err != nil {
+				return err.AddContextQuoted(k)
+			}
+			st.replace(o, k)
+			if t.mandatory {
+				delete(mand, k)
+			}
+		}
+		if r, ok := st.takeReplacement(); ok {
+			if replaced == nil {
+				replaced = make(map[string]interface{}, len(m))
+				for mk, mv := range m {
+					replaced[mk] = mv
 				}
 			}
+			replaced[k] = r
 		}
 	}
-	if len(mand) != 0 {
+	if om, ok := o.(*OrderedMap); ok && st.opts.EnforceOrder {
+		if err := opts.checkKeyOrder(om.Keys); err != nil {
+			return err
+		}
+	}
+	if err := ct.applyDefaults(o, m, pos, opts, st, path); err != nil {
+		return err
+	}
+	if len(mand) != 0 && !st.opts.Partial {
 		missing := make([]string, len(mand))
 		i := 0
 		for k := range mand {
 			missing[i] = fmt.Sprintf("'%s'", k)
 			i++
 		}
-		return NewError("ErrMissingMandatory").SetSupplementary(fmt.Sprintf("missing %s", strings.Join(missing, ", ")))
+		sort.Strings(missing)
+		return NewError("ErrMissingMandatory").SetSupplementary(fmt.Sprintf("missing %s", strings.Join(missing, ", "))).WithField("missing", missing)
+	}
+	for _, g := range opts.groups {
+		var present []string
+		for _, k := range g.keys {
+			if _, ok := m[k]; ok {
+				present = append(present, fmt.Sprintf("'%s'", k))
+			}
+		}
+		if len(present) > 1 {
+			return NewError("ErrExclusiveKeys").SetSupplementary(fmt.Sprintf("only one of %s may be present", strings.Join(present, ", "))).WithField("present", present)
+		}
+		if len(present) == 0 && !g.optional && !st.opts.Partial {
+			missing := make([]string, len(g.keys))
+			for i, k := range g.keys {
+				missing[i] = fmt.Sprintf("'%s'", k)
+			}
+			return NewError("ErrMissingMandatory").SetSupplementary(fmt.Sprintf("missing one of %s", strings.Join(missing, ", "))).WithField("missing", missing)
+		}
+	}
+	if err := ct.checkLengths(m); err != nil {
+		return err
+	}
+	if !opts.present.Contains(len(m)) {
+		err := opts.present.newError("ErrValueOutOfRange", len(m))
+		return err.SetSupplementary("keys present: " + err.Supplementary)
+	}
+	if st.opts.PresentOptional {
+		present := []string{}
+		for _, k := range keys {
+			if t, ok := opts.keys[k]; ok && !t.mandatory {
+				present = append(present, k)
+			}
+		}
+		if st.result.PresentOptional == nil {
+			st.result.PresentOptional = make(map[string][]string)
+		}
+		st.result.PresentOptional[path.String()] = present
+	}
+	if replaced != nil {
+		if om, ok := o.(*OrderedMap); ok {
+			st.setReplacement(&OrderedMap{Keys: om.Keys, Values: replaced})
+		} else {
+			st.setReplacement(replaced)
+		}
 	}
 	return nil
 }
 
-func (ct *CompiledTemplate) validateItem(o interface{}, pos string, configurator Configurator, path Path) *CdlError {
+func (ct *CompiledTemplate) validateItem(o interface{}, pos string, st *state, path Path) *CdlError {
 	if val, ok := ct.s[pos]; !ok {
 		return NewError("ErrUnknownKey")
 	} else {
 		switch t := val.(type) {
 		case ValidatorFunc:
-			return t(o)
+			return st.check(st.run(t, o), path)
+		case TransformFunc:
+			// already applied by validateAndConfigureItem
 		case EnumType:
 			switch n := o.(type) {
 			case string:
 				if !t.Has(n) {
-					return NewError("ErrBadEnumValue").SetSupplementary(fmt.Sprintf("unknown value '%s'", n))
+					return newBadEnumValueError(n, t)
 				}
 			default:
-				return NewError("ErrBadType").SetSupplementary(fmt.Sprintf("got %T expected an option as a string", o))
+				return newBadTypeError(o, "an option as a string")
 			}
 		case *options:
-			return ct.validateMap(o, pos, t, configurator, path)
+			return ct.validateMap(o, pos, t, st, path)
+		case *union:
+			return ct.validateUnion(o, t, st, path)
+		case *stringSet:
+			return t.validate(o)
 		case *array:
-			return ct.validateRange(o, t.name, t.r, configurator, path)
+			return ct.validateRange(o, t, st, path)
+		case *tuple:
+			return ct.validateTuple(o, t, st, path)
+		case *literal:
+			return t.validate(o)
+		case *stringSpec:
+			return t.validate(o)
 		case string:
 			ok := false
 			switch t {
@@ -309,13 +1569,77 @@ func (ct *CompiledTemplate) validateItem(o interface{}, pos string, configurator
 						ok = true
 					}
 				}
+			case "ip":
+				switch n := o.(type) {
+				case string:
+					ok = net.ParseIP(n) != nil
+				case net.IP:
+					ok = len(n) == net.IPv4len || len(n) == net.IPv6len
+				}
+			case "email":
+				if n, isString := o.(string); isString {
+					if a, err := mail.ParseAddress(n); err == nil && a.Address == n {
+						ok = true
+					}
+				}
+			case "url":
+				if n, isString := o.(string); isString {
+					if u, err := url.Parse(n); err == nil && u.Scheme != "" && u.Host != "" {
+						ok = true
+					}
+				}
+			case "duration":
+				if _, err := toDuration(o); err != nil {
+					return err
+				}
+				ok = true
+			case "timestamp":
+				if _, err := toTimestamp(o); err != nil {
+					return err
+				}
+				ok = true
+			case "bytesize":
+				if _, err := toByteSize(o); err != nil {
+					return err
+				}
+				ok = true
+			case "bytes":
+				_, ok = o.([]byte)
+			case "raw":
+				switch n := o.(type) {
+				case json.RawMessage:
+					ok = json.Valid(n)
+				case []byte:
+					// arbitrary bytes may happen to be valid JSON, e.g. "42"
+					trimmed := bytes.TrimLeft(n, " \t\r\n")
+					ok = len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(n)
+				}
+				if !ok {
+					return NewError("ErrBadType").SetSupplementary(fmt.Sprintf("got %s expected raw JSON", typeName(o))).
+						WithField("got", typeName(o)).
+						WithField("expected", "raw")
+				}
+			case "ipport_numeric", "ipport_host", "ipport_host_numeric":
+				if n, isString := o.(string); isString {
+					if err := validateIPPort(n, strings.HasPrefix(t, "ipport_host"), strings.HasSuffix(t, "_numeric")); err != nil {
+						return err
+					}
+					ok = true
+				}
 			default:
-				if reflect.TypeOf(o).String() == t {
+				if o != nil && reflect.TypeOf(o).String() == t {
+					ok = true
+				} else if rt, resolved := ct.opts.resolveType(t); resolved {
+					ok = reflect.TypeOf(o) == rt
+				} else if sized, isSized := sizedNumericTypes[t]; isSized && isNumber(o) {
+					if _, err := convertNumber(o, sized); err != nil {
+						return err
+					}
 					ok = true
 				}
 			}
 			if !ok {
-				return NewError("ErrBadType").SetSupplementary(fmt.Sprintf("got %T expected %s", o, t))
+				return newPseudoTypeError(o, t)
 			}
 		case int:
 			// autodiscovered
@@ -326,137 +1650,438 @@ func (ct *CompiledTemplate) validateItem(o interface{}, pos string, configurator
 	return nil
 }
 
+func validateIPPort(s string, needHost bool, numeric bool) *CdlError {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return NewError("ErrBadType").SetSupplementary(fmt.Sprintf("'%s' is not a host and port", s)).WithField("got", s)
+	}
+	if needHost && host == "" {
+		return NewError("ErrBadType").SetSupplementary(fmt.Sprintf("'%s' has no host", s)).WithField("got", s)
+	}
+	if numeric {
+		if match, _ := regexp.MatchString("^\\d+$", port); !match {
+			return NewError("ErrBadType").SetSupplementary(fmt.Sprintf("port '%s' is not numeric", port)).WithField("got", port)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return NewError("ErrValueOutOfRange").SetSupplementary(fmt.Sprintf("port %s, expecting between 1 and 65535", port)).
+				WithField("got", port).
+				WithField("min", 1).
+				WithField("max", 65535)
+		}
+	}
+	return nil
+}
+
+func (ct *CompiledTemplate) interpolate(s string) (string, *CdlError) {
+	undefined := []string{}
+	expanded := os.Expand(s, func(name string) string {
+		v, ok := ct.opts.Interpolate(name)
+		if !ok {
+			undefined = append(undefined, fmt.Sprintf("'%s'", name))
+		}
+		return v
+	})
+	if len(undefined) != 0 && !ct.opts.AllowUndefined {
+		return s, NewError("ErrUndefinedVariable").SetSupplementary(fmt.Sprintf("undefined %s", strings.Join(undefined, ", ")))
+	}
+	return expanded, nil
+}
+
 func assign(ptr interface{}, obj interface{}) *CdlError {
 	p := reflect.ValueOf(ptr)
 
 	switch p.Kind() {
 	case reflect.Ptr:
 		v := p.Elem()
-		if v.Type() != reflect.TypeOf(obj) {
+		o := reflect.ValueOf(obj)
+		switch {
+		case v.Kind() == reflect.Interface && v.NumMethod() == 0:
+			// an *interface{} captures whatever value is given, even nil
+			if obj == nil {
+				v.Set(reflect.Zero(v.Type()))
+			} else {
+				v.Set(o)
+			}
+		case obj != nil && o.Type().AssignableTo(v.Type()):
+			v.Set(o)
+		case isNumber(obj) && isNumericKind(v.Kind()):
+			// convert only if the value can be represented exactly
+			n, err := convertNumber(obj, v.Type())
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(n))
+		case obj != nil && o.Kind() == v.Kind() && o.Type().ConvertibleTo(v.Type()):
+			// e.g. a string to a named string type
+			v.Set(o.Convert(v.Type()))
+		default:
 			return NewError("ErrBadType").SetSupplementary(fmt.Sprintf("at configuration got %s expected %s",
-				v.Type().String(),
-				reflect.TypeOf(obj).String()))
+				typeName(obj),
+				v.Type().String())).
+				WithField("got", typeName(obj)).
+				WithField("expected", v.Type().String())
 		}
-		v.Set(reflect.ValueOf(obj))
 		return nil
 	default:
 		return NewError("ErrBadConfigurator").SetSupplementary("got object that is not a pointer")
 	}
 }
 
-func (ct *CompiledTemplate) validateAndConfigureItem(o interface{}, pos string, configurator Configurator, path Path) *CdlError {
-	if err := ct.validateItem(o, pos, configurator, path); err != nil {
+// coerce converts a validated object to the type delivered for a type specification
+//
+// For instance, data validated as a `number` is delivered as a float64.
+func coerce(o interface{}, t string) interface{} {
+	v := o
+	switch t {
+	case "number":
+		switch n := o.(type) {
+		// Go unhelpfully does not allow casting with a multiple case type assertion
+		case int:
+			v = float64(n)
+		case int8:
+			v = float64(n)
+		case int16:
+			v = float64(n)
+		case int32:
+			v = float64(n)
+		case int64:
+			v = float64(n)
+		case uint:
+			v = float64(n)
+		case uint8:
+			v = float64(n)
+		case uint16:
+			v = float64(n)
+		case uint32:
+			v = float64(n)
+		case uint64:
+			v = float64(n)
+		case float32:
+			v = float64(n)
+		case float64:
+			v = float64(n)
+		}
+	case "integer":
+		switch n := o.(type) {
+		// Go unhelpfully does not allow casting with a multiple case type assertion
+		case int:
+			v = int(n)
+		case int8:
+			v = int(n)
+		case int16:
+			v = int(n)
+		case int32:
+			v = int(n)
+		case int64:
+			v = int(n)
+		case uint:
+			v = int(n)
+		case uint8:
+			v = int(n)
+		case uint16:
+			v = int(n)
+		case uint32:
+			v = int(n)
+		case uint64:
+			v = int(n)
+		case float32:
+			v = int(n)
+		case float64:
+			v = int(n)
+		}
+	case "duration":
+		v, _ = toDuration(o)
+	case "timestamp":
+		v, _ = toTimestamp(o)
+	case "bytesize":
+		v, _ = toByteSize(o)
+	case "ip":
+		if n, ok := o.(string); ok {
+			v = net.ParseIP(n)
+		}
+	case "raw":
+		if n, ok := o.([]byte); ok {
+			v = json.RawMessage(n)
+		}
+	default:
+		if sized, isSized := sizedNumericTypes[t]; isSized {
+			if n, err := convertNumber(o, sized); err == nil {
+				v = n
+			}
+		}
+	}
+	return v
+}
+
+// deliver converts a validated object to the value passed to a configurator
+// for the specification val
+//
+// Type specifications are converted by coerce, and enum values become Enums.
+func deliver(val interface{}, o interface{}) (interface{}, *CdlError) {
+	switch t := val.(type) {
+	case string:
+		return coerce(o, t), nil
+	case EnumType:
+		switch n := o.(type) {
+		case string:
+			if !t.Has(n) {
+				return nil, newBadEnumValueError(n, t)
+			}
+			return t.New(n), nil
+		default:
+			return nil, newBadTypeError(o, "an option as a string")
+		}
+	}
+	return o, nil
+}
+
+func (ct *CompiledTemplate) validateAndConfigureItem(o interface{}, pos string, st *state, path Path) (err *CdlError) {
+	if st.opts.OnEnter != nil || st.opts.OnExit != nil {
+		switch ct.s[pos].(type) {
+		case *array, *options, *tuple, *union:
+			// entered by validateRange, validateMap and validateTuple
+		default:
+			st.enter(path, "leaf")
+			// deferred first, so sees the error after any redaction
+			defer func() { st.exit(path, "leaf", err) }()
+		}
+	}
+	if len(ct.opts.SecretKeys) != 0 && ct.opts.isSecret(pos) {
+		warnings := len(st.result.Warnings)
+		defer func() {
+			if err != nil {
+				err.redact()
+			}
+			// as are any warnings about the item
+			for _, w := range st.result.Warnings[warnings:] {
+				w.Err.redact()
+			}
+		}()
+	}
+	if len(path.items) > st.opts.MaxDepth {
+		return NewError("ErrMaxDepth").SetSupplementary(fmt.Sprintf("nesting deeper than %d", st.opts.MaxDepth))
+	}
+	if s, ok := o.(string); ok && ct.opts.Interpolate != nil {
+		var err *CdlError
+		if o, err = ct.interpolate(s); err != nil {
+			return err
+		}
+	}
+	if t, ok := ct.s[pos].(TransformFunc); ok {
+		n, err := t(o)
+		if err = st.check(err, path); err != nil {
+			return err
+		}
+		o = n
+	}
+	if s, ok := o.(string); ok && st.opts.StringNumbers {
+		if t, ok := ct.s[pos].(string); ok {
+			var err *CdlError
+			if o, err = parseNumber(s, t); err != nil {
+				return err
+			}
+		}
+	}
+	if st.opts.WidenNumbers && isNumber(o) {
+		if t, ok := ct.s[pos].(string); ok {
+			if exact, ok := exactNumericTypes[t]; ok {
+				var err *CdlError
+				if o, err = convertNumber(o, exact); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	switch ct.s[pos].(type) {
+	case *array:
+		o = st.wrap(o)
+	case *options, *tuple, *union:
+	default:
+		st.visit(path, "leaf")
+	}
+	if err := ct.validateItem(o, pos, st, path); err != nil {
+		return err
+	}
+	if _, ok := ct.s[pos].(*union); !ok {
+		// a union's value was set by the alternative chosen
+		st.validated = o
+	}
+	switch ct.s[pos].(type) {
+	case *array, *options, *tuple:
+		// not a leaf, even if it is a struct
+	default:
+		if v := typeValidator(o); v != nil {
+			if err := st.check(st.run(v, o), path); err != nil {
+				return err
+			}
+		}
+	}
+	if st.opts.MutateInPlace {
+		switch ct.s[pos].(type) {
+		case *array, *tuple, *union:
+			// the value was set by validateRange, validateTuple or the
+			// alternative chosen
+		default:
+			v, err := deliver(ct.s[pos], o)
+			if err != nil {
+				return err
+			}
+			st.value = v
+		}
+	}
+	if st.replaced {
+		// a configurator replaced something within the item
+		o = st.replacement
+	}
+	if err := ct.configureParts(o, pos, st, path); err != nil {
 		return err
 	}
-	if configurator != nil {
-		if cnf, ok := configurator[pos]; ok && (cnf != nil) {
+	if st.configurator != nil {
+		if cnf := st.configuratorFor(pos, path); cnf != nil {
 			if val, ok := ct.s[pos]; !ok {
 				return NewError("ErrUnknownKey")
 			} else {
-				v := o
-				switch t := val.(type) {
-				case string:
-					switch t {
-					case "number":
-						switch n := o.(type) {
-						// Go unhelpfully does not allow casting with a multiple case type assertion
-						case int:
-							v = float64(n)
-						case int8:
-							v = float64(n)
-						case int16:
-							v = float64(n)
-						case int32:
-							v = float64(n)
-						case int64:
-							v = float64(n)
-						case uint:
-							v = float64(n)
-						case uint8:
-							v = float64(n)
-						case uint16:
-							v = float64(n)
-						case uint32:
-							v = float64(n)
-						case uint64:
-							v = float64(n)
-						case float32:
-							v = float64(n)
-						case float64:
-							v = float64(n)
-						}
-					case "integer":
-						switch n := o.(type) {
-						// Go unhelpfully does not allow casting with a multiple case type assertion
-						case int:
-							v = int(n)
-						case int8:
-							v = int(n)
-						case int16:
-							v = int(n)
-						case int32:
-							v = int(n)
-						case int64:
-							v = int(n)
-						case uint:
-							v = int(n)
-						case uint8:
-							v = int(n)
-						case uint16:
-							v = int(n)
-						case uint32:
-							v = int(n)
-						case uint64:
-							v = int(n)
-						case float32:
-							v = int(n)
-						case float64:
-							v = int(n)
-						}
-					}
-				case EnumType:
-					switch n := o.(type) {
-					case string:
-						if !t.Has(n) {
-							return NewError("ErrBadEnumValue").SetSupplementary(fmt.Sprintf("unknown value '%s'", n))
-						}
-						v = t.New(n)
-					default:
-						return NewError("ErrBadType").SetSupplementary(fmt.Sprintf("got %T expected an option as a string", v))
-					}
+				v, err := deliver(val, o)
+				if err != nil {
+					return err
 				}
-				switch t := cnf.(type) {
-				case ConfiguratorFunc:
-					return t(v, path)
-				case func(interface{}, Path) *CdlError: // in case they didn't cast it
-					return t(v, path)
-				case *Enum:
-					switch n := v.(type) {
-					case string:
-						if !t.Has(n) {
-							return NewError("ErrBadEnumValue").SetSupplementary(fmt.Sprintf("unknown value '%s'", n))
-						}
-						t.Set(n)
-					case Enum: // converted above
-						if !t.Has(n.String()) {
-							return NewError("ErrBadEnumValue").SetSupplementary(fmt.Sprintf("unknown value '%s'", n.String()))
-						}
-						t.Set(n.String())
-					default:
-						return NewError("ErrBadType").SetSupplementary(fmt.Sprintf("got %T expected an option as a string", v))
-					}
-				default:
-					if reflect.ValueOf(cnf).Kind() == reflect.Ptr {
-						if err := assign(cnf, v); err != nil {
-							return err
-						}
-					} else {
-						return NewError("ErrBadConfigurator").SetSupplementary("got unknown type")
-					}
+				return st.configure(cnf, val, o, v, path)
+			}
+		}
+	}
+	return nil
+}
+
+// configure passes a value delivered for an item to its configurator, which is
+// a function or a pointer to a variable
+//
+// The item's specification and undelivered object are used to deliver numbers
+// as the kind of the variable pointed to.
+func (st *state) configure(cnf interface{}, spec interface{}, o interface{}, v interface{}, path Path) *CdlError {
+	if err := st.assignOnce(cnf, path); err != nil {
+		return err
+	}
+	switch t := cnf.(type) {
+	case ConfiguratorFunc:
+		return st.check(t(v, path), path)
+	case func(interface{}, Path) *CdlError: // in case they didn't cast it
+		return st.check(t(v, path), path)
+	case ReplacingConfiguratorFunc:
+		return st.configureReplacing(t, v, path)
+	case sliceAppender:
+		return st.check(t.append(v), path)
+	case pointerField:
+		p := reflect.New(t.field.Type().Elem())
+		if err := st.configure(p.Interface(), spec, o, v, path); err != nil {
+			return err
+		}
+		t.field.Set(p)
+	case func(interface{}, Path) (interface{}, *CdlError):
+		return st.configureReplacing(t, v, path)
+	case *HostPort:
+		hp, err := splitHostPort(v)
+		if err != nil {
+			return err
+		}
+		*t = hp
+	case *Enum:
+		switch n := v.(type) {
+		case string:
+			if t.Type == nil {
+				return NewError("ErrBadConfigurator").SetSupplementary("enum has no type")
+			}
+			if !t.Has(n) {
+				return newBadEnumValueError(n, *t.Type)
+			}
+			t.Set(n)
+		case Enum: // converted by deliver
+			if t.Type == nil {
+				// an uninitialised enum takes the template's type
+				*t = n
+			} else if !t.Has(n.String()) {
+				return newBadEnumValueError(n.String(), *t.Type)
+			}
+			t.Set(n.String())
+		default:
+			return newBadTypeError(v, "an option as a string")
+		}
+	default:
+		if p := reflect.ValueOf(cnf); p.Kind() == reflect.Ptr {
+			// numeric pseudotypes are delivered as the kind of the variable pointed to
+			if spec, ok := spec.(string); ok && (spec == "number" || spec == "integer" || spec == "bytesize") && isNumericKind(p.Type().Elem().Kind()) {
+				n := o
+				if spec == "bytesize" {
+					n = v
+				}
+				var err *CdlError
+				if v, err = convertNumber(n, p.Type().Elem()); err != nil {
+					return err
 				}
 			}
+			if err := assign(cnf, v); err != nil {
+				return err
+			}
+		} else {
+			return NewError("ErrBadConfigurator").SetSupplementary("got unknown type")
+		}
+	}
+	return nil
+}
+
+// configureParts calls the configurators for the parts of a composite
+// pseudotype, i.e. `key.host` and `key.port` for an ipport (or similar)
+//
+// The host is given as a string, and the port as an int if it is numeric.
+func (ct *CompiledTemplate) configureParts(o interface{}, pos string, st *state, path Path) *CdlError {
+	if st.configurator == nil {
+		return nil
+	}
+	if t, ok := ct.s[pos].(string); !ok || !strings.HasPrefix(t, "ipport") {
+		return nil
+	}
+	parts := map[string]interface{}{}
+	for _, part := range []string{"host", "port"} {
+		if cnf, ok := st.configurator[pos+"."+part]; ok {
+			parts[part] = cnf
+		} else if i := strings.LastIndex(pos, "."); i >= 0 {
+			// a key qualified by its parent
+			if cnf, ok := st.configurator[pos[i+1:]+"."+part]; ok {
+				parts[part] = cnf
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	hp, err := splitHostPort(o)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{"host": hp.Host, "port": hp.Port}
+	if n, err := strconv.Atoi(hp.Port); err == nil {
+		values["port"] = n
+	}
+	for _, part := range []string{"host", "port"} {
+		cnf, ok := parts[part]
+		if !ok {
+			continue
 		}
+		if err := st.configure(cnf, nil, values[part], values[part], path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureReplacing calls a configurator function returning a value, which
+// replaces the value configured unless an error (rather than a warning) is
+// returned
+func (st *state) configureReplacing(f func(interface{}, Path) (interface{}, *CdlError), v interface{}, path Path) *CdlError {
+	r, err := f(v, path)
+	if err = st.check(err, path); err != nil {
+		return err
 	}
+	st.setReplacement(r)
 	return nil
 }
 
@@ -464,9 +2089,164 @@ func (ct *CompiledTemplate) validateAndConfigureItem(o interface{}, pos string,
 //
 // Optionally a configurator may be passed. This can be nil if you do not need configurator functions calling
 func (ct *CompiledTemplate) Validate(o interface{}, configurator Configurator) error {
-	path := Path{}
-	if err := ct.validateAndConfigureItem(o, "/", configurator, path); err != nil {
+	if _, err := ct.ValidateWithWarnings(o, configurator); err != nil {
+		return err
+	}
+	return nil
+}
+
+// func ValidateWithWarnings validates an object against a cdl template, returning any warnings.
+//
+// This is like Validate, but if validation succeeds, a Result is returned containing
+// the warnings produced (with their paths) by validator and configurator functions.
+func (ct *CompiledTemplate) ValidateWithWarnings(o interface{}, configurator Configurator) (*Result, error) {
+	return ct.ValidateWithOptions(o, configurator, ValidateOptions{})
+}
+
+// func ValidateWithOptions validates an object against a cdl template using the specified options.
+//
+// This is like ValidateWithWarnings, but the behaviour of validation may be altered by
+// the options passed.
+func (ct *CompiledTemplate) ValidateWithOptions(o interface{}, configurator Configurator, opts ValidateOptions) (*Result, error) {
+	st, err := ct.validate(o, configurator, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &st.result, nil
+}
+
+// validate validates an object from the root, returning the state reached
+func (ct *CompiledTemplate) validate(o interface{}, configurator Configurator, opts ValidateOptions) (*state, *CdlError) {
+	st := newState(configurator, opts)
+	if err := ct.validateAndConfigureItem(o, "/", st, Path{}); err != nil {
+		if len(err.Context) == 0 {
+			// the error is at the root
+			err.AddContext("/")
+		}
+		err.maxContext = opts.MaxContextDepth
+		err.WithField("depth", err.Path().Depth())
+		return st, err
+	}
+	return st, nil
+}
+
+// func Typed validates an object against a cdl template, returning a typed copy.
+//
+// The object is copied, and each item in the copy is replaced by the value
+// which would be passed to a configurator (as with the MutateInPlace option),
+// e.g. a `duration` by a time.Duration, an `ip` by a net.IP and an enum value
+// by an Enum. The object passed is not modified. The template must describe a
+// map. A struct (or a pointer to one) is accepted, and copied as a map of its
+// fields.
+func (ct *CompiledTemplate) Typed(o interface{}) (map[string]interface{}, error) {
+	if v := reflect.Indirect(reflect.ValueOf(o)); v.Kind() == reflect.Struct {
+		// cannot fail for a struct
+		o, _ = asMap(o, false)
+	}
+	c := copyTree(o)
+	if _, err := ct.ValidateWithOptions(c, nil, ValidateOptions{MutateInPlace: true}); err != nil {
+		return nil, err
+	}
+	m, ok := c.(map[string]interface{})
+	if !ok {
+		return nil, newBadTypeError(o, "a map").AddContext("/")
+	}
+	return m, nil
+}
+
+// copyTree makes a deep copy of the maps and arrays within an object, so that
+// it may be mutated in place
+//
+// Maps with string keys are copied as map[string]interface{}; a
+// map[interface{}]interface{} with any other key is copied with its keys
+// unchanged, so is rejected by validation just as the original would be.
+func copyTree(o interface{}) interface{} {
+	switch t := o.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[k] = copyTree(v)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			ks, ok := k.(string)
+			if !ok {
+				break
+			}
+			m[ks] = copyTree(v)
+		}
+		if len(m) == len(t) {
+			return m
+		}
+		mi := make(map[interface{}]interface{}, len(t))
+		for k, v := range t {
+			mi[k] = copyTree(v)
+		}
+		return mi
+	case *OrderedMap:
+		m := &OrderedMap{Keys: append([]string(nil), t.Keys...), Values: make(map[string]interface{}, len(t.Values))}
+		for k, v := range t.Values {
+			m.Values[k] = copyTree(v)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, v := range t {
+			a[i] = copyTree(v)
+		}
+		return a
+	}
+	return o
+}
+
+// func ValidateStats validates an object against a cdl template, returning
+// statistics.
+//
+// This is like Validate, but also returns the number of maps, arrays and
+// leaves visited, and the depth of the deepest, which may be used to detect
+// unexpectedly large documents. The statistics are returned even if
+// validation fails, in which case they cover the items visited before the
+// failure.
+func (ct *CompiledTemplate) ValidateStats(o interface{}, configurator Configurator) (Stats, error) {
+	st, err := ct.validate(o, configurator, ValidateOptions{})
+	if err != nil {
+		return st.stats, err
+	}
+	return st.stats, nil
+}
+
+// func ValidatePartial validates a partial object against a cdl template.
+//
+// This is like Validate, save that mandatory keys may be missing. Types are
+// still checked and unknown keys still rejected. This is useful for validating
+// an update (such as a merge patch) to be applied to a valid object.
+func (ct *CompiledTemplate) ValidatePartial(o interface{}, configurator Configurator) error {
+	if _, err := ct.ValidateWithOptions(o, configurator, ValidateOptions{Partial: true}); err != nil {
 		return err
 	}
 	return nil
 }
+
+// func ValidateEach validates each of a slice of objects against a cdl template.
+//
+// Each object is validated as a separate document. An error is returned for
+// each object which fails validation, with the index of the object in its
+// context (and at the start of any path passed to a configurator function).
+// If all objects are valid, nil is returned.
+func (ct *CompiledTemplate) ValidateEach(items []interface{}, configurator Configurator) []error {
+	var errs []error
+	root := Path{}
+	for i, o := range items {
+		st := newState(configurator, ValidateOptions{})
+		if err := ct.validateAndConfigureItem(o, "/", st, root.push(i)); err != nil {
+			if len(err.Context) == 0 {
+				// the error is at the root of the item
+				err.AddContext("/")
+			}
+			errs = append(errs, err.AddContext(fmt.Sprintf("index %d", i)))
+		}
+	}
+	return errs
+}
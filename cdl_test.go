@@ -2,10 +2,20 @@ package cdl_test
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/abligh/cdl"
+	"io/ioutil"
 	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type checkTemplate map[string]cdl.Template
@@ -98,6 +108,25 @@ var checkTemplates checkTemplate = checkTemplate{
 		"cherry":    "ipport",
 		"tangerine": fruitPart,
 	},
+	"present": cdl.Template{
+		"/": "{}[2,3]a? b? c? d?",
+	},
+	"badpresent1": cdl.Template{
+		"/": "{}[2]a? b?",
+	},
+	"badpresent2": cdl.Template{
+		"/": "{}[3,2]a? b?",
+	},
+	"ipport": cdl.Template{
+		"/":       "{}any? numeric? host?",
+		"any":     "ipport",
+		"numeric": "ipport_numeric",
+		"host":    "ipport_host_numeric",
+	},
+	"forbidden": cdl.Template{
+		"/":     "{}a? b- empty{0,0} tight?{2,2}",
+		"empty": "string",
+	},
 	"integernumberstring": cdl.Template{
 		"/": "{}i? n? s? u? w? e? f?",
 		"n": "number",
@@ -381,6 +410,10 @@ var checkJsons checkJson = checkJson{
 			"blueberry": { "yellow" : 1 }
 		}
 	`,
+	"present1": `{ "a" : 1 }`,
+	"present2": `{ "a" : 1, "c" : 1 }`,
+	"present3": `{ "a" : 1, "b" : 1, "d" : 1 }`,
+	"present4": `{ "a" : 1, "b" : 1, "c" : 1, "d" : 1 }`,
 	"integernumberstring": `
 		{
 			"i" : 1,
@@ -603,28 +636,34 @@ func checkCompile(s string, e string) *cdl.CompiledTemplate {
 }
 
 func checkValidate(ct *cdl.CompiledTemplate, s string, e string, c cdl.Configurator) {
-	var m interface{}
 	if j, ok := checkJsons[s]; !ok {
 		log.Fatalf("Test checkValidate Cannot find template %s", s)
 	} else {
-		if err := json.Unmarshal([]byte(j), &m); err != nil {
-			log.Fatalf("Test checkValidate %s JSON parse error: %v ", s, err)
-		}
+		checkValidateJson(ct, s, j, e, c)
+	}
+}
 
-		if err := ct.Validate(m, c); err != nil {
-			if me, ok := err.(*cdl.CdlError); !ok {
-				log.Fatalf("Test checkValidate %s Bad error return %T", s, err)
-			} else {
-				if me.Type.String() != e {
-					log.Fatalf("Test checkValidate %s Returned unexpected error - expecting '%s' got %v; %s", s, e, me.Type.String(), me.Error())
-				}
-			}
+func checkValidateJson(ct *cdl.CompiledTemplate, s string, j string, e string, c cdl.Configurator) *cdl.CdlError {
+	var m interface{}
+	if err := json.Unmarshal([]byte(j), &m); err != nil {
+		log.Fatalf("Test checkValidate %s JSON parse error: %v ", s, err)
+	}
+
+	if err := ct.Validate(m, c); err != nil {
+		if me, ok := err.(*cdl.CdlError); !ok {
+			log.Fatalf("Test checkValidate %s Bad error return %T", s, err)
 		} else {
-			if e != "" {
-				log.Fatalf("Test checkValidate %s was meant to error with '%s' but didn't", s, e)
+			if me.Type.String() != e {
+				log.Fatalf("Test checkValidate %s Returned unexpected error - expecting '%s' got %v; %s", s, e, me.Type.String(), me.Error())
 			}
+			return me
+		}
+	} else {
+		if e != "" {
+			log.Fatalf("Test checkValidate %s was meant to error with '%s' but didn't", s, e)
 		}
 	}
+	return nil
 }
 
 func TestCompile(t *testing.T) {
@@ -651,6 +690,9 @@ func TestCompile(t *testing.T) {
 	checkCompile("badmap7", "ErrBadOptionModifier")
 	checkCompile("badmap8", "ErrBadRangeOptionModifierValue")
 	checkCompile("integernumberstring", "")
+	checkCompile("present", "")
+	checkCompile("badpresent1", "ErrBadRangeOptionModifier")
+	checkCompile("badpresent2", "ErrBadRangeOptionModifierValue")
 }
 
 func TestValidate(t *testing.T) {
@@ -751,91 +793,3580 @@ func TestValidate(t *testing.T) {
 	checkValidate(ct2, "badintegernumberstring10", "ErrBadType", configurator)
 }
 
-func Example_cdlCompile() {
+func TestEnumText(t *testing.T) {
+	e := fruitPart.New("flesh")
+	if b, err := e.MarshalText(); err != nil || string(b) != "flesh" {
+		log.Fatalf("MarshalText failed: got '%s', %v", string(b), err)
+	}
+	if err := e.UnmarshalText([]byte("pips")); err != nil || e.String() != "pips" {
+		log.Fatalf("UnmarshalText failed: got '%s', %v", e.String(), err)
+	}
+	if err := e.UnmarshalText([]byte("cerebralcortex")); err == nil {
+		log.Fatalf("UnmarshalText accepted an unknown value")
+	}
+	if e.String() != "pips" {
+		log.Fatalf("UnmarshalText of an unknown value changed the enum to '%s'", e.String())
+	}
+	var z cdl.Enum
+	if err := z.UnmarshalText([]byte("pips")); err == nil {
+		log.Fatalf("UnmarshalText accepted a value into an enum without a type")
+	}
+}
 
-	// here's our template
-	template := cdl.Template{
-		"/":     "{}apple peach? pear* plum+ raspberry{1,3} strawberry! kiwi{1,4}? guava!{1,2} orange?{2,31}",
-		"apple": "float64",
+func TestEnumValue(t *testing.T) {
+	e := fruitPart.New("flesh")
+	v, err := e.Value()
+	if err != nil || v != "flesh" {
+		log.Fatalf("Value failed: got %v, %v", v, err)
+	}
+	scanned := fruitPart.New("pips")
+	if err := scanned.Scan(v); err != nil || scanned != e {
+		log.Fatalf("Scan failed: got '%s', %v", scanned.String(), err)
+	}
+	if err := scanned.Scan([]byte("rind")); err != nil || scanned.String() != "rind" {
+		log.Fatalf("Scan of bytes failed: got '%s', %v", scanned.String(), err)
+	}
+	if err := scanned.Scan("cerebralcortex"); err == nil || scanned.String() != "rind" {
+		log.Fatalf("Scan accepted an unknown value: got '%s'", scanned.String())
+	}
+	if err := scanned.Scan(1); err == nil {
+		log.Fatalf("Scan accepted a number")
+	}
+	var z cdl.Enum
+	if v, err := z.Value(); err != nil || v != nil {
+		log.Fatalf("Value of zero enum was %v, %v", v, err)
+	}
+	if z.String() != "" {
+		log.Fatalf("String of zero enum was '%s'", z.String())
+	}
+	if err := z.Scan("pips"); err == nil {
+		log.Fatalf("Scan accepted a value into an enum without a type")
 	}
+	// the zero value round trips, keeping the type of the enum scanned into
+	if v, err = z.Value(); err != nil {
+		log.Fatalf("Value of zero enum failed: %v", err)
+	}
+	if err := scanned.Scan(v); err != nil || scanned != (cdl.Enum{Type: scanned.Type}) || scanned.Type == nil {
+		log.Fatalf("Scan of nil failed: got %#v, %v", scanned, err)
+	}
+	for _, s := range []string{"flesh", "pips", "rind"} {
+		e := fruitPart.New(s)
+		v, err := e.Value()
+		if err != nil {
+			log.Fatalf("Value failed: %v", err)
+		}
+		scanned := fruitPart.New("flesh")
+		if err := scanned.Scan(v); err != nil || scanned != e {
+			log.Fatalf("Value %v did not round trip: got '%s', %v", v, scanned.String(), err)
+		}
+	}
+}
 
-	if ct, err := cdl.Compile(template); err != nil {
-		log.Fatalf("Error on compile: %v", err)
-	} else {
+func TestEnumEntries(t *testing.T) {
+	entries := cdl.ErrorEnum.Entries()
+	if entries["ErrBadType"] != "Bad type" {
+		log.Fatalf("Unexpected entry for ErrBadType '%s'", entries["ErrBadType"])
+	}
+	et := cdl.NewEnumTypeFromEntries(entries)
+	if !reflect.DeepEqual(et.Entries(), entries) {
+		log.Fatalf("Entries did not round trip: %v", et.Entries())
+	}
+	if e := et.New("ErrMissingRoot"); e.Text() != "No root key in template" {
+		log.Fatalf("Round tripped enum has text '%s'", e.Text())
+	}
+	if entries := fruitPart.Entries(); len(entries) != 3 || entries["pips"] != "pips" {
+		log.Fatalf("Unexpected entries %v", entries)
+	}
+}
 
-		// use ct here
-		_ = ct
+func TestEnumFlag(t *testing.T) {
+	part := fruitPart.New("flesh")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(part.Flag(), "part", "fruit part")
+	if err := fs.Parse([]string{"-part", "rind"}); err != nil {
+		log.Fatalf("Flag parse failed: %v", err)
+	}
+	if part.String() != "rind" {
+		log.Fatalf("Flag did not set enum: got '%s'", part.String())
+	}
+	if f := fs.Lookup("part"); f == nil || f.Value.String() != "rind" {
+		log.Fatalf("Flag value does not report enum value")
 	}
 
-	fmt.Println("Success!")
-	// Output: Success!
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Var(part.Flag(), "part", "fruit part")
+	if err := fs.Parse([]string{"-part", "cerebralcortex"}); err == nil {
+		log.Fatalf("Flag parse accepted an unknown value")
+	}
+	if part.String() != "rind" {
+		log.Fatalf("Bad flag changed the enum to '%s'", part.String())
+	}
 }
 
-func Example_cdlValidate() {
+func TestPresent(t *testing.T) {
+	ct := checkCompile("present", "")
+	checkValidate(ct, "present1", "ErrValueOutOfRange", nil)
+	checkValidate(ct, "present2", "", nil)
+	checkValidate(ct, "present3", "", nil)
+	checkValidate(ct, "present4", "ErrValueOutOfRange", nil)
+	err := checkValidateJson(ct, "present5", checkJsons["present4"], "ErrValueOutOfRange", nil)
+	if !strings.HasPrefix(err.Error(), "Value outside permissible range; keys present: ") || err.Details["got"] != 4 {
+		log.Fatalf("Unexpected error for keys present '%s' %v", err.Error(), err.Details)
+	}
+}
 
-	// here's our template
-	template := cdl.Template{
-		"/":     "{}apple peach? pear* plum+ raspberry{1,3} strawberry! kiwi{1,4}? guava!{1,2} orange?{2,31}",
-		"apple": "float64",
-		"peach": func(o interface{}) *cdl.CdlError {
-			if v, ok := o.(float64); !ok {
-				return cdl.NewError("ErrBadValue").SetSupplementary("is not a float64")
-			} else {
-				if v != 1 && v != 2 {
-					return cdl.NewError("ErrBadValue").SetSupplementary("is not 1 or 2")
-				}
-			}
-			return nil
-		},
+func TestPatterns(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":       "{}servers",
+		"servers": "{}/^[a-z][a-z0-9-]*$/server",
+		"server":  "{}host port?",
+		"port":    "integer",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "pattern1", `{ "servers" : { "web-1" : { "host" : "a" }, "db" : { "host" : "b", "port" : 5432 } } }`, "", nil)
+	e := checkValidateJson(ct, "pattern2", `{ "servers" : { "Web_1" : { "host" : "a" } } }`, "ErrBadKey", nil)
+	if p := e.ContextPath(); p != "/servers/Web_1" {
+		log.Fatalf("Unexpected context path '%s'", p)
 	}
+	checkValidateJson(ct, "pattern3", `{ "servers" : { "web" : { "host" : "a", "port" : "x" } } }`, "ErrBadType", nil)
+	for _, spec := range []string{"{}/abc", "{}/[/x", "{}/a/"} {
+		if _, err := cdl.Compile(cdl.Template{"/": spec}); err == nil {
+			log.Fatalf("Compile of '%s' did not fail", spec)
+		}
+	}
+	if _, err := cdl.Compile(cdl.Template{"/": "{}a? /^x|y$/b* /a\\/b/c"}); err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+}
 
-	if ct, err := cdl.Compile(template); err != nil {
-		log.Fatalf("Error on compile: %v", err)
-	} else {
+func TestConfiguratorFromStruct(t *testing.T) {
+	var cfg struct {
+		I     int      `cdl:"i"`
+		N     float64  `cdl:"n"`
+		E     cdl.Enum `cdl:"e"`
+		Other struct {
+			S string `cdl:"s"`
+		}
+		Ignored string
+	}
+	c, err := cdl.ConfiguratorFromStruct(&cfg)
+	if err != nil {
+		log.Fatalf("ConfiguratorFromStruct failed: %v", err)
+	}
+	ct := checkCompile("integernumberstring", "")
+	checkValidate(ct, "integernumberstring", "", c)
+	if cfg.I != 1 || cfg.N != 0.5 || cfg.Other.S != "hello" || cfg.E.String() != "rind" {
+		log.Fatalf("Unexpected struct contents %+v", cfg)
+	}
+	if _, err := cdl.ConfiguratorFromStruct(cfg); err == nil {
+		log.Fatalf("ConfiguratorFromStruct accepted a struct rather than a pointer")
+	}
 
-		var strawberry string
+	// tagged nested structs are bound to qualified keys
+	type limits struct {
+		Min  int   `cdl:"min"`
+		Tags []int `cdl:"tags"`
+	}
+	var nested struct {
+		Low  limits `cdl:"low"`
+		High limits `cdl:"high"`
+	}
+	if c, err = cdl.ConfiguratorFromStruct(&nested); err != nil {
+		log.Fatalf("ConfiguratorFromStruct failed: %v", err)
+	}
+	ct, err = cdl.Compile(cdl.Template{
+		"/":    "{}low high",
+		"low":  "{}min tags*",
+		"high": "{}min tags*",
+		"min":  "integer",
+		"tags": "integer",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "nested", `{ "low" : { "min" : 1, "tags" : [ 2 ] }, "high" : { "min" : 3, "tags" : [ 4, 5 ] } }`, "", c)
+	if nested.Low.Min != 1 || nested.High.Min != 3 || !reflect.DeepEqual(nested.Low.Tags, []int{2}) || !reflect.DeepEqual(nested.High.Tags, []int{4, 5}) {
+		log.Fatalf("Unexpected struct contents %+v", nested)
+	}
+}
 
-		// here's our configurator
-		configurator := cdl.Configurator{
+func TestCompileStruct(t *testing.T) {
+	type limits struct {
+		Min int `cdl:"min"`
+		Max int `cdl:"max?"`
+	}
+	var cfg struct {
+		Name    string        `cdl:"name"`
+		Port    int           `cdl:"port?"`
+		Tags    []string      `cdl:"tags{1,3}"`
+		Ratio   float64       `cdl:"ratio?"`
+		Timeout time.Duration `cdl:"timeout?"`
+		Listen  string        `cdl:"listen?" cdltype:"ipport"`
+		Limits  limits        `cdl:"limits?"`
+		Ignored string
+	}
+	ct, err := cdl.CompileStruct(&cfg)
+	if err != nil {
+		log.Fatalf("CompileStruct failed: %v", err)
+	}
+	c, err := cdl.ConfiguratorFromStruct(&cfg)
+	if err != nil {
+		log.Fatalf("ConfiguratorFromStruct failed: %v", err)
+	}
+	checkValidateJson(ct, "struct1", `{ "name" : "a", "port" : 80, "tags" : [ "x" ], "timeout" : "5s", "limits" : { "min" : 1 } }`, "", c)
+	if cfg.Name != "a" || cfg.Port != 80 || len(cfg.Tags) != 1 || cfg.Timeout != 5*time.Second || cfg.Limits.Min != 1 {
+		log.Fatalf("Unexpected struct contents %+v", cfg)
+	}
+	// slices are emptied by each validation
+	tags := cfg.Tags
+	checkValidateJson(ct, "struct1a", `{ "name" : "a", "tags" : [ "y", "z" ] }`, "", c)
+	if !reflect.DeepEqual(cfg.Tags, []string{"y", "z"}) || tags[0] != "x" {
+		log.Fatalf("Unexpected tags %v after revalidation, previously %v", cfg.Tags, tags)
+	}
+	checkValidateJson(ct, "struct2", `{ "tags" : [ "x" ] }`, "ErrMissingMandatory", nil)
+	checkValidateJson(ct, "struct3", `{ "name" : "a", "tags" : [] }`, "ErrOutOfRange", nil)
+	checkValidateJson(ct, "struct4", `{ "name" : "a", "tags" : [ "x" ], "port" : "80" }`, "ErrBadType", nil)
+	checkValidateJson(ct, "struct5", `{ "name" : "a", "tags" : [ "x" ], "listen" : "nowhere" }`, "ErrBadType", nil)
+	checkValidateJson(ct, "struct6", `{ "name" : "a", "tags" : [ "x" ], "limits" : { "max" : 1 } }`, "ErrMissingMandatory", nil)
+	checkValidateJson(ct, "struct7", `{ "name" : "a", "tags" : [ "x" ], "Ignored" : "" }`, "ErrBadKey", nil)
 
-			// First an easy example using a pointer
-			"strawberry": &strawberry,
+	// pointer fields are allocated when configured
+	var opt struct {
+		Count *int     `cdl:"count?"`
+		Ratio *float64 `cdl:"ratio?"`
+		Name  *string  `cdl:"name?"`
+	}
+	if ct, err = cdl.CompileStruct(&opt); err != nil {
+		log.Fatalf("CompileStruct failed: %v", err)
+	}
+	if c, err = cdl.ConfiguratorFromStruct(&opt); err != nil {
+		log.Fatalf("ConfiguratorFromStruct failed: %v", err)
+	}
+	checkValidateJson(ct, "struct8", `{ "count" : 3, "ratio" : 0.5 }`, "", c)
+	if opt.Count == nil || *opt.Count != 3 || opt.Ratio == nil || *opt.Ratio != 0.5 || opt.Name != nil {
+		log.Fatalf("Unexpected struct contents %+v", opt)
+	}
+	checkValidateJson(ct, "struct9", `{ "count" : 3.5 }`, "ErrBadType", c)
 
-			// Now a more complex example using a string
-			"apple": func(o interface{}, p cdl.Path) *cdl.CdlError {
-				fmt.Printf("Apple is %1.0f - ", o.(float64))
-				return nil
-			},
+	// fields with no specification must be given one
+	for name, s := range map[string]interface{}{
+		"map": &struct {
+			M map[string]string `cdl:"m"`
+		}{},
+		"interface": &struct {
+			I interface{} `cdl:"i"`
+		}{},
+		"enum": &struct {
+			E cdl.Enum `cdl:"e"`
+		}{},
+		"int": 1,
+	} {
+		if _, err := cdl.CompileStruct(s); err == nil {
+			log.Fatalf("CompileStruct accepted %s", name)
+		} else if ce := err.(*cdl.CdlError); ce.Type.String() != "ErrBadConfigurator" {
+			log.Fatalf("CompileStruct of %s gave unexpected error %v", name, err)
 		}
+	}
+	if _, err := cdl.CompileStruct(&struct {
+		M map[string]string `cdl:"m" cdltype:"{}:string"`
+	}{}); err != nil {
+		log.Fatalf("CompileStruct failed with a cdltype tag: %v", err)
+	}
+	if _, err := cdl.ConfiguratorFromStruct(&struct {
+		L *limits `cdl:"l"`
+	}{}); err == nil {
+		log.Fatalf("ConfiguratorFromStruct accepted a pointer to a struct")
+	}
+}
 
-		// Unmarshal some JSON
-		var m interface{}
+func TestStruct(t *testing.T) {
+	type blueberry struct {
+		Red      int
+		Yellow   *string `cdl:"yellow"`
+		Purple   string  `json:"purple,omitempty"`
+		Hidden   string  `cdl:"-"`
+		internal bool
+	}
+	ct, err := cdl.Compile(cdl.Template{
+		"/":      "{}Red yellow? purple?",
+		"Red":    "int",
+		"yellow": "string",
+		"purple": "string",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	yellow := "yes"
+	var red int
+	if err := ct.Validate(blueberry{Red: 1, Yellow: &yellow, Hidden: "x"}, cdl.Configurator{"Red": &red}); err != nil {
+		log.Fatalf("Struct failed to validate: %v", err)
+	}
+	if red != 1 {
+		log.Fatalf("Configurator set %d from struct", red)
+	}
+	if err := ct.Validate(&blueberry{Red: 1, Purple: "x"}, nil); err != nil {
+		log.Fatalf("Struct pointer failed to validate: %v", err)
+	}
+	ct = checkCompile("example", "")
+	err = ct.Validate(map[string]interface{}{
+		"apple": 1.0, "pear": []interface{}{}, "plum": []interface{}{1.0},
+		"raspberry": []interface{}{"a"}, "strawberry": "x", "guava": []interface{}{"c"},
+		"blueberry": struct {
+			Red    int `json:"red"`
+			Orange int `json:"orange"`
+		}{},
+	}, nil)
+	if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrBadKey" {
+		log.Fatalf("Struct with extra field did not return ErrBadKey: %v", err)
+	}
+}
 
-		j := `
-		     {
-				"apple" : 3,
-				"pear" : [],
-				"peach" : 2,
-				"plum" : [ 1 ],
-				"raspberry" : [ "a", "b" ],
-				"strawberry" : "here",
-				"guava": [ "c", "d" ]
-		     }`
+func TestAllUnknownKeys(t *testing.T) {
+	ct := checkCompile("example", "")
+	var m interface{}
+	if err := json.Unmarshal([]byte(`{ "apple" : 1, "appel" : 2, "pair" : [] }`), &m); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	_, err := ct.ValidateWithOptions(m, nil, cdl.ValidateOptions{AllUnknownKeys: true})
+	if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrBadKey" {
+		log.Fatalf("Unexpected error %v", err)
+	} else if !strings.Contains(me.Error(), "unknown keys: 'appel', 'pair'") {
+		log.Fatalf("Unexpected error message '%s'", me.Error())
+	}
+}
 
-		if err := json.Unmarshal([]byte(j), &m); err != nil {
-			log.Fatalf("Cannot unmarshal JSON: %v", err)
+func TestErrorOrder(t *testing.T) {
+	ct := checkCompile("example", "")
+	for i := 0; i < 20; i++ {
+		e := checkValidateJson(ct, "order", `{ "apple" : "x", "strawberry" : 1, "pear" : [], "plum" : [ 1 ], "raspberry" : [ "a" ], "guava" : [ "c" ], "cherry" : 7 }`, "ErrBadType", nil)
+		if p := e.ContextPath(); p != "/apple" {
+			log.Fatalf("Error reported at '%s' rather than '/apple'", p)
 		}
+	}
+}
 
-		// Validate it
-		if err := ct.Validate(m, configurator); err != nil {
-			log.Fatalf("Validation error: %v", err)
+func TestQualifiedKeys(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":            "{}name planets*",
+		"planets":      "{}name moons?",
+		"name":         "string",
+		"planets.name": "string{1,5}",
+		"moons":        "[]name",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "qualified1", `{ "name" : "a long name", "planets" : [ { "name" : "mars", "moons" : [ "a long name" ] } ] }`, "", nil)
+	checkValidateJson(ct, "qualified2", `{ "name" : "a long name", "planets" : [ { "name" : "a long name" } ] }`, "ErrValueOutOfRange", nil)
+	checkValidateJson(ct, "qualified3", `{ "name" : "x", "planets" : [ { "name" : 1 } ] }`, "ErrBadType", nil)
+
+	var names []string
+	c := cdl.Configurator{"name": cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError {
+		names = append(names, o.(string))
+		return nil
+	})}
+	checkValidateJson(ct, "qualified4", `{ "name" : "sol", "planets" : [ { "name" : "mars" } ] }`, "", c)
+	if strings.Join(names, " ") != "sol mars" {
+		log.Fatalf("Configurator called for %v", names)
+	}
+	var planet string
+	names = nil
+	c["planets.name"] = &planet
+	checkValidateJson(ct, "qualified5", `{ "name" : "sol", "planets" : [ { "name" : "mars" } ] }`, "", c)
+	if planet != "mars" || strings.Join(names, " ") != "sol" {
+		log.Fatalf("Configurator set planet %s and was called for %v", planet, names)
+	}
+	if _, err := cdl.Compile(cdl.Template{"/": "{}a", "a.b.c": "string"}); err == nil {
+		log.Fatalf("Compile of doubly qualified key did not fail")
+	}
+}
+
+func TestPathConfigurator(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":      "{}earth mango?",
+		"mango":  "[]planet",
+		"planet": "{}earth venus?",
+		"earth":  "string",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	doc := `{ "earth" : "top", "mango" : [ { "earth" : "first" }, { "earth" : "second", "venus" : 1 } ] }`
+	var nested []string
+	nestedConfigurator := cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError {
+		nested = append(nested, path.String()+"="+o.(string))
+		return nil
+	})
+	checkValidateJson(ct, "pathconfigurator1", doc, "", cdl.Configurator{"/mango/*/earth": nestedConfigurator})
+	if strings.Join(nested, " ") != "/mango/0/earth=first /mango/1/earth=second" {
+		log.Fatalf("Path configurator called for %v", nested)
+	}
+
+	var top string
+	nested = nil
+	checkValidateJson(ct, "pathconfigurator2", doc, "", cdl.Configurator{"/earth": &top, "/mango/*/earth": nestedConfigurator})
+	if top != "top" || len(nested) != 2 {
+		log.Fatalf("Path configurators set top %q nested %v", top, nested)
+	}
+
+	// the most specific key takes precedence
+	var all []string
+	nested = nil
+	checkValidateJson(ct, "pathconfigurator3", doc, "", cdl.Configurator{
+		"earth": cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError {
+			all = append(all, o.(string))
+			return nil
+		}),
+		"/mango/*/earth": nestedConfigurator,
+	})
+	if !reflect.DeepEqual(all, []string{"top"}) || len(nested) != 2 {
+		log.Fatalf("Name configurator called for %v, path configurator for %v", all, nested)
+	}
+	var first string
+	nested = nil
+	checkValidateJson(ct, "pathconfigurator4", doc, "", cdl.Configurator{
+		"/mango/*/earth": nestedConfigurator,
+		"/mango/0/earth": &first,
+	})
+	if first != "first" || strings.Join(nested, " ") != "/mango/1/earth=second" {
+		log.Fatalf("Path configurators set first %q nested %v", first, nested)
+	}
+
+	// a nil configurator does not hide another
+	nested = nil
+	checkValidateJson(ct, "pathconfigurator5", doc, "", cdl.Configurator{"/mango/*/earth": nil, "earth": nestedConfigurator})
+	if len(nested) != 3 {
+		log.Fatalf("Name configurator hidden by nil configurator, called for %v", nested)
+	}
+}
+
+func TestComments(t *testing.T) {
+	plain, err := cdl.Compile(cdl.Template{
+		"/":     "{}apple peach? /^x-/extension*",
+		"apple": "number",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	commented, err := cdl.Compile(cdl.Template{
+		"/":     "{}apple # the quantity\n peach? # optional, may be\n\t/^x-/extension* # any key # starting x-",
+		"apple": "number",
+	})
+	if err != nil {
+		log.Fatalf("Compile with comments failed: %v", err)
+	}
+	if !plain.Equal(commented) {
+		log.Fatalf("Spec with comments compiled differently: %v", plain.Diff(commented))
+	}
+	if _, err := cdl.Compile(cdl.Template{"/": "{}apple#quantity"}); err == nil {
+		log.Fatalf("Compile with comment not starting an element did not fail")
+	}
+}
+
+func TestPresentOptional(t *testing.T) {
+	ct := checkCompile("example", "")
+	var m interface{}
+	if err := json.Unmarshal([]byte(checkJsons["simple2"]), &m); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	result, err := ct.ValidateWithOptions(m, nil, cdl.ValidateOptions{PresentOptional: true})
+	if err != nil {
+		log.Fatalf("Unexpected error: %v", err)
+	}
+	present := map[string]bool{}
+	for _, k := range result.PresentOptional["/"] {
+		present[k] = true
+	}
+	for _, k := range []string{"kiwi", "orange"} {
+		if !present[k] {
+			log.Fatalf("Optional key %s not reported present: %v", k, result.PresentOptional)
+		}
+	}
+	for _, k := range []string{"apple", "strawberry", "mango"} {
+		if present[k] {
+			log.Fatalf("Key %s wrongly reported as a present optional: %v", k, result.PresentOptional)
 		}
+	}
+	if result, err := ct.ValidateWithWarnings(m, nil); err != nil || result.PresentOptional != nil {
+		log.Fatalf("PresentOptional populated without the option: %v %v", result, err)
+	}
+}
 
-		if strawberry != "here" {
-			log.Fatal("Strawberry variable not set correctly")
+func TestPartial(t *testing.T) {
+	ct := checkCompile("example", "")
+	var m interface{}
+	if err := json.Unmarshal([]byte(`{ "apple" : 4, "peach" : 2 }`), &m); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if err := ct.ValidatePartial(m, nil); err != nil {
+		log.Fatalf("Partial validation failed: %v", err)
+	}
+	if me, ok := ct.Validate(m, nil).(*cdl.CdlError); !ok || me.Type.String() != "ErrMissingMandatory" {
+		log.Fatalf("Full validation did not return ErrMissingMandatory")
+	}
+	if err := json.Unmarshal([]byte(`{ "apple" : "x", "pair" : [] }`), &m); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if me, ok := ct.ValidatePartial(m, nil).(*cdl.CdlError); !ok || me.Type.String() != "ErrBadType" {
+		log.Fatalf("Partial validation did not check types")
+	}
+}
+
+func TestInlineArray(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":      "{}names? counts?",
+		"names":  "[]string",
+		"counts": "[]integer{1,3}",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "inline1", `{ "names" : [ "a", "b" ], "counts" : [ 1, 2 ] }`, "", nil)
+	checkValidateJson(ct, "inline2", `{ "names" : [ "a", 2 ] }`, "ErrBadType", nil)
+	checkValidateJson(ct, "inline3", `{ "counts" : [ 1.5 ] }`, "ErrBadType", nil)
+	checkValidateJson(ct, "inline4", `{ "counts" : [] }`, "ErrOutOfRange", nil)
+	checkValidateJson(ct, "inline5", `{ "counts" : [ 1, 2, 3, 4 ] }`, "ErrOutOfRange", nil)
+}
+
+func TestTuple(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":        "{}count? point?",
+		"count":    "(string, integer)",
+		"point":    "(latitude,longitude)",
+		"latitude": "number",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "tuple1", `{ "count" : [ "apples", 3 ] }`, "", nil)
+	e := checkValidateJson(ct, "tuple2", `{ "count" : [ 3, "apples" ] }`, "ErrBadType", nil)
+	if p := e.ContextPath(); p != "/count/0" {
+		log.Fatalf("Unexpected context path '%s'", p)
+	}
+	checkValidateJson(ct, "tuple3", `{ "count" : [ "apples" ] }`, "ErrOutOfRange", nil)
+	checkValidateJson(ct, "tuple4", `{ "count" : [ "apples", 3, 4 ] }`, "ErrOutOfRange", nil)
+	checkValidateJson(ct, "tuple5", `{ "count" : "apples" }`, "ErrExpectedArray", nil)
+	var lat float64
+	checkValidateJson(ct, "tuple6", `{ "point" : [ 51.5, "anything" ] }`, "", cdl.Configurator{"latitude": &lat})
+	if lat != 51.5 {
+		log.Fatalf("Configurator set latitude %v", lat)
+	}
+}
+
+func TestLiteral(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":       "{}kind version radius?",
+		"kind":    "=circle",
+		"version": "=2",
+		"radius":  "number",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "literal1", `{ "kind" : "circle", "version" : 2, "radius" : 1 }`, "", nil)
+	checkValidateJson(ct, "literal2", `{ "kind" : "square", "version" : 2 }`, "ErrBadValue", nil)
+	checkValidateJson(ct, "literal3", `{ "kind" : "circle", "version" : 3 }`, "ErrBadValue", nil)
+	checkValidateJson(ct, "literal4", `{ "kind" : "circle", "version" : "2" }`, "ErrBadValue", nil)
+	checkValidateJson(ct, "literal5", `{ "kind" : 7, "version" : 2 }`, "ErrBadValue", nil)
+	checkValidateJson(ct, "literal6", `{ "kind" : "circle", "version" : 2.0 }`, "", nil)
+	ct, err = cdl.Compile(cdl.Template{
+		"/":       "{}version? enabled? name?",
+		"version": `="2"`,
+		"enabled": "=true",
+		"name":    "=7up",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "literal7", `{ "version" : "2" }`, "", nil)
+	checkValidateJson(ct, "literal8", `{ "version" : 2 }`, "ErrBadValue", nil)
+	checkValidateJson(ct, "literal9", `{ "enabled" : true }`, "", nil)
+	checkValidateJson(ct, "literal10", `{ "enabled" : "true" }`, "ErrBadValue", nil)
+	checkValidateJson(ct, "literal11", `{ "name" : "7up" }`, "", nil)
+}
+
+func TestNotLiteral(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":    "{}user port?",
+		"user": "!=admin",
+		"port": "!=0",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "notliteral1", `{ "user" : "user" }`, "", nil)
+	checkValidateJson(ct, "notliteral2", `{ "user" : "admin" }`, "ErrBadValue", nil)
+	checkValidateJson(ct, "notliteral3", `{ "user" : "user", "port" : 80 }`, "", nil)
+	checkValidateJson(ct, "notliteral4", `{ "user" : "user", "port" : 0 }`, "ErrBadValue", nil)
+	checkValidateJson(ct, "notliteral5", `{ "user" : "user", "port" : "0" }`, "", nil)
+}
+
+func TestOptRange(t *testing.T) {
+	for _, c := range []struct {
+		r     cdl.OptRange
+		s     string
+		in    []int
+		notIn []int
+	}{
+		{cdl.OptRange{Min: 1, Max: 3}, "{1,3}", []int{1, 2, 3}, []int{0, 4}},
+		{cdl.OptRange{Min: 2, Max: -1}, "{2,}", []int{2, 100}, []int{0, 1}},
+		{cdl.OptRange{Min: -1, Max: 2}, "{,2}", []int{0, 2}, []int{3}},
+		{cdl.OptRange{Min: 3, Max: 3}, "{3}", []int{3}, []int{2, 4}},
+		{cdl.OptRange{Min: 0, Max: 0}, "{0}", []int{0}, []int{1}},
+		{cdl.OptRange{Min: -1, Max: -1}, "{0,}", []int{0, 1000}, nil},
+	} {
+		if s := c.r.String(); s != c.s {
+			log.Fatalf("OptRange %#v String() gave '%s' expecting '%s'", c.r, s, c.s)
+		}
+		for _, v := range c.in {
+			if !c.r.Contains(v) {
+				log.Fatalf("OptRange %s does not contain %d", c.r, v)
+			}
+		}
+		for _, v := range c.notIn {
+			if c.r.Contains(v) {
+				log.Fatalf("OptRange %s contains %d", c.r, v)
+			}
 		}
+	}
+}
 
-		fmt.Println("Success!")
-		// Output: Apple is 3 - Success!
+func TestDefaults(t *testing.T) {
+	ct, err := cdl.CompileWithOptions(cdl.Template{
+		"/":         "{}apple blueberry? planets?*",
+		"apple":     "number",
+		"blueberry": "{}red yellow?",
+		"red":       "integer",
+		"planets":   "{}name blueberry?",
+	}, cdl.CompileOptions{Defaults: map[string]interface{}{
+		"blueberry":         map[string]interface{}{"red": 1.0},
+		"planets.blueberry": map[string]interface{}{"red": 2.0},
+		"yellow":            "default",
+	}})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var reds []int
+	var yellow interface{}
+	c := cdl.Configurator{
+		"red": cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError {
+			reds = append(reds, o.(int))
+			return nil
+		}),
+		"yellow": &yellow,
+	}
+	checkValidateJson(ct, "defaults1", `{ "apple" : 1 }`, "", c)
+	if !reflect.DeepEqual(reds, []int{1}) || yellow != "default" {
+		log.Fatalf("Default configurators gave reds %v yellow %v", reds, yellow)
+	}
+	reds = nil
+	checkValidateJson(ct, "defaults2", `{ "apple" : 1, "blueberry" : { "red" : 5, "yellow" : "y" }, "planets" : [ { "name" : "mars" } ] }`, "", c)
+	// the defaulted blueberry in planets is configured last
+	if !reflect.DeepEqual(reds, []int{5, 2}) || yellow != "default" {
+		log.Fatalf("Default configurators gave reds %v yellow %v", reds, yellow)
+	}
+
+	var o map[string]interface{}
+	if err := json.Unmarshal([]byte(`{ "apple" : 1 }`), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(o, nil, cdl.ValidateOptions{MutateInPlace: true}); err != nil {
+		log.Fatalf("Validate with MutateInPlace failed: %v", err)
+	}
+	if b, ok := o["blueberry"].(map[string]interface{}); !ok || b["yellow"] != "default" {
+		log.Fatalf("MutateInPlace did not apply defaults: %v", o)
+	}
+	om := cdl.NewOrderedMap()
+	if err := json.Unmarshal([]byte(`{ "apple" : 1, "blueberry" : { "red" : 5 } }`), om); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(om, nil, cdl.ValidateOptions{MutateInPlace: true}); err != nil {
+		log.Fatalf("Validate of ordered map with MutateInPlace failed: %v", err)
+	}
+	if b, err := json.Marshal(om); err != nil || string(b) != `{"apple":1,"blueberry":{"red":5,"yellow":"default"}}` {
+		log.Fatalf("MutateInPlace did not apply defaults to ordered map: %s %v", b, err)
+	}
+	// documents do not share a default with each other or with the template
+	var o2 map[string]interface{}
+	if err := json.Unmarshal([]byte(`{ "apple" : 2 }`), &o2); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(o2, nil, cdl.ValidateOptions{MutateInPlace: true}); err != nil {
+		log.Fatalf("Validate with MutateInPlace failed: %v", err)
+	}
+	o["blueberry"].(map[string]interface{})["red"] = 99
+	if b := o2["blueberry"].(map[string]interface{}); b["red"] != 1 {
+		log.Fatalf("Mutating one document changed the default in another: %v", o2)
+	}
+	checkValidateJson(ct, "defaultscopy", `{ "apple" : 1 }`, "", c)
+	if reds[len(reds)-1] != 1 {
+		log.Fatalf("Mutating a document changed the template's default: %v", reds)
+	}
+
+	ct, err = cdl.CompileWithOptions(cdl.Template{"/": "{}blueberry?", "blueberry": "{}red"},
+		cdl.CompileOptions{Defaults: map[string]interface{}{"blueberry": map[string]interface{}{}}})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "defaults3", `{}`, "ErrMissingMandatory", nil)
+}
+
+func TestLengthMatches(t *testing.T) {
+	ct, err := cdl.CompileWithOptions(cdl.Template{
+		"/":      "{}count? items?* shapes?*",
+		"count":  "integer",
+		"items":  "string",
+		"shapes": "{}count items*",
+	}, cdl.CompileOptions{LengthMatches: map[string]string{"items": "count"}})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "lengthmatches1", `{ "count" : 3, "items" : [ "a", "b", "c" ] }`, "", nil)
+	checkValidateJson(ct, "lengthmatches2", `{ "count" : 3, "items" : [ "a", "b" ] }`, "ErrOutOfRange", nil)
+	checkValidateJson(ct, "lengthmatches3", `{ "count" : 0, "items" : [] }`, "", nil)
+	checkValidateJson(ct, "lengthmatches4", `{ "items" : [ "a", "b" ] }`, "", nil)
+	checkValidateJson(ct, "lengthmatches5", `{ "shapes" : [ { "count" : 1, "items" : [ "a" ] } ] }`, "", nil)
+	checkValidateJson(ct, "lengthmatches6", `{ "shapes" : [ { "count" : 2, "items" : [ "a" ] } ] }`, "ErrOutOfRange", nil)
+}
+
+func TestExclusiveKeys(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":      "{}name (file|url|inline*)? (tcp|unix)",
+		"name":   "string",
+		"file":   "string",
+		"url":    "url",
+		"inline": "string",
+		"tcp":    "ipport",
+		"unix":   "string",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "exclusive1", `{ "name" : "x", "tcp" : ":80" }`, "", nil)
+	checkValidateJson(ct, "exclusive2", `{ "name" : "x", "tcp" : ":80", "file" : "a" }`, "", nil)
+	checkValidateJson(ct, "exclusive3", `{ "name" : "x", "tcp" : ":80", "inline" : [ "a" ] }`, "", nil)
+	checkValidateJson(ct, "exclusive4", `{ "name" : "x", "tcp" : ":80", "file" : "a", "url" : "http://x/" }`, "ErrExclusiveKeys", nil)
+	checkValidateJson(ct, "exclusive5", `{ "name" : "x" }`, "ErrMissingMandatory", nil)
+	checkValidateJson(ct, "exclusive6", `{ "name" : "x", "tcp" : ":80", "unix" : "/s" }`, "ErrExclusiveKeys", nil)
+	checkValidateJson(ct, "exclusive7", `{ "name" : "x", "unix" : "/s", "inline" : "a" }`, "ErrExpectedArray", nil)
+	for _, bad := range []string{"{}(a)", "{}(a|b", "{}(a|b)!", "{}(a?|b)", "{}(a|/b/c)"} {
+		if _, err := cdl.Compile(cdl.Template{"/": bad}); err == nil {
+			log.Fatalf("Compile of bad group %s did not fail", bad)
+		}
+	}
+	if cdl.MustCompile(cdl.Template{"/": "{}(a|b)?"}).Equal(cdl.MustCompile(cdl.Template{"/": "{}(a|b)"})) {
+		log.Fatalf("Optional and mandatory groups compare equal")
+	}
+}
+
+func TestExtraKeys(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":    "{}name size? ...labels:string",
+		"name": "string",
+		"size": "integer",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	labels := make(map[string]string)
+	c := cdl.Configurator{
+		"labels": func(o interface{}, p cdl.Path) *cdl.CdlError {
+			s := p.StringSlice()
+			labels[s[len(s)-1]] = o.(string)
+			return nil
+		},
+	}
+	checkValidateJson(ct, "extra1", `{ "name" : "a", "size" : 1, "colour" : "red", "shape" : "round" }`, "", c)
+	if len(labels) != 2 || labels["colour"] != "red" || labels["shape"] != "round" {
+		log.Fatalf("Unexpected labels %v", labels)
+	}
+	checkValidateJson(ct, "extra2", `{ "name" : "a", "weight" : 7 }`, "ErrBadType", nil)
+	checkValidateJson(ct, "extra3", `{ "name" : "a", "size" : "big" }`, "ErrBadType", nil)
+	if _, err := cdl.Compile(cdl.Template{"/": "{}a ...b:string", "b": "int"}); err == nil {
+		log.Fatalf("Compile of conflicting catch-all did not fail")
+	}
+	if _, err := cdl.Compile(cdl.Template{"/": "{}a ...b ...c"}); err == nil {
+		log.Fatalf("Compile of two catch-alls did not fail")
+	}
+}
+
+func TestNamedEnums(t *testing.T) {
+	var template cdl.Template
+	if err := json.Unmarshal([]byte(`{ "/" : "{}colour part?", "colour" : "@palette", "part" : "@part" }`), &template); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	palette := cdl.NewEnumType("red", "green", "blue")
+	opts := cdl.CompileOptions{Enums: map[string]cdl.EnumType{"palette": palette, "part": fruitPart}}
+	ct, err := cdl.CompileWithOptions(template, opts)
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	colour := palette.New("red")
+	checkValidateJson(ct, "enum1", `{ "colour" : "blue", "part" : "pips" }`, "", cdl.Configurator{"colour": &colour})
+	if colour.String() != "blue" {
+		log.Fatalf("Configurator set colour %s", colour.String())
+	}
+	checkValidateJson(ct, "enum2", `{ "colour" : "mauve" }`, "ErrBadEnumValue", nil)
+	if _, err := cdl.CompileWithOptions(template, cdl.CompileOptions{}); err == nil {
+		log.Fatalf("Compile with unknown enum did not fail")
+	}
+}
+
+func TestEnumElements(t *testing.T) {
+	palette := cdl.NewEnumType("red", "green", "blue")
+	opts := cdl.CompileOptions{Enums: map[string]cdl.EnumType{"palette": palette}}
+	ct, err := cdl.CompileWithOptions(cdl.Template{
+		"/":       "{}colours? pair? shades?",
+		"colours": "[]@palette{1,}",
+		"pair":    "(@palette, number)",
+		"shades":  "{}...shade:@palette",
+	}, opts)
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "enumelements1", `{ "colours" : [ "red", "blue" ] }`, "", nil)
+	checkValidateJson(ct, "enumelements2", `{ "colours" : [ "red", "mauve" ] }`, "ErrBadEnumValue", nil)
+	checkValidateJson(ct, "enumelements3", `{ "colours" : [ "red", 1 ] }`, "ErrBadType", nil)
+	checkValidateJson(ct, "enumelements4", `{ "colours" : [] }`, "ErrOutOfRange", nil)
+	checkValidateJson(ct, "enumelements5", `{ "pair" : [ "green", 1 ] }`, "", nil)
+	checkValidateJson(ct, "enumelements6", `{ "pair" : [ "mauve", 1 ] }`, "ErrBadEnumValue", nil)
+	checkValidateJson(ct, "enumelements7", `{ "shades" : { "sky" : "blue", "grass" : "green" } }`, "", nil)
+	checkValidateJson(ct, "enumelements8", `{ "shades" : { "sky" : "mauve" } }`, "ErrBadEnumValue", nil)
+	if _, err := cdl.Compile(cdl.Template{"/": "{}colours", "colours": "[]@palette"}); err == nil {
+		log.Fatalf("Compile with unknown enum array did not fail")
+	}
+}
+
+func TestStringBounds(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":    "{}date? year?",
+		"date": "string>=2021-01-01",
+		"year": "string>=2021<2022",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "stringbound1", `{ "date" : "2021-06-30" }`, "", nil)
+	checkValidateJson(ct, "stringbound2", `{ "date" : "2021-01-01" }`, "", nil)
+	checkValidateJson(ct, "stringbound3", `{ "date" : "2020-12-31" }`, "ErrValueOutOfRange", nil)
+	checkValidateJson(ct, "stringbound4", `{ "date" : 2021 }`, "ErrBadType", nil)
+	// bounds are compared lexicographically, even if they are numbers
+	checkValidateJson(ct, "stringbound5", `{ "year" : "2021-06-30" }`, "", nil)
+	checkValidateJson(ct, "stringbound6", `{ "year" : "2022-01-01" }`, "ErrValueOutOfRange", nil)
+	checkValidateJson(ct, "stringbound7", `{ "year" : "10000" }`, "ErrValueOutOfRange", nil)
+}
+
+func TestStringLength(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}runes? bytes? code?",
+		"runes": "string{1,4}",
+		"bytes": "string{b:1,4}",
+		"code":  "string{2,}>=a",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "stringlength1", `{ "runes" : "abcd", "bytes" : "abcd" }`, "", nil)
+	checkValidateJson(ct, "stringlength2", `{ "runes" : "abcde" }`, "ErrValueOutOfRange", nil)
+	checkValidateJson(ct, "stringlength3", `{ "runes" : "" }`, "ErrValueOutOfRange", nil)
+	// "héé" is 3 runes but 5 bytes
+	checkValidateJson(ct, "stringlength4", `{ "runes" : "héé" }`, "", nil)
+	checkValidateJson(ct, "stringlength5", `{ "bytes" : "héé" }`, "ErrValueOutOfRange", nil)
+	checkValidateJson(ct, "stringlength6", `{ "bytes" : "hé" }`, "", nil)
+	checkValidateJson(ct, "stringlength7", `{ "bytes" : "héh" }`, "", nil)
+	checkValidateJson(ct, "stringlength8", `{ "code" : "ab" }`, "", nil)
+	checkValidateJson(ct, "stringlength9", `{ "code" : "b" }`, "ErrValueOutOfRange", nil)
+	checkValidateJson(ct, "stringlength10", `{ "code" : "AB" }`, "ErrValueOutOfRange", nil)
+	for _, bad := range []string{"string{4,1}", "string{,}", "string{b:,}"} {
+		if _, err := cdl.Compile(cdl.Template{"/": "{}a", "a": bad}); err == nil {
+			log.Fatalf("Compile of %s did not fail", bad)
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":       "{}timeout since?",
+		"timeout": "duration",
+		"since":   "timestamp",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var timeout time.Duration
+	var since time.Time
+	c := cdl.Configurator{"timeout": &timeout, "since": &since}
+	if err := ct.Validate(map[string]interface{}{"timeout": 5 * time.Second}, c); err != nil {
+		log.Fatalf("Native duration failed to validate: %v", err)
+	}
+	if timeout != 5*time.Second {
+		log.Fatalf("Configurator set timeout %v", timeout)
+	}
+	now := time.Now()
+	if err := ct.Validate(map[string]interface{}{"timeout": time.Duration(0), "since": now}, c); err != nil {
+		log.Fatalf("Native timestamp failed to validate: %v", err)
+	}
+	if !since.Equal(now) {
+		log.Fatalf("Configurator set since %v", since)
+	}
+	checkValidateJson(ct, "time1", `{ "timeout" : "1m30s", "since" : "2021-01-01T00:00:00Z" }`, "", c)
+	if timeout != 90*time.Second || since.Year() != 2021 {
+		log.Fatalf("Configurator set timeout %v since %v", timeout, since)
+	}
+	checkValidateJson(ct, "time2", `{ "timeout" : "soon" }`, "ErrBadValue", c)
+	checkValidateJson(ct, "time3", `{ "timeout" : 5 }`, "ErrBadType", c)
+	checkValidateJson(ct, "time4", `{ "timeout" : "1s", "since" : "yesterday" }`, "ErrBadValue", c)
+}
+
+func TestTypeResolver(t *testing.T) {
+	opts := cdl.CompileOptions{
+		Strict: true,
+		TypeResolver: func(name string) (reflect.Type, bool) {
+			if name == "mytime" {
+				return reflect.TypeOf(time.Time{}), true
+			}
+			return nil, false
+		},
+	}
+	ct, err := cdl.CompileWithOptions(cdl.Template{
+		"/":       "{}started? count?",
+		"started": "mytime",
+		"count":   "int",
+	}, opts)
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	if err := ct.Validate(map[string]interface{}{"started": time.Now(), "count": 1}, nil); err != nil {
+		log.Fatalf("Validate of aliased type failed: %v", err)
+	}
+	if err := ct.Validate(map[string]interface{}{"started": "2021-01-01T00:00:00Z"}, nil); err == nil {
+		log.Fatalf("Validate of string as aliased type did not fail")
+	}
+	if _, err := cdl.CompileWithOptions(cdl.Template{"/": "{}started", "started": "mytme"}, opts); err == nil {
+		log.Fatalf("Strict compile of unresolved type did not fail")
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cdl")
+	if err != nil {
+		log.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shape.cdl")
+	if err := ioutil.WriteFile(path, []byte(`
+# a shape
+/ = {}kind radius? colour? tags? # the root
+kind = =circle # a literal
+radius = number # a comment
+colour = !=mauve
+tags = #tags
+`), 0600); err != nil {
+		log.Fatalf("Cannot write %s: %v", path, err)
+	}
+	template, err := cdl.ParseFile(path)
+	if err != nil {
+		log.Fatalf("ParseFile failed: %v", err)
+	}
+	if !reflect.DeepEqual(template, cdl.Template{"/": "{}kind radius? colour? tags?", "kind": "=circle", "radius": "number", "colour": "!=mauve", "tags": "#tags"}) {
+		log.Fatalf("ParseFile returned unexpected template %#v", template)
+	}
+	ct, err := cdl.CompileWithOptions(template, cdl.CompileOptions{Sets: map[string][]string{"tags": {"a", "b"}}})
+	if err != nil {
+		log.Fatalf("Compile of parsed template failed: %v", err)
+	}
+	checkValidateJson(ct, "parsefile1", `{ "kind" : "circle", "radius" : 1 }`, "", nil)
+	checkValidateJson(ct, "parsefile2", `{ "kind" : "square" }`, "ErrBadValue", nil)
+	checkValidateJson(ct, "parsefile3", `{ "kind" : "circle", "colour" : "mauve" }`, "ErrBadValue", nil)
+	checkValidateJson(ct, "parsefile4", `{ "kind" : "circle", "tags" : "a" }`, "", nil)
+
+	for _, s := range []string{"/ = {}a\na\n", "/ = {}a\n= string\n"} {
+		_, err := cdl.Parse(strings.NewReader(s))
+		if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrSyntax" || !strings.Contains(me.Error(), "line 2") {
+			log.Fatalf("Parse of line without key = spec returned %v", err)
+		}
+	}
+	if _, err := cdl.Parse(strings.NewReader("a = string\na = number\n")); err == nil {
+		log.Fatalf("Parse of duplicate key did not fail")
+	}
+	if _, err := cdl.ParseFile(filepath.Join(dir, "missing.cdl")); err == nil {
+		log.Fatalf("ParseFile of missing file did not fail")
+	}
+}
+
+func TestValidateFile(t *testing.T) {
+	ct := checkCompile("example", "")
+	dir, err := ioutil.TempDir("", "cdl")
+	if err != nil {
+		log.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// JSON is a subset of YAML, so suffices to test a registered decoder
+	cdl.RegisterDecoder(".jsn", json.Unmarshal)
+	defer cdl.RegisterDecoder(".jsn", nil)
+	for _, f := range []struct{ name, bad, good string }{
+		{"config.json", checkJsons["bad1"], checkJsons["simple1"]},
+		{"config.jsn", checkJsons["bad1"], checkJsons["simple1"]},
+	} {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, []byte(f.bad), 0600); err != nil {
+			log.Fatalf("Cannot write %s: %v", path, err)
+		}
+		err := ct.ValidateFile(path, nil)
+		if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrBadType" {
+			log.Fatalf("Unexpected error validating %s: %v", f.name, err)
+		} else if !strings.Contains(me.Error(), path) {
+			log.Fatalf("File name missing from error '%s'", me.Error())
+		}
+		if err := ioutil.WriteFile(path, []byte(f.good), 0600); err != nil {
+			log.Fatalf("Cannot write %s: %v", path, err)
+		}
+		if err := ct.ValidateFile(path, nil); err != nil {
+			log.Fatalf("Unexpected error validating %s: %v", f.name, err)
+		}
+	}
+	cdl.RegisterDecoder(".jsn", nil)
+	err = ct.ValidateFile(filepath.Join(dir, "config.jsn"), nil)
+	if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrBadFile" {
+		log.Fatalf("Removed decoder did not return ErrBadFile: %v", err)
+	}
+	err = ct.ValidateFile(filepath.Join(dir, "config.ini"), nil)
+	if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrBadFile" {
+		log.Fatalf("Unknown extension did not return ErrBadFile: %v", err)
+	}
+	m := map[interface{}]interface{}{"red": 1}
+	if err := ct.Validate(map[string]interface{}{
+		"apple": 1.0, "pear": []interface{}{}, "plum": []interface{}{1.0},
+		"raspberry": []interface{}{"a"}, "strawberry": "x", "guava": []interface{}{"c"},
+		"blueberry": m,
+	}, nil); err != nil {
+		log.Fatalf("Map with interface keys failed to validate: %v", err)
+	}
+}
+
+func TestStringifyKeys(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/": "{}1 2? name?",
+		"1": "string",
+		"2": "number",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	m := map[interface{}]interface{}{1: "one", 2: 2, "name": "x"}
+	if err := ct.Validate(m, nil); err == nil {
+		log.Fatalf("Map with numeric keys validated without StringifyKeys")
+	} else if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrBadKey" {
+		log.Fatalf("Map with numeric keys returned unexpected error %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(m, nil, cdl.ValidateOptions{StringifyKeys: true}); err != nil {
+		log.Fatalf("Map with numeric keys failed to validate with StringifyKeys: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(map[int]interface{}{1: "one"}, nil, cdl.ValidateOptions{StringifyKeys: true}); err != nil {
+		log.Fatalf("Map with int keys failed to validate with StringifyKeys: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(map[interface{}]interface{}{1: 1}, nil, cdl.ValidateOptions{StringifyKeys: true}); err == nil {
+		log.Fatalf("Map with bad value validated with StringifyKeys")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	ct := checkCompile("example", "")
+	var m interface{}
+	if err := json.Unmarshal([]byte(checkJsons["jupiter"]), &m); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	entered := make(map[string]int)
+	exited := make(map[string]int)
+	depth := 0
+	opts := cdl.ValidateOptions{
+		OnEnter: func(p cdl.Path, kind string) {
+			entered[kind]++
+			depth++
+		},
+		OnExit: func(p cdl.Path, kind string, err *cdl.CdlError) {
+			exited[kind]++
+			depth--
+		},
+	}
+	if _, err := ct.ValidateWithOptions(m, nil, opts); err != nil {
+		log.Fatalf("Validation failed: %v", err)
+	}
+	stats, err := ct.ValidateStats(m, nil)
+	if err != nil {
+		log.Fatalf("Validation failed: %v", err)
+	}
+	if entered["map"] != 5 || entered["array"] != 6 || entered["leaf"] != stats.Leaves || !reflect.DeepEqual(entered, exited) || depth != 0 {
+		log.Fatalf("Unexpected hook counts entered %v exited %v", entered, exited)
+	}
+	// a leaf's error is passed to OnExit
+	var failed []string
+	opts.OnExit = func(p cdl.Path, kind string, err *cdl.CdlError) {
+		if kind == "leaf" && err != nil {
+			failed = append(failed, p.String()+" "+err.Type.String())
+		}
+	}
+	if err := json.Unmarshal([]byte(checkJsons["bad1"]), &m); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(m, nil, opts); err == nil {
+		log.Fatalf("Validation of bad1 succeeded")
+	}
+	if !reflect.DeepEqual(failed, []string{"/apple ErrBadType"}) {
+		log.Fatalf("Unexpected leaf errors %v", failed)
+	}
+}
+
+func TestIgnoreExtraKeys(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}loose? tight?",
+		"loose": "{}apple peach? ...",
+		"tight": "{}apple peach?",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "ignore1", `{ "loose" : { "apple" : 1, "kiwi" : 2, "plum" : [] } }`, "", nil)
+	checkValidateJson(ct, "ignore2", `{ "loose" : { "kiwi" : 2 } }`, "ErrMissingMandatory", nil)
+	checkValidateJson(ct, "ignore3", `{ "tight" : { "apple" : 1, "kiwi" : 2 } }`, "ErrBadKey", nil)
+	checkValidateJson(ct, "ignore4", `{ "loose" : { "apple" : 1 }, "kiwi" : 2 }`, "ErrBadKey", nil)
+}
+
+func TestSkip(t *testing.T) {
+	ct := checkCompile("example", "")
+	var o interface{}
+	if err := json.Unmarshal([]byte(`{ "apple" : 1, "pear" : [], "plum" : [ 1 ], "raspberry" : [ "a" ], "strawberry" : "x", "guava" : [ "c" ],
+		"mango" : [ { "earth" : 1 }, { "earth" : 1, "jupiter" : [ { "loki" : 1 } ] } ], "cache" : { "anything" : 1 } }`), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if err := ct.Validate(o, nil); err == nil {
+		log.Fatalf("Validate of invalid subtrees did not fail")
+	}
+	var skipped []string
+	opts := cdl.ValidateOptions{Skip: func(path cdl.Path, value interface{}) bool {
+		items := path.Slice()
+		if items[len(items)-1] == "cache" || items[len(items)-1] == "jupiter" {
+			skipped = append(skipped, path.String())
+			return true
+		}
+		return false
+	}}
+	if _, err := ct.ValidateWithOptions(o, nil, opts); err != nil {
+		log.Fatalf("Validate skipping invalid subtrees failed: %v", err)
+	}
+	if strings.Join(skipped, " ") != "/cache /mango/1/jupiter" {
+		log.Fatalf("Unexpected subtrees skipped: %v", skipped)
+	}
+	// a skipped mandatory key is treated as present
+	opts.Skip = func(path cdl.Path, value interface{}) bool { return path.String() == "/strawberry" }
+	if _, err := ct.ValidateWithOptions(map[string]interface{}{
+		"apple": 1.0, "pear": []interface{}{}, "plum": []interface{}{1.0}, "raspberry": []interface{}{"a"}, "strawberry": 7, "guava": []interface{}{"c"},
+	}, nil, opts); err != nil {
+		log.Fatalf("Validate skipping mandatory key failed: %v", err)
+	}
+}
+
+func TestAllowEmptyArrays(t *testing.T) {
+	ct := checkCompile("example", "")
+	var o interface{}
+	if err := json.Unmarshal([]byte(`{ "apple" : 1, "pear" : [], "plum" : [], "raspberry" : [ "a" ], "strawberry" : "x", "guava" : [ "c" ] }`), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if err := ct.Validate(o, nil); err == nil {
+		log.Fatalf("Validate of empty plum did not fail")
+	} else if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrOutOfRange" {
+		log.Fatalf("Validate of empty plum gave unexpected error: %v", err)
+	}
+	r, err := ct.ValidateWithOptions(o, nil, cdl.ValidateOptions{AllowEmptyArrays: true})
+	if err != nil {
+		log.Fatalf("Validate of empty plum with AllowEmptyArrays failed: %v", err)
+	}
+	if len(r.Warnings) != 1 || r.Warnings[0].Path.String() != "/plum" || r.Warnings[0].Err.Type.String() != "ErrOutOfRange" {
+		log.Fatalf("Unexpected warnings: %v", r.Warnings)
+	}
+	// a non-empty array out of range still fails
+	if err := json.Unmarshal([]byte(`{ "apple" : 1, "pear" : [], "plum" : [ 1 ], "raspberry" : [ "a", "b", "c", "d" ], "strawberry" : "x", "guava" : [ "c" ] }`), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(o, nil, cdl.ValidateOptions{AllowEmptyArrays: true}); err == nil {
+		log.Fatalf("Validate of long raspberry with AllowEmptyArrays did not fail")
+	}
+}
+
+func TestOnUnknownKey(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}loose? tight?",
+		"loose": "{}apple peach? ...",
+		"tight": "{}apple peach?",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var unknown []string
+	opts := cdl.ValidateOptions{
+		IgnoreUnknownKeys: true,
+		OnUnknownKey: func(path cdl.Path, key string) {
+			unknown = append(unknown, path.String()+" "+key)
+		},
+	}
+	var o interface{}
+	if err := json.Unmarshal([]byte(`{ "tight" : { "apple" : 1, "kiwi" : 2 }, "plum" : 3 }`), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(o, nil, opts); err != nil {
+		log.Fatalf("Validate with IgnoreUnknownKeys failed: %v", err)
+	}
+	if strings.Join(unknown, ", ") != "/ plum, /tight kiwi" {
+		log.Fatalf("Unexpected unknown key callbacks: %v", unknown)
+	}
+
+	unknown = nil
+	opts.IgnoreUnknownKeys = false
+	if _, err := ct.ValidateWithOptions(o, nil, opts); err == nil {
+		log.Fatalf("Validate without IgnoreUnknownKeys did not fail")
+	}
+	if len(unknown) != 1 {
+		log.Fatalf("Unexpected unknown key callbacks: %v", unknown)
+	}
+
+	unknown = nil
+	if err := json.Unmarshal([]byte(`{ "loose" : { "apple" : 1, "kiwi" : 2, "plum" : 3 } }`), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(o, nil, opts); err != nil || len(unknown) != 2 {
+		log.Fatalf("Ignored keys gave callbacks %v: %v", unknown, err)
+	}
+}
+
+func TestAtMost(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":    "{}[,2]tags? names?{,3} colours?",
+		"tags": "[]string{,2}",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "atmost1", `{ "tags" : [ "a", "b" ], "names" : [] }`, "", nil)
+	e := checkValidateJson(ct, "atmost2", `{ "tags" : [ "a", "b", "c" ] }`, "ErrOutOfRange", nil)
+	if e.Supplementary != "got 3, expecting at most 2" {
+		log.Fatalf("Unexpected supplementary '%s'", e.Supplementary)
+	}
+	if _, ok := e.Details["min"]; ok || e.Details["max"] != 2 {
+		log.Fatalf("Unexpected details %v", e.Details)
+	}
+	checkValidateJson(ct, "atmost3", `{ "names" : [ 1, 2, 3, 4 ] }`, "ErrOutOfRange", nil)
+	checkValidateJson(ct, "atmost4", `{ "tags" : [], "names" : [], "colours" : 1 }`, "ErrValueOutOfRange", nil)
+	if _, err := cdl.Compile(cdl.Template{"/": "{}a{,}"}); err == nil {
+		log.Fatalf("Compile of {,} did not fail")
+	}
+}
+
+func TestNonZero(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}name= count?= tags*= opts?=",
+		"name":  "string",
+		"count": "number",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "nonzero1", `{ "name" : "a", "count" : 1, "tags" : [ "x" ], "opts" : { "a" : 1 } }`, "", nil)
+	checkValidateJson(ct, "nonzero2", `{ "name" : "", "tags" : [ "x" ] }`, "ErrEmptyValue", nil)
+	checkValidateJson(ct, "nonzero3", `{ "name" : "a", "count" : 0, "tags" : [ "x" ] }`, "ErrEmptyValue", nil)
+	checkValidateJson(ct, "nonzero4", `{ "name" : "a", "tags" : [] }`, "ErrEmptyValue", nil)
+	checkValidateJson(ct, "nonzero5", `{ "name" : "a", "tags" : [ "x" ], "opts" : {} }`, "ErrEmptyValue", nil)
+	checkValidateJson(ct, "nonzero6", `{ "tags" : [ "x" ] }`, "ErrMissingMandatory", nil)
+}
+
+func TestForbidden(t *testing.T) {
+	ct := checkCompile("forbidden", "")
+	checkValidateJson(ct, "forbidden1", `{ "a" : 1, "empty" : [] }`, "", nil)
+	checkValidateJson(ct, "forbidden2", `{ "empty" : [ "x" ] }`, "ErrOutOfRange", nil)
+	checkValidateJson(ct, "forbidden3", `{ "empty" : [], "b" : 1 }`, "ErrBadKey", nil)
+	checkValidateJson(ct, "forbidden4", `{ "empty" : [], "tight" : [ 1, 2 ] }`, "", nil)
+	checkValidateJson(ct, "forbidden5", `{ "empty" : [], "tight" : [ 1, 2, 3 ] }`, "ErrOutOfRange", nil)
+}
+
+func TestMaxDepth(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}child?",
+		"child": "{}child?",
+	})
+	if err != nil {
+		log.Fatalf("Compile of recursive template failed: %v", err)
+	}
+	m := map[string]interface{}{}
+	deep := m
+	for i := 0; i < 50; i++ {
+		next := map[string]interface{}{}
+		deep["child"] = next
+		deep = next
+	}
+	if err := ct.Validate(m, nil); err != nil {
+		log.Fatalf("Validate of nested document failed: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(m, nil, cdl.ValidateOptions{MaxDepth: 10}); err == nil {
+		log.Fatalf("Validate of nested document did not hit the depth limit")
+	} else if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrMaxDepth" {
+		log.Fatalf("Validate of nested document returned unexpected error %v", err)
+	}
+
+	// A cyclic document must not recurse forever
+	cyclic := map[string]interface{}{}
+	cyclic["child"] = cyclic
+	if err := ct.Validate(cyclic, nil); err == nil {
+		log.Fatalf("Validate of cyclic document did not hit the depth limit")
+	} else if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrMaxDepth" {
+		log.Fatalf("Validate of cyclic document returned unexpected error %v", err)
+	}
+}
+
+func TestMaxContextDepth(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}child? leaf?",
+		"child": "{}child? leaf?",
+		"leaf":  "number",
+	})
+	if err != nil {
+		log.Fatalf("Compile of recursive template failed: %v", err)
+	}
+	doc := `{ "child" : { "child" : { "child" : { "child" : { "leaf" : "x" } } } } }`
+	var o interface{}
+	if err := json.Unmarshal([]byte(doc), &o); err != nil {
+		log.Fatalf("Cannot unmarshal JSON: %v", err)
+	}
+	check := func(depth int, want string) {
+		_, err := ct.ValidateWithOptions(o, nil, cdl.ValidateOptions{MaxContextDepth: depth})
+		me, ok := err.(*cdl.CdlError)
+		if !ok {
+			log.Fatalf("Validate with MaxContextDepth %d returned unexpected error %v", depth, err)
+		}
+		if !strings.HasSuffix(me.Error(), want) {
+			log.Fatalf("Validate with MaxContextDepth %d returned error %q, expected suffix %q", depth, me.Error(), want)
+		}
+		if me.ContextPath() != "/child/child/child/child/leaf" {
+			log.Fatalf("Validate with MaxContextDepth %d returned unexpected path %s", depth, me.ContextPath())
+		}
+	}
+	check(0, "near 'leaf' at 'child' at 'child' at 'child' at 'child'")
+	check(5, "near 'leaf' at 'child' at 'child' at 'child' at 'child'")
+	check(2, "near 'leaf' at 'child' at ...")
+}
+
+func TestIPPort(t *testing.T) {
+	ct := checkCompile("ipport", "")
+	checkValidateJson(ct, "any1", `{ "any" : ":http" }`, "", nil)
+	checkValidateJson(ct, "any2", `{ "any" : ":70000" }`, "", nil)
+	checkValidateJson(ct, "numeric1", `{ "numeric" : ":http" }`, "ErrBadType", nil)
+	checkValidateJson(ct, "numeric2", `{ "numeric" : ":70000" }`, "ErrValueOutOfRange", nil)
+	checkValidateJson(ct, "numeric3", `{ "numeric" : ":80" }`, "", nil)
+	checkValidateJson(ct, "numeric4", `{ "numeric" : "host:80" }`, "", nil)
+	checkValidateJson(ct, "numeric5", `{ "numeric" : "host" }`, "ErrBadType", nil)
+	checkValidateJson(ct, "numeric6", `{ "numeric" : 80 }`, "ErrBadType", nil)
+	checkValidateJson(ct, "numeric7", `{ "numeric" : ":0" }`, "ErrValueOutOfRange", nil)
+	checkValidateJson(ct, "numeric8", `{ "numeric" : ":65536" }`, "ErrValueOutOfRange", nil)
+	checkValidateJson(ct, "numeric9", `{ "numeric" : ":99999" }`, "ErrValueOutOfRange", nil)
+	checkValidateJson(ct, "numeric10", `{ "numeric" : ":8080" }`, "", nil)
+	checkValidateJson(ct, "numeric11", `{ "numeric" : ":65535" }`, "", nil)
+	checkValidateJson(ct, "host1", `{ "host" : ":80" }`, "ErrBadType", nil)
+	checkValidateJson(ct, "host2", `{ "host" : "host:80" }`, "", nil)
+	checkValidateJson(ct, "host3", `{ "host" : "host:http" }`, "ErrBadType", nil)
+}
+
+func TestHostPort(t *testing.T) {
+	ct := checkCompile("ipport", "")
+	var hp cdl.HostPort
+	c := cdl.Configurator{"numeric": &hp}
+	checkValidateJson(ct, "hostport1", `{ "numeric" : "[::1]:8080" }`, "", c)
+	if hp.Host != "::1" || hp.Port != "8080" {
+		log.Fatalf("Unexpected host port %#v", hp)
+	}
+	if s := hp.String(); s != "[::1]:8080" {
+		log.Fatalf("Unexpected host port string '%s'", s)
+	}
+	checkValidateJson(ct, "hostport2", `{ "numeric" : "example.com:80" }`, "", c)
+	if hp.Host != "example.com" || hp.Port != "80" {
+		log.Fatalf("Unexpected host port %#v", hp)
+	}
+	checkValidateJson(ct, "hostport3", `{ "numeric" : "::1:8080" }`, "ErrBadType", c)
+}
+
+func TestDiff(t *testing.T) {
+	ct1 := checkCompile("map", "")
+	ct2 := checkCompile("map", "")
+	if !ct1.Equal(ct2) {
+		log.Fatalf("Identical templates are not equal: %v", ct1.Diff(ct2))
+	}
+
+	extra := cdl.Template{}
+	for k, v := range checkTemplates["map"] {
+		extra[k] = v
+	}
+	extra["/"] = extra["/"].(string) + " banana?"
+	extra["apple"] = "float64"
+	ct3, err := cdl.Compile(extra)
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	if ct1.Equal(ct3) {
+		log.Fatalf("Different templates are equal")
+	}
+	changes := ct1.Diff(ct3)
+	if len(changes) != 3 {
+		log.Fatalf("Expected 3 changes, got %v", changes)
+	}
+	if changes[0].Key != "/" || changes[0].Change.String() != "KeyChanged" || !strings.Contains(changes[0].New, "banana?") || strings.Contains(changes[0].Old, "banana") {
+		log.Fatalf("Unexpected change: %s", changes[0])
+	}
+	if changes[1].Key != "apple" || changes[1].Change.String() != "KeyChanged" || changes[1].Old != "int" || changes[1].New != "float64" {
+		log.Fatalf("Unexpected change: %s", changes[1])
+	}
+	if changes[2].Key != "banana" || changes[2].Change.String() != "KeyAdded" {
+		log.Fatalf("Unexpected change: %s", changes[2])
+	}
+	if back := ct3.Diff(ct1); len(back) != 3 || back[2].Change.String() != "KeyRemoved" {
+		log.Fatalf("Unexpected reverse changes: %v", back)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	template := cdl.Template{
+		"/":        "{}endpoint",
+		"endpoint": "url",
+	}
+	vars := map[string]string{"HOST": "example.com"}
+	lookup := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	ct := cdl.MustCompile(template)
+	checkValidateJson(ct, "plain", `{ "endpoint" : "http://${HOST}:8080/" }`, "ErrBadType", nil)
+
+	ct, err := cdl.CompileWithOptions(template, cdl.CompileOptions{Interpolate: lookup})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var endpoint string
+	checkValidateJson(ct, "expanded", `{ "endpoint" : "http://${HOST}:8080/" }`, "", cdl.Configurator{"endpoint": &endpoint})
+	if endpoint != "http://example.com:8080/" {
+		log.Fatalf("Configurator received unexpanded value '%s'", endpoint)
+	}
+	checkValidateJson(ct, "undefined", `{ "endpoint" : "http://${PORT}/" }`, "ErrUndefinedVariable", nil)
+
+	ct, err = cdl.CompileWithOptions(template, cdl.CompileOptions{Interpolate: lookup, AllowUndefined: true})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "allowed", `{ "endpoint" : "http://${HOST}${PORT}/" }`, "", nil)
+}
+
+func TestErrorDetails(t *testing.T) {
+	ct := checkCompile("example", "")
+	err := checkValidateJson(ct, "bad1", checkJsons["bad1"], "ErrBadType", nil)
+	if err.Details["expected"] != "float64" || err.Details["got"] != "string" {
+		log.Fatalf("Type error has unexpected details %v", err.Details)
+	}
+	err = checkValidateJson(ct, "badmango1", checkJsons["badmango1"], "ErrOutOfRange", nil)
+	if err.Details["got"] != 1 || err.Details["min"] != 2 || err.Details["max"] != 4 {
+		log.Fatalf("Range error has unexpected details %v", err.Details)
+	}
+	if e := cdl.NewError("ErrBadValue").WithField("limit", 3); e.Details["limit"] != 3 {
+		log.Fatalf("WithField did not set detail: %v", e.Details)
+	}
+}
+
+func TestContextPath(t *testing.T) {
+	ct := checkCompile("example", "")
+	err := checkValidateJson(ct, "badjupiter2", checkJsons["badjupiter2"], "ErrBadKey", nil)
+	if p := err.ContextPath(); p != "/mango/1/jupiter/0/wotan" {
+		log.Fatalf("Unexpected context path '%s'", p)
+	}
+	expected := []interface{}{"mango", 1, "jupiter", 0, "wotan"}
+	if tc := err.TypedContext(); !reflect.DeepEqual(tc, expected) {
+		log.Fatalf("Unexpected typed context %#v", tc)
+	}
+	if err.Details["depth"] != 5 {
+		log.Fatalf("Unexpected depth detail %v", err.Details["depth"])
+	}
+	if p := cdl.NewError("ErrBadValue").ContextPath(); p != "/" {
+		log.Fatalf("Unexpected empty context path '%s'", p)
+	}
+}
+
+func TestExpectedType(t *testing.T) {
+	ct := checkCompile("example", "")
+	me := checkValidateJson(ct, "bad1", checkJsons["bad1"], "ErrBadType", nil)
+	if et, ok := ct.ExpectedType(me.Path()); !ok || et != "float64" {
+		log.Fatalf("Unexpected expected type '%s' for %s", et, me.ContextPath())
+	}
+	me = checkValidateJson(ct, "expected1", `{ "apple" : 1, "pear" : [], "plum" : [ 1 ], "raspberry" : [ "a", "b", "c", "d" ], "strawberry" : "x", "guava" : [ "c" ] }`, "ErrOutOfRange", nil)
+	if et, ok := ct.ExpectedType(me.Path()); !ok || et != "[]raspberry{1,3}" {
+		log.Fatalf("Unexpected expected type '%s' for %s", et, me.ContextPath())
+	}
+	me = checkValidateJson(ct, "badjupiter2", checkJsons["badjupiter2"], "ErrBadKey", nil)
+	if et, ok := ct.ExpectedType(me.Path()); ok {
+		log.Fatalf("Unexpected expected type '%s' for unknown key %s", et, me.ContextPath())
+	}
+	var paths = map[string]string{}
+	c := cdl.Configurator{
+		"/mango/*/jupiter": cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError {
+			paths[path.String()], _ = ct.ExpectedType(path)
+			return nil
+		}),
+		"/mango/*/jupiter/*": cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError {
+			paths[path.String()], _ = ct.ExpectedType(path)
+			return nil
+		}),
+		"/mango/*/jupiter/*/thor": cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError {
+			paths[path.String()], _ = ct.ExpectedType(path)
+			return nil
+		}),
+	}
+	checkValidateJson(ct, "expected", `{ "apple" : 1, "pear" : [], "plum" : [ 1 ], "raspberry" : [ "a" ], "strawberry" : "x", "guava" : [ "c" ],
+		"mango" : [ { "earth" : 1 }, { "earth" : 1, "jupiter" : [ { "thor" : 1 } ] } ] }`, "", c)
+	expected := map[string]string{
+		"/mango/1/jupiter":        "[]gods",
+		"/mango/1/jupiter/0":      "{}odin? thor?",
+		"/mango/1/jupiter/0/thor": "",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		log.Fatalf("Unexpected expected types %v", paths)
+	}
+}
+
+func TestAddKey(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}apple",
+		"apple": "number",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "addkey1", `{ "apple" : 1, "plugin" : { "level" : 3 } }`, "ErrBadKey", nil)
+	if err := ct.AddKey("/", "{}apple plugin?"); err != nil {
+		log.Fatalf("AddKey failed: %v", err)
+	}
+	if err := ct.AddKey("plugin", "{}level"); err != nil {
+		log.Fatalf("AddKey failed: %v", err)
+	}
+	checkValidateJson(ct, "addkey2", `{ "apple" : 1, "plugin" : { "level" : 3 } }`, "", nil)
+	checkValidateJson(ct, "addkey3", `{ "apple" : 1, "plugin" : { "level" : "high" } }`, "", nil)
+	if err := ct.AddKey("level", "integer"); err != nil {
+		log.Fatalf("AddKey failed: %v", err)
+	}
+	checkValidateJson(ct, "addkey4", `{ "apple" : 1, "plugin" : { "level" : "high" } }`, "ErrBadType", nil)
+
+	// a failed change leaves the template unchanged
+	if err := ct.AddKey("level", "[]"); err == nil {
+		log.Fatalf("AddKey of a bad specification did not fail")
+	}
+	if err := ct.RemoveKey("/"); err == nil {
+		log.Fatalf("RemoveKey of the root did not fail")
+	}
+	checkValidateJson(ct, "addkey5", `{ "apple" : 1, "plugin" : { "level" : 3 } }`, "", nil)
+
+	if err := ct.RemoveKey("level"); err != nil {
+		log.Fatalf("RemoveKey failed: %v", err)
+	}
+	checkValidateJson(ct, "addkey6", `{ "apple" : 1, "plugin" : { "level" : "high" } }`, "", nil)
+}
+
+func TestValidateStats(t *testing.T) {
+	ct := checkCompile("example", "")
+	var o interface{}
+	if err := json.Unmarshal([]byte(checkJsons["jupiter"]), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	stats, err := ct.ValidateStats(o, nil)
+	if err != nil {
+		log.Fatalf("ValidateStats failed: %v", err)
+	}
+	if expected := (cdl.Stats{Maps: 5, Arrays: 6, Leaves: 12, MaxDepth: 5}); stats != expected {
+		log.Fatalf("ValidateStats gave %+v expecting %+v", stats, expected)
+	}
+	if err := json.Unmarshal([]byte(checkJsons["bad1"]), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if stats, err := ct.ValidateStats(o, nil); err == nil {
+		log.Fatalf("ValidateStats of bad1 did not fail")
+	} else if stats.Maps != 1 || stats.Leaves != 1 {
+		log.Fatalf("ValidateStats of bad1 gave %+v", stats)
+	}
+}
+
+func TestJSONPointer(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":      "{}routes",
+		"routes": "{}/.*/route",
+		"route":  "[]integer",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	me := checkValidateJson(ct, "pointer1", `{ "routes" : { "/api/v1~beta" : [ 1, "x" ] } }`, "ErrBadType", nil)
+	p := me.Path()
+	if s := p.JSONPointer(); s != "/routes/~1api~1v1~0beta/1" {
+		log.Fatalf("Unexpected JSON pointer '%s'", s)
+	}
+	if s := p.String(); s != "/routes//api/v1~beta/1" {
+		log.Fatalf("Unexpected path '%s'", s)
+	}
+	if s := (cdl.Path{}).JSONPointer(); s != "" {
+		log.Fatalf("Unexpected JSON pointer '%s' for root", s)
+	}
+}
+
+func TestPathDepth(t *testing.T) {
+	ct := checkCompile("example", "")
+	depths := map[string]int{}
+	c := cdl.Configurator{
+		"thor": cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError {
+			depths[path.String()] = path.Depth()
+			return nil
+		}),
+		"/": cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError {
+			depths[path.String()] = path.Depth()
+			return nil
+		}),
+	}
+	checkValidateJson(ct, "depth", `{ "apple" : 1, "pear" : [], "plum" : [ 1 ], "raspberry" : [ "a" ], "strawberry" : "x", "guava" : [ "c" ],
+		"mango" : [ { "earth" : 1 }, { "earth" : 1, "jupiter" : [ { "thor" : 1 } ] } ] }`, "", c)
+	if !reflect.DeepEqual(depths, map[string]int{"/": 0, "/mango/1/jupiter/0/thor": 5}) {
+		log.Fatalf("Unexpected depths %v", depths)
+	}
+}
+
+func TestBoolHint(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":       "{}enabled",
+		"enabled": "bool",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "bool1", `{ "enabled" : true }`, "", nil)
+	e := checkValidateJson(ct, "bool2", `{ "enabled" : 1 }`, "ErrBadType", nil)
+	if e.Supplementary != "got number, expected bool, did you quote a boolean?" {
+		log.Fatalf("Unexpected supplementary '%s'", e.Supplementary)
+	}
+	e = checkValidateJson(ct, "bool3", `{ "enabled" : "true" }`, "ErrBadType", nil)
+	if !strings.Contains(e.Supplementary, "did you quote a boolean?") {
+		log.Fatalf("Unexpected supplementary '%s'", e.Supplementary)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	template := cdl.Template{
+		"/": "{}i s? m?",
+		"i": "integar",
+		"s": "string",
+		"m": "map[string]interface {}",
+	}
+	if _, err := cdl.Compile(template); err != nil {
+		log.Fatalf("Non-strict compile failed: %v", err)
+	}
+	_, err := cdl.CompileWithOptions(template, cdl.CompileOptions{Strict: true})
+	if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrUnknownType" {
+		log.Fatalf("Strict compile did not return ErrUnknownType: %v", err)
+	} else if me.Details["suggestion"] != "integer" {
+		log.Fatalf("Strict compile made unexpected suggestion: %v", me)
+	}
+	template["i"] = "integer"
+	if _, err := cdl.CompileWithOptions(template, cdl.CompileOptions{Strict: true}); err != nil {
+		log.Fatalf("Strict compile failed: %v", err)
+	}
+}
+
+func TestRootContext(t *testing.T) {
+	ct := checkCompile("example", "")
+	e := checkValidateJson(ct, "rootarray", `[ 1, 2 ]`, "ErrExpectedMap", nil)
+	if len(e.Context) != 1 || e.Context[0] != "/" || !strings.HasSuffix(e.Error(), "near /") {
+		log.Fatalf("Root error has unexpected context: %v", e)
+	}
+	if p := e.ContextPath(); p != "/" {
+		log.Fatalf("Unexpected context path '%s'", p)
+	}
+	if p := (cdl.Path{}); !p.IsRoot() {
+		log.Fatalf("Empty path is not root")
+	}
+}
+
+func TestDefaultCompileOptions(t *testing.T) {
+	template := cdl.Template{
+		"/": "{}i",
+		"i": "integar",
+	}
+	saved := cdl.DefaultCompileOptions
+	defer func() { cdl.DefaultCompileOptions = saved }()
+	cdl.DefaultCompileOptions.Strict = true
+	if _, err := cdl.Compile(template); err == nil {
+		log.Fatalf("Compile with strict default did not fail")
+	}
+	if _, err := cdl.CompileWithOptions(template, cdl.CompileOptions{}); err != nil {
+		log.Fatalf("Compile with per-call options failed: %v", err)
+	}
+	cdl.DefaultCompileOptions = saved
+	if _, err := cdl.Compile(template); err != nil {
+		log.Fatalf("Compile with restored default failed: %v", err)
+	}
+}
+
+func TestErrorJSON(t *testing.T) {
+	ct := checkCompile("example", "")
+	e := checkValidateJson(ct, "bad1", checkJsons["bad1"], "ErrBadType", nil)
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Fatalf("Marshal failed: %v", err)
+	}
+	expected := `{"type":"ErrBadType","message":"Bad type","path":"/apple","supplementary":"got string expected float64"}`
+	if string(b) != expected {
+		log.Fatalf("Unexpected JSON %s", string(b))
+	}
+	m := cdl.MultiError{e, checkValidateJson(ct, "bad4", `{ "apple" : 1 }`, "ErrMissingMandatory", nil)}
+	if b, err = json.Marshal(m); err != nil {
+		log.Fatalf("Marshal failed: %v", err)
+	}
+	expected = "[" + expected + `,{"type":"ErrMissingMandatory","message":"Missing mandatory key","path":"/","supplementary":"missing 'guava', 'pear', 'plum', 'raspberry', 'strawberry'"}]`
+	if string(b) != expected {
+		log.Fatalf("Unexpected JSON %s", string(b))
+	}
+	if b, err = json.Marshal(cdl.MultiError(nil)); err != nil || string(b) != "[]" {
+		log.Fatalf("Unexpected JSON %s for no errors: %v", string(b), err)
+	}
+	if !strings.Contains(m.Error(), "Bad type") || !strings.Contains(m.Error(), "; Missing mandatory key") {
+		log.Fatalf("Unexpected text '%s'", m.Error())
+	}
+	// nil errors are skipped
+	withNil := cdl.MultiError{nil, m[0], nil, m[1]}
+	if withNil.Error() != m.Error() {
+		log.Fatalf("Unexpected text '%s' with nil errors", withNil.Error())
+	}
+	if b, err = json.Marshal(withNil); err != nil || string(b) != expected {
+		log.Fatalf("Unexpected JSON %s with nil errors: %v", string(b), err)
+	}
+	if b, err = json.Marshal(cdl.MultiError{nil}); err != nil || string(b) != "[]" || (cdl.MultiError{nil}).Error() != "" {
+		log.Fatalf("Unexpected JSON %s for only nil errors: %v", string(b), err)
+	}
+}
+
+func TestValidateEach(t *testing.T) {
+	ct := checkCompile("example", "")
+	var items []interface{}
+	for _, s := range []string{"simple1", "bad1", "simple2"} {
+		var m interface{}
+		if err := json.Unmarshal([]byte(checkJsons[s]), &m); err != nil {
+			log.Fatalf("JSON parse error: %v", err)
+		}
+		items = append(items, m)
+	}
+	errs := ct.ValidateEach(items, nil)
+	if len(errs) != 1 {
+		log.Fatalf("Expected 1 error, got %v", errs)
+	}
+	if me, ok := errs[0].(*cdl.CdlError); !ok || me.Type.String() != "ErrBadType" {
+		log.Fatalf("Unexpected error %v", errs[0])
+	} else if c := me.Context[len(me.Context)-1]; c != "index 1" {
+		log.Fatalf("Error has unexpected outer context '%s'", c)
+	}
+	if errs := ct.ValidateEach(items[:1], nil); errs != nil {
+		log.Fatalf("Unexpected errors %v", errs)
+	}
+	// an error at the root of an item has the root as its context
+	errs = ct.ValidateEach([]interface{}{items[0], 1}, nil)
+	if len(errs) != 1 {
+		log.Fatalf("Expected 1 error, got %v", errs)
+	}
+	if me, ok := errs[0].(*cdl.CdlError); !ok || !reflect.DeepEqual(me.Context, []string{"/", "index 1"}) {
+		log.Fatalf("Unexpected error %v", errs[0])
+	}
+}
+
+func TestNumericConfigurator(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}port ratio",
+		"port":  "integer",
+		"ratio": "number",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var port uint16
+	var ratio float32
+	c := cdl.Configurator{"port": &port, "ratio": &ratio}
+	checkValidateJson(ct, "numeric1", `{ "port" : 8080, "ratio" : 0.5 }`, "", c)
+	if port != 8080 || ratio != 0.5 {
+		log.Fatalf("Numeric configurator set port=%d ratio=%v", port, ratio)
+	}
+	checkValidateJson(ct, "numeric2", `{ "port" : 65536, "ratio" : 0.5 }`, "ErrValueOutOfRange", c)
+	checkValidateJson(ct, "numeric3", `{ "port" : -1, "ratio" : 0.5 }`, "ErrValueOutOfRange", c)
+	checkValidateJson(ct, "numeric4", `{ "port" : 80, "ratio" : 1e300 }`, "ErrValueOutOfRange", c)
+	var whole int
+	checkValidateJson(ct, "numeric5", `{ "port" : 80, "ratio" : 1.5 }`, "ErrBadType", cdl.Configurator{"ratio": &whole})
+}
+
+type celsius float64
+type colour string
+
+func TestAssignConvertible(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":      "{}temp colour? count?",
+		"temp":   "number",
+		"colour": "string",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var temp celsius
+	var c colour
+	var count uint
+	conf := cdl.Configurator{"temp": &temp, "colour": &c, "count": &count}
+	checkValidateJson(ct, "convertible1", `{ "temp" : 21.5, "colour" : "red", "count" : 3 }`, "", conf)
+	if temp != 21.5 || c != "red" || count != 3 {
+		log.Fatalf("Configurator set temp=%v colour=%v count=%v", temp, c, count)
+	}
+	checkValidateJson(ct, "convertible2", `{ "temp" : 21.5, "count" : 3.5 }`, "ErrBadType", conf)
+	checkValidateJson(ct, "convertible3", `{ "temp" : 21.5, "colour" : 7 }`, "ErrBadType", cdl.Configurator{"colour": &c})
+	checkValidateJson(ct, "convertible4", `{ "temp" : 21.5, "count" : "3" }`, "ErrBadType", conf)
+}
+
+func TestAssignOnce(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":         "{}primary secondary?",
+		"primary":   "string",
+		"secondary": "string",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var m interface{}
+	if err := json.Unmarshal([]byte(`{ "primary" : "a", "secondary" : "b" }`), &m); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	var s string
+	c := cdl.Configurator{"primary": &s, "secondary": &s}
+	if _, err := ct.ValidateWithOptions(m, c, cdl.ValidateOptions{}); err != nil {
+		log.Fatalf("Validation failed: %v", err)
+	}
+	_, err = ct.ValidateWithOptions(m, c, cdl.ValidateOptions{AssignOnce: true})
+	if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrBadConfigurator" {
+		log.Fatalf("Second assignment did not return ErrBadConfigurator: %v", err)
+	}
+	if err := json.Unmarshal([]byte(`{ "primary" : "a" }`), &m); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(m, c, cdl.ValidateOptions{AssignOnce: true}); err != nil {
+		log.Fatalf("Single assignment failed: %v", err)
+	}
+}
+
+func TestStringNumbers(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}count? ratio? small? name?",
+		"count": "integer",
+		"ratio": "number",
+		"small": "uint8",
+		"name":  "string",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	opts := cdl.ValidateOptions{StringNumbers: true}
+	for _, tc := range []struct {
+		doc      map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"count": "0x1F"}, ""},
+		{map[string]interface{}{"count": "0b101"}, ""},
+		{map[string]interface{}{"count": "0o17"}, ""},
+		{map[string]interface{}{"count": "42"}, ""},
+		{map[string]interface{}{"count": "0xZZ"}, "ErrBadValue"},
+		{map[string]interface{}{"count": "1.5"}, "ErrBadValue"},
+		{map[string]interface{}{"ratio": "1.5"}, ""},
+		{map[string]interface{}{"small": "0xff"}, ""},
+		{map[string]interface{}{"small": "0x100"}, "ErrValueOutOfRange"},
+		{map[string]interface{}{"name": "0x1F"}, ""},
+	} {
+		_, err := ct.ValidateWithOptions(tc.doc, nil, opts)
+		if tc.expected == "" {
+			if err != nil {
+				log.Fatalf("Validate of %v failed: %v", tc.doc, err)
+			}
+		} else if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != tc.expected {
+			log.Fatalf("Validate of %v returned %v, expected %s", tc.doc, err, tc.expected)
+		}
+	}
+	var count int
+	if _, err := ct.ValidateWithOptions(map[string]interface{}{"count": "0x1F"}, cdl.Configurator{"count": &count}, opts); err != nil || count != 31 {
+		log.Fatalf("Configurator set count %d: %v", count, err)
+	}
+	if err := ct.Validate(map[string]interface{}{"count": "0x1F"}, nil); err == nil {
+		log.Fatalf("String integer accepted without StringNumbers")
+	}
+}
+
+func TestWidenNumbers(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/": "{}x? y? z?",
+		"x": "int",
+		"y": "uint",
+		"z": "float64",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "widen1", `{ "x" : 3 }`, "ErrBadType", nil)
+	opts := cdl.ValidateOptions{WidenNumbers: true}
+	for _, tc := range []struct {
+		doc      map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"x": 3.0}, ""},
+		{map[string]interface{}{"x": 3.5}, "ErrBadType"},
+		{map[string]interface{}{"x": "3"}, "ErrBadType"},
+		{map[string]interface{}{"y": 3.0}, ""},
+		{map[string]interface{}{"y": -3.0}, "ErrValueOutOfRange"},
+		{map[string]interface{}{"z": 3}, ""},
+		{map[string]interface{}{"z": uint8(3)}, ""},
+		{map[string]interface{}{"z": int64(1 << 53)}, ""},
+		{map[string]interface{}{"z": int64(1<<53 + 1)}, "ErrBadValue"},
+		{map[string]interface{}{"z": ^uint64(0)}, "ErrBadValue"},
+	} {
+		_, err := ct.ValidateWithOptions(tc.doc, nil, opts)
+		if tc.expected == "" {
+			if err != nil {
+				log.Fatalf("Validate of %v failed: %v", tc.doc, err)
+			}
+		} else if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != tc.expected {
+			log.Fatalf("Validate of %v returned %v, expected %s", tc.doc, err, tc.expected)
+		}
+	}
+	var o interface{}
+	if err := json.Unmarshal([]byte(`{ "x" : 3 }`), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	var x int
+	if _, err := ct.ValidateWithOptions(o, cdl.Configurator{"x": &x}, opts); err != nil || x != 3 {
+		log.Fatalf("Configurator set x %d: %v", x, err)
+	}
+}
+
+func TestMutateInPlace(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":       "{}count timeout? sizes* name?",
+		"count":   "integer",
+		"timeout": "duration",
+		"sizes":   "number",
+		"name":    "string",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var o map[string]interface{}
+	if err := json.Unmarshal([]byte(`{ "count" : 3, "timeout" : "5s", "sizes" : [ 1, 2 ], "name" : "x" }`), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if err := ct.Validate(o, nil); err != nil {
+		log.Fatalf("Validate failed: %v", err)
+	}
+	if _, ok := o["count"].(float64); !ok {
+		log.Fatalf("Validate without MutateInPlace changed count to %T", o["count"])
+	}
+	if _, err := ct.ValidateWithOptions(o, nil, cdl.ValidateOptions{MutateInPlace: true}); err != nil {
+		log.Fatalf("Validate with MutateInPlace failed: %v", err)
+	}
+	if n, ok := o["count"].(int); !ok || n != 3 {
+		log.Fatalf("MutateInPlace set count to %T %v", o["count"], o["count"])
+	}
+	if d, ok := o["timeout"].(time.Duration); !ok || d != 5*time.Second {
+		log.Fatalf("MutateInPlace set timeout to %T %v", o["timeout"], o["timeout"])
+	}
+	if sizes, ok := o["sizes"].([]interface{}); !ok || !reflect.DeepEqual(sizes, []interface{}{1.0, 2.0}) {
+		log.Fatalf("MutateInPlace set sizes to %#v", o["sizes"])
+	}
+	if o["name"] != "x" {
+		log.Fatalf("MutateInPlace set name to %#v", o["name"])
+	}
+	// typed slices are validated but not modified
+	sizes := []int{1, 2}
+	o = map[string]interface{}{"count": 3, "sizes": sizes}
+	if _, err := ct.ValidateWithOptions(o, nil, cdl.ValidateOptions{MutateInPlace: true}); err != nil {
+		log.Fatalf("Validate with MutateInPlace failed: %v", err)
+	}
+	if s, ok := o["sizes"].([]int); !ok || !reflect.DeepEqual(s, sizes) {
+		log.Fatalf("MutateInPlace set typed sizes to %#v", o["sizes"])
+	}
+	o = map[string]interface{}{"count": 3, "sizes": []string{"1"}}
+	if _, err := ct.ValidateWithOptions(o, nil, cdl.ValidateOptions{MutateInPlace: true}); err == nil {
+		log.Fatalf("Validate of strings as sizes did not fail")
+	}
+}
+
+func TestRaw(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":      "{}name plugin",
+		"name":   "string",
+		"plugin": "raw",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(`{ "name" : "x", "plugin" : { "anything" : [ 1, 2 ] } }`), &doc); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	var name string
+	if err := json.Unmarshal(doc["name"], &name); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	var plugin json.RawMessage
+	c := cdl.Configurator{"plugin": &plugin}
+	if err := ct.Validate(map[string]interface{}{"name": name, "plugin": doc["plugin"]}, c); err != nil {
+		log.Fatalf("Validate of raw message failed: %v", err)
+	}
+	if string(plugin) != `{ "anything" : [ 1, 2 ] }` {
+		log.Fatalf("Configurator set plugin to %s", string(plugin))
+	}
+	if err := ct.Validate(map[string]interface{}{"name": name, "plugin": []byte(`[ 1 ]`)}, c); err != nil || string(plugin) != "[ 1 ]" {
+		log.Fatalf("Validate of raw bytes failed: %s %v", string(plugin), err)
+	}
+	if err := ct.Validate(map[string]interface{}{"name": name, "plugin": []byte(`{ bad`)}, nil); err == nil {
+		log.Fatalf("Validate of invalid raw bytes did not fail")
+	}
+	// bytes which are valid JSON but not an object or array are not raw
+	for _, b := range []string{`42`, ` "x"`, `true`, ``} {
+		if err := ct.Validate(map[string]interface{}{"name": name, "plugin": []byte(b)}, nil); err == nil {
+			log.Fatalf("Validate of raw bytes '%s' did not fail", b)
+		}
+	}
+	if err := ct.Validate(map[string]interface{}{"name": name, "plugin": json.RawMessage(`42`)}, nil); err != nil {
+		log.Fatalf("Validate of raw message of a number failed: %v", err)
+	}
+	if err := ct.Validate(map[string]interface{}{"name": name, "plugin": "{}"}, nil); err == nil {
+		log.Fatalf("Validate of string as raw did not fail")
+	}
+}
+
+func TestTyped(t *testing.T) {
+	ct, err := cdl.CompileWithOptions(cdl.Template{
+		"/":       "{}timeout address colour servers*",
+		"timeout": "duration",
+		"address": "ip",
+		"colour":  "@palette",
+		"servers": "{}host port",
+		"host":    "ip",
+		"port":    "integer",
+	}, cdl.CompileOptions{Enums: map[string]cdl.EnumType{"palette": cdl.NewEnumType("red", "green")}})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var o interface{}
+	if err := json.Unmarshal([]byte(`{ "timeout" : "1m30s", "address" : "192.0.2.1", "colour" : "green",
+		"servers" : [ { "host" : "2001:db8::1", "port" : 80 } ] }`), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	m, err := ct.Typed(o)
+	if err != nil {
+		log.Fatalf("Typed failed: %v", err)
+	}
+	if d, ok := m["timeout"].(time.Duration); !ok || d != 90*time.Second {
+		log.Fatalf("Typed gave timeout %#v", m["timeout"])
+	}
+	if ip, ok := m["address"].(net.IP); !ok || !ip.Equal(net.ParseIP("192.0.2.1")) {
+		log.Fatalf("Typed gave address %#v", m["address"])
+	}
+	if e, ok := m["colour"].(cdl.Enum); !ok || e.String() != "green" {
+		log.Fatalf("Typed gave colour %#v", m["colour"])
+	}
+	server := m["servers"].([]interface{})[0].(map[string]interface{})
+	if ip, ok := server["host"].(net.IP); !ok || !ip.Equal(net.ParseIP("2001:db8::1")) || server["port"] != 80 {
+		log.Fatalf("Typed gave server %#v", server)
+	}
+	if o.(map[string]interface{})["timeout"] != "1m30s" {
+		log.Fatalf("Typed modified the object passed")
+	}
+	if _, err := ct.Typed(map[string]interface{}{"timeout": "1s", "address": "999.0.0.1", "colour": "red"}); err == nil {
+		log.Fatalf("Typed of bad ip did not fail")
+	}
+	type config struct {
+		Timeout string        `json:"timeout"`
+		Address string        `json:"address"`
+		Colour  string        `json:"colour"`
+		Servers []interface{} `json:"servers"`
+	}
+	for _, c := range []interface{}{config{"1s", "192.0.2.1", "red", []interface{}{}}, &config{"1s", "192.0.2.1", "red", []interface{}{}}} {
+		m, err := ct.Typed(c)
+		if err != nil {
+			log.Fatalf("Typed of %T failed: %v", c, err)
+		}
+		if d, ok := m["timeout"].(time.Duration); !ok || d != time.Second {
+			log.Fatalf("Typed of %T gave timeout %#v", c, m["timeout"])
+		}
+	}
+	// maps are copied whatever their keys
+	ct, err = cdl.Compile(cdl.Template{
+		"/":    "{}data",
+		"data": cdl.ValidatorFunc(func(o interface{}) *cdl.CdlError { return nil }),
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	data := map[interface{}]interface{}{1: []interface{}{"x"}}
+	m, err = ct.Typed(map[string]interface{}{"data": data})
+	if err != nil {
+		log.Fatalf("Typed failed: %v", err)
+	}
+	m["data"].(map[interface{}]interface{})[1].([]interface{})[0] = "y"
+	if data[1].([]interface{})[0] != "x" {
+		log.Fatalf("Typed shared a map with a non-string key")
+	}
+}
+
+func TestSecretKeys(t *testing.T) {
+	weak := func(o interface{}) *cdl.CdlError {
+		if s, ok := o.(string); ok && len(s) < 10 {
+			return cdl.NewError("ErrBadValue").SetSupplementary(fmt.Sprintf("'%s' is too short", s)).WithField("got", s)
+		}
+		return nil
+	}
+	ct, err := cdl.CompileWithOptions(cdl.Template{
+		"/":           "{}user password? pin? credentials?",
+		"user":        weak,
+		"password":    weak,
+		"pin":         "@pins",
+		"credentials": "{}token",
+		"token":       "integer",
+	}, cdl.CompileOptions{
+		SecretKeys: []string{"password", "pin", "credentials"},
+		Enums:      map[string]cdl.EnumType{"pins": cdl.NewEnumType("1234")},
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	for _, c := range []struct {
+		json   string
+		secret string
+	}{
+		{`{ "user" : "administrator", "password" : "hunter2" }`, "hunter2"},
+		{`{ "user" : "administrator", "pin" : "4321" }`, "4321"},
+		{`{ "user" : "administrator", "credentials" : { "token" : "s3cr3t" } }`, "string"},
+	} {
+		var o interface{}
+		if err := json.Unmarshal([]byte(c.json), &o); err != nil {
+			log.Fatalf("JSON parse error: %v", err)
+		}
+		err := ct.Validate(o, nil)
+		if err == nil {
+			log.Fatalf("Validate of %s did not fail", c.json)
+		}
+		me := err.(*cdl.CdlError)
+		if strings.Contains(me.Error(), c.secret) || me.Supplementary != "***" {
+			log.Fatalf("Validate of %s revealed a secret: %v", c.json, me)
+		}
+		if got, ok := me.Details["got"]; ok && got != "***" {
+			log.Fatalf("Validate of %s revealed a secret in its details: %v", c.json, me.Details)
+		}
+		if _, ok := me.Details["allowed"]; ok {
+			log.Fatalf("Validate of %s revealed the allowed values of a secret: %v", c.json, me.Details)
+		}
+	}
+	// other keys are not redacted
+	if err := ct.Validate(map[string]interface{}{"user": "admin"}, nil); err == nil || !strings.Contains(err.Error(), "admin") {
+		log.Fatalf("Validate of short user gave unexpected error: %v", err)
+	}
+
+	// nor are warnings about secrets revealed
+	reused := func(o interface{}) *cdl.CdlError {
+		if s, ok := o.(string); ok && s == "password123" {
+			return cdl.NewWarning("ErrBadValue").SetSupplementary(fmt.Sprintf("'%s' is commonly used", s)).WithField("got", s)
+		}
+		return nil
+	}
+	ct, err = cdl.CompileWithOptions(cdl.Template{
+		"/":        "{}user password",
+		"user":     reused,
+		"password": reused,
+	}, cdl.CompileOptions{SecretKeys: []string{"password"}})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	result, err := ct.ValidateWithOptions(map[string]interface{}{"user": "password123", "password": "password123"}, nil, cdl.ValidateOptions{})
+	if err != nil {
+		log.Fatalf("Validate with warnings failed: %v", err)
+	}
+	if len(result.Warnings) != 2 {
+		log.Fatalf("Unexpected warnings: %v", result.Warnings)
+	}
+	for _, w := range result.Warnings {
+		secret := strings.HasSuffix(w.Path.String(), "password")
+		if revealed := strings.Contains(w.String(), "password123") || w.Err.Details["got"] != "***"; revealed == secret {
+			log.Fatalf("Warning at %s redacted wrongly: %v %v", w.Path.String(), w, w.Err.Details)
+		}
+	}
+}
+
+func TestInterfaceConfigurator(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":      "{}weight name extra",
+		"weight": "number",
+		"name":   "string",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var weight, name interface{}
+	extra := interface{}("unset")
+	var o interface{}
+	if err := json.Unmarshal([]byte(`{ "weight" : 3, "name" : "kiwi", "extra" : null }`), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if err := ct.Validate(o, cdl.Configurator{"weight": &weight, "name": &name, "extra": &extra}); err != nil {
+		log.Fatalf("Validate failed: %v", err)
+	}
+	if weight != 3.0 || name != "kiwi" || extra != nil {
+		log.Fatalf("Configurator set weight %#v name %#v extra %#v", weight, name, extra)
+	}
+	// coercion still applies, so an integer is captured as an int
+	ct, err = cdl.Compile(cdl.Template{"/": "{}weight", "weight": "integer"})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	if err := ct.Validate(map[string]interface{}{"weight": 3.0}, cdl.Configurator{"weight": &weight}); err != nil {
+		log.Fatalf("Validate failed: %v", err)
+	}
+	if weight != 3 {
+		log.Fatalf("Configurator set weight %#v", weight)
+	}
+}
+
+func TestHostPortParts(t *testing.T) {
+	ct := checkCompile("example", "")
+	var host string
+	var port int
+	var whole cdl.HostPort
+	c := cdl.Configurator{"cherry.host": &host, "cherry.port": &port, "cherry": &whole}
+	checkValidate(ct, "cherry", "", c)
+	if host != "127.0.0.1" || port != 1234 || whole.String() != "127.0.0.1:1234" {
+		log.Fatalf("Configurator set host '%s' port %d whole '%s'", host, port, whole.String())
+	}
+	var portName string
+	c = cdl.Configurator{"cherry.port": cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError {
+		if path.String() != "/cherry" {
+			log.Fatalf("Port configurator called with path %s", path.String())
+		}
+		portName = fmt.Sprintf("%T %v", o, o)
+		return nil
+	})}
+	checkValidate(ct, "cherry", "", c)
+	if portName != "int 1234" {
+		log.Fatalf("Configurator func given port %s", portName)
+	}
+	// parts are configured as any other item
+	var hostName string
+	c = cdl.Configurator{"cherry.host": cdl.ReplacingConfiguratorFunc(func(o interface{}, path cdl.Path) (interface{}, *cdl.CdlError) {
+		hostName = fmt.Sprintf("%T %v", o, o)
+		return o, nil
+	})}
+	checkValidate(ct, "cherry", "", c)
+	if hostName != "string 127.0.0.1" {
+		log.Fatalf("Replacing configurator func given host %s", hostName)
+	}
+}
+
+func TestSorted(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":          "{}thresholds? priorities? names? timeouts?",
+		"thresholds": "[]number{1,} sorted",
+		"priorities": "[]priority sorted-",
+		"priority":   "integer",
+		"names":      "[]string sorted",
+		"timeouts":   "[]duration sorted",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "sorted1", `{ "thresholds" : [ 1, 2, 2, 10 ], "priorities" : [ 9, 5, 1 ], "names" : [ "a", "b" ], "timeouts" : [ "1s", "1m" ] }`, "", nil)
+	checkValidateJson(ct, "sorted2", `{ "thresholds" : [ 1 ], "priorities" : [], "names" : [] }`, "", nil)
+	me := checkValidateJson(ct, "sorted3", `{ "thresholds" : [ 1, 10, 2 ] }`, "ErrNotSorted", nil)
+	if me.Details["index"] != 2 || me.ContextPath() != "/thresholds/2" {
+		log.Fatalf("Unexpected error for unsorted array: %v %v", me, me.Details)
+	}
+	checkValidateJson(ct, "sorted4", `{ "priorities" : [ 1, 5 ] }`, "ErrNotSorted", nil)
+	checkValidateJson(ct, "sorted5", `{ "names" : [ "b", "a" ] }`, "ErrNotSorted", nil)
+	checkValidateJson(ct, "sorted6", `{ "timeouts" : [ "1m", "1s" ] }`, "ErrNotSorted", nil)
+
+	for _, bad := range []cdl.Template{
+		{"/": "{}shapes", "shapes": "[]shape sorted", "shape": "{}sides"},
+		{"/": "[]bool sorted"},
+		{"/": "[]number sorted+"},
+	} {
+		if _, err := cdl.Compile(bad); err == nil {
+			log.Fatalf("Compile of %v did not fail", bad)
+		}
+	}
+	// elements are compared as validated, so numbers given as strings are compared as numbers
+	opts := cdl.ValidateOptions{StringNumbers: true}
+	if _, err := ct.ValidateWithOptions(map[string]interface{}{"thresholds": []interface{}{"9", "10"}}, nil, opts); err != nil {
+		log.Fatalf("Sorted numbers given as strings failed: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(map[string]interface{}{"thresholds": []interface{}{"10", "9"}}, nil, opts); err == nil {
+		log.Fatalf("Unsorted numbers given as strings validated")
+	}
+	// integers are compared exactly
+	if err := ct.Validate(map[string]interface{}{"thresholds": []interface{}{int64(1<<53 + 1), int64(1 << 53)}}, nil); err == nil {
+		log.Fatalf("Unsorted large integers validated")
+	}
+	if err := ct.Validate(map[string]interface{}{"thresholds": []interface{}{int64(1 << 53), uint64(1<<53 + 1), uint64(1<<64 - 1)}}, nil); err != nil {
+		log.Fatalf("Sorted large integers failed: %v", err)
+	}
+}
+
+func TestWrapScalars(t *testing.T) {
+	ct := checkCompile("example", "")
+	doc := `{ "apple" : 1, "pear" : [], "plum" : 2, "raspberry" : [ "a" ], "strawberry" : "x", "guava" : "c" }`
+	checkValidateJson(ct, "wrapscalars1", doc, "ErrExpectedArray", nil)
+
+	var o interface{}
+	if err := json.Unmarshal([]byte(doc), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	var plums []float64
+	c := cdl.Configurator{"plum": cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError {
+		if path.String() != "/plum/0" {
+			log.Fatalf("Plum configurator called with path %s", path.String())
+		}
+		plums = append(plums, o.(float64))
+		return nil
+	})}
+	if _, err := ct.ValidateWithOptions(o, c, cdl.ValidateOptions{WrapScalars: true, MutateInPlace: true}); err != nil {
+		log.Fatalf("Validate with WrapScalars failed: %v", err)
+	}
+	if !reflect.DeepEqual(plums, []float64{2}) {
+		log.Fatalf("Configurator given plums %v", plums)
+	}
+	m := o.(map[string]interface{})
+	if !reflect.DeepEqual(m["plum"], []interface{}{2.0}) || !reflect.DeepEqual(m["guava"], []interface{}{"c"}) {
+		log.Fatalf("MutateInPlace gave plum %#v guava %#v", m["plum"], m["guava"])
+	}
+
+	// an array specifier
+	ct, err := cdl.Compile(cdl.Template{"/": "{}tags", "tags": "[]string{1,2}"})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var tags interface{}
+	if _, err := ct.ValidateWithOptions(map[string]interface{}{"tags": "red"}, cdl.Configurator{"tags": &tags},
+		cdl.ValidateOptions{WrapScalars: true}); err != nil {
+		log.Fatalf("Validate with WrapScalars failed: %v", err)
+	}
+	if !reflect.DeepEqual(tags, []interface{}{"red"}) {
+		log.Fatalf("Configurator set tags %#v", tags)
+	}
+	// maps are not wrapped
+	for _, m := range []interface{}{map[string]interface{}{}, cdl.NewOrderedMap(), &struct{}{}} {
+		_, err := ct.ValidateWithOptions(map[string]interface{}{"tags": m}, nil, cdl.ValidateOptions{WrapScalars: true})
+		if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrExpectedArray" {
+			log.Fatalf("Validate of %T with WrapScalars did not return ErrExpectedArray: %v", m, err)
+		}
+	}
+}
+
+func TestPseudoTypeMessages(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":       "{}server? contact? count?",
+		"server":  "ipport",
+		"contact": "email",
+		"count":   "integer",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "email1", `{ "contact" : "fred@example.com" }`, "", nil)
+	for _, c := range []struct {
+		json    string
+		message string
+	}{
+		{`{ "server" : "localhost" }`, "got 'localhost', must be host:port"},
+		{`{ "server" : 80 }`, "got float64, must be host:port"},
+		{`{ "contact" : "fred" }`, "got 'fred', must be a valid email address"},
+		{`{ "contact" : "Fred <fred@example.com>" }`, "must be a valid email address"},
+		{`{ "count" : 1.5 }`, "got float64, must be a whole number"},
+	} {
+		me := checkValidateJson(ct, c.json, c.json, "ErrBadType", nil)
+		if !strings.Contains(me.Supplementary, c.message) {
+			log.Fatalf("Validate of %s gave '%s', expecting '%s'", c.json, me.Supplementary, c.message)
+		}
+	}
+}
+
+func TestTrimTrailingNulls(t *testing.T) {
+	ct := checkCompile("example", "")
+	doc := `{ "apple" : 1, "pear" : [], "plum" : [ 1 ], "raspberry" : [ "a", "b", "c", null, null ], "strawberry" : "x", "guava" : [ "c" ] }`
+	checkValidateJson(ct, "trimnulls1", doc, "ErrOutOfRange", nil)
+
+	var o interface{}
+	if err := json.Unmarshal([]byte(doc), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(o, nil, cdl.ValidateOptions{TrimTrailingNulls: true, MutateInPlace: true}); err != nil {
+		log.Fatalf("Validate with TrimTrailingNulls failed: %v", err)
+	}
+	m := o.(map[string]interface{})
+	if !reflect.DeepEqual(m["raspberry"], []interface{}{"a", "b", "c"}) {
+		log.Fatalf("MutateInPlace gave raspberry %#v", m["raspberry"])
+	}
+	// arrays given by a specifier rather than a modifier are trimmed too
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}a pair? delay?",
+		"a":     "[]number",
+		"pair":  "(duration,number)",
+		"delay": "oneof(duration|number)",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	m = map[string]interface{}{"a": []interface{}{1.0, nil}, "pair": []interface{}{"1s", 2.0}, "delay": "5s"}
+	if _, err := ct.ValidateWithOptions(m, nil, cdl.ValidateOptions{TrimTrailingNulls: true, MutateInPlace: true}); err != nil {
+		log.Fatalf("Validate with TrimTrailingNulls failed: %v", err)
+	}
+	if !reflect.DeepEqual(m["a"], []interface{}{1.0}) {
+		log.Fatalf("MutateInPlace gave a %#v", m["a"])
+	}
+	if !reflect.DeepEqual(m["pair"], []interface{}{time.Second, 2.0}) {
+		log.Fatalf("MutateInPlace gave pair %#v", m["pair"])
+	}
+	if m["delay"] != 5*time.Second {
+		log.Fatalf("MutateInPlace gave delay %#v", m["delay"])
+	}
+}
+
+func TestSharedValueMap(t *testing.T) {
+	tmpl := cdl.Template{
+		"/":        "{}settings? limits? colours? servers?",
+		"settings": "{}:string",
+		"limits":   "{}:integer",
+		"colours":  "{}:@palette",
+		"servers":  "{}:server",
+		"server":   "{}host port?",
+	}
+	if _, err := cdl.Compile(tmpl); err == nil {
+		log.Fatalf("Compile with unknown enum did not fail")
+	}
+	ct, err := cdl.CompileWithOptions(tmpl, cdl.CompileOptions{Enums: map[string]cdl.EnumType{"palette": cdl.NewEnumType("red", "green")}})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "shared1", `{ "settings" : { "a" : "x", "b-c" : "y", "D" : "z" }, "limits" : { "cpu" : 2 }, "colours" : { "sky" : "green" } }`, "", nil)
+	checkValidateJson(ct, "shared2", `{ "settings" : {} }`, "", nil)
+	checkValidateJson(ct, "shared3", `{ "settings" : { "a" : "x", "b" : 2 } }`, "ErrBadType", nil)
+	checkValidateJson(ct, "shared4", `{ "limits" : { "cpu" : 2.5 } }`, "ErrBadType", nil)
+	checkValidateJson(ct, "shared5", `{ "colours" : { "sky" : "blue" } }`, "ErrBadEnumValue", nil)
+	checkValidateJson(ct, "shared6", `{ "servers" : { "main" : { "host" : "a" }, "backup" : { "port" : 1 } } }`, "ErrMissingMandatory", nil)
+
+	var settings = map[string]string{}
+	c := cdl.Configurator{"/settings/*": cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError {
+		settings[path.StringSlice()[1]] = o.(string)
+		return nil
+	})}
+	checkValidateJson(ct, "shared7", `{ "settings" : { "a" : "x", "b" : "y" } }`, "", c)
+	if !reflect.DeepEqual(settings, map[string]string{"a": "x", "b": "y"}) {
+		log.Fatalf("Configurator gave settings %v", settings)
+	}
+	if _, err := cdl.Compile(cdl.Template{"/": "{}:string{1,}"}); err == nil {
+		log.Fatalf("Compile of bad shared map specification did not fail")
+	}
+}
+
+func TestUniqueArrays(t *testing.T) {
+	ct, err := cdl.CompileWithOptions(cdl.Template{
+		"/":       "{}colours? sizes? tags?",
+		"colours": "[]@palette unique",
+		"sizes":   "[]number{1,} sorted unique",
+		"tags":    "[]string",
+	}, cdl.CompileOptions{Enums: map[string]cdl.EnumType{"palette": cdl.NewEnumType("red", "green", "blue")}})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "unique1", `{ "colours" : [ "red", "blue", "green" ], "sizes" : [ 1, 2, 3 ], "tags" : [ "a", "a" ] }`, "", nil)
+	me := checkValidateJson(ct, "unique2", `{ "colours" : [ "red", "blue", "red" ] }`, "ErrDuplicate", nil)
+	if me.Details["index"] != 2 || me.Details["first"] != 0 || me.ContextPath() != "/colours/2" {
+		log.Fatalf("Unexpected error for duplicated enum: %v %v", me, me.Details)
+	}
+	checkValidateJson(ct, "unique3", `{ "sizes" : [ 1, 2, 2 ] }`, "ErrDuplicate", nil)
+	if err := ct.Validate(map[string]interface{}{"sizes": []interface{}{int64(1 << 53), int64(1<<53 + 1)}}, nil); err != nil {
+		log.Fatalf("Distinct large integers failed: %v", err)
+	}
+	if err := ct.Validate(map[string]interface{}{"sizes": []interface{}{1, 1.0}}, nil); err == nil {
+		log.Fatalf("Equal integer and float validated as unique")
+	}
+
+	// enums delivered as Enum values are compared by value
+	var o interface{}
+	if err := json.Unmarshal([]byte(`{ "colours" : [ "green", "green" ] }`), &o); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	if _, err := ct.ValidateWithOptions(o, nil, cdl.ValidateOptions{MutateInPlace: true}); err == nil {
+		log.Fatalf("Validate of duplicated enum with MutateInPlace did not fail")
+	}
+}
+
+func TestUnion(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":      "{}shape",
+		"shape":  "oneof(square|points|string)",
+		"square": "{}a",
+		"a":      "number",
+		"points": "[]b{1,}",
+		"b":      "(number,number)",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var squares, points int
+	c := cdl.Configurator{
+		"square": cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError { squares++; return nil }),
+		"b":      cdl.ConfiguratorFunc(func(o interface{}, path cdl.Path) *cdl.CdlError { points++; return nil }),
+	}
+	checkValidateJson(ct, "oneof1", `{ "shape" : { "a" : 2 } }`, "", c)
+	checkValidateJson(ct, "oneof2", `{ "shape" : [ [ 0, 0 ], [ 1, 1 ] ] }`, "", c)
+	checkValidateJson(ct, "oneof3", `{ "shape" : "circle" }`, "", c)
+	if squares != 1 || points != 2 {
+		log.Fatalf("Configurators called for %d squares and %d points", squares, points)
+	}
+	me := checkValidateJson(ct, "oneof4", `{ "shape" : 7 }`, "ErrBadType", nil)
+	if !strings.Contains(me.Supplementary, "matches none of 'square', 'points', 'string'") {
+		log.Fatalf("Unexpected error for no match: %v", me)
+	}
+	// the deepest error is returned
+	me = checkValidateJson(ct, "oneof5", `{ "shape" : [ [ 0, 0 ], [ 1, "x" ] ] }`, "ErrBadType", nil)
+	if me.ContextPath() != "/shape/1/1" {
+		log.Fatalf("Unexpected error for bad points: %v", me)
+	}
+	me = checkValidateJson(ct, "oneof6", `{ "shape" : { "a" : "x" } }`, "ErrBadType", nil)
+	if me.ContextPath() != "/shape/a" {
+		log.Fatalf("Unexpected error for bad square: %v", me)
+	}
+	// a union may not be its own alternative, but may contain itself
+	for _, tmpl := range []cdl.Template{
+		{"/": "{}x", "x": "oneof(y|number)", "y": "oneof(x|string)"},
+		{"/": "{}x", "x": "oneof(number|x)"},
+	} {
+		if _, err := cdl.Compile(tmpl); err == nil || err.(*cdl.CdlError).Type.String() != "ErrBadOptionValue" {
+			log.Fatalf("Compile of cyclic union %v returned %v", tmpl, err)
+		}
+	}
+	ct, err = cdl.Compile(cdl.Template{"/": "{}x", "x": "oneof(number|y)", "y": "[]x"})
+	if err != nil {
+		log.Fatalf("Compile of recursive union failed: %v", err)
+	}
+	checkValidateJson(ct, "oneof7", `{ "x" : [ 1, [ 2, [] ] ] }`, "", nil)
+	checkValidateJson(ct, "oneof8", `{ "x" : [ 1, [ true ] ] }`, "ErrBadType", nil)
+}
+
+func TestConflictingModifiers(t *testing.T) {
+	for _, spec := range []string{"{}apple?!", "{}apple*+", "{}apple?-", "{}apple??", "{}apple*{1,2}", "{}apple+=*", "{}(apple|pear*+)"} {
+		_, err := cdl.Compile(cdl.Template{"/": spec})
+		if err == nil {
+			log.Fatalf("Compile of %s did not fail", spec)
+		}
+		if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrBadOptionModifier" || !strings.Contains(me.Supplementary, "conflicting modifiers") {
+			log.Fatalf("Compile of %s gave unexpected error %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"{}apple?*", "{}apple!{1,2}", "{}apple{1,4}?", "{}apple=?", "{}apple-"} {
+		if _, err := cdl.Compile(cdl.Template{"/": spec}); err != nil {
+			log.Fatalf("Compile of %s failed: %v", spec, err)
+		}
+	}
+}
+
+func TestSets(t *testing.T) {
+	countries := []string{"FR", "GB", "US"}
+	tmpl := cdl.Template{
+		"/":        "{}country? currency? codes?",
+		"country":  "#countries",
+		"currency": cdl.InSet([]string{"EUR", "GBP", "USD"}),
+		"codes":    "[]code",
+		"code":     "#countries",
+	}
+	if _, err := cdl.Compile(tmpl); err == nil {
+		log.Fatalf("Compile with unknown set did not fail")
+	}
+	ct, err := cdl.CompileWithOptions(tmpl, cdl.CompileOptions{Sets: map[string][]string{"countries": countries}})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "sets1", `{ "country" : "GB", "currency" : "EUR", "codes" : [ "FR", "US" ] }`, "", nil)
+	me := checkValidateJson(ct, "sets2", `{ "country" : "XX" }`, "ErrBadEnumValue", nil)
+	if !strings.Contains(me.Supplementary, "'XX' in set 'countries'") {
+		log.Fatalf("Unexpected error for value not in set: %v", me)
+	}
+	checkValidateJson(ct, "sets3", `{ "currency" : "JPY" }`, "ErrBadEnumValue", nil)
+	checkValidateJson(ct, "sets4", `{ "codes" : [ "FR", "fr" ] }`, "ErrBadEnumValue", nil)
+	checkValidateJson(ct, "sets5", `{ "country" : 44 }`, "ErrBadType", nil)
+
+	// sets may be given inline wherever enums may
+	ct, err = cdl.CompileWithOptions(cdl.Template{
+		"/":      "{}list? byname? either? pair? more? ...extra:#countries",
+		"list":   "[]#countries{1,2}",
+		"byname": "{}:#countries",
+		"either": "oneof(#countries|integer)",
+		"pair":   "(#countries,number)",
+		"more":   "{}...other:#countries",
+	}, cdl.CompileOptions{Sets: map[string][]string{"countries": countries}})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "sets6", `{ "list" : [ "FR", "US" ], "byname" : { "home" : "GB" }, "either" : "US", "pair" : [ "FR", 1 ], "more" : { "a" : "FR" }, "x" : "GB" }`, "", nil)
+	checkValidateJson(ct, "sets7", `{ "either" : 1 }`, "", nil)
+	for _, doc := range []string{
+		`{ "list" : [ "XX" ] }`,
+		`{ "byname" : { "home" : "XX" } }`,
+		`{ "pair" : [ "XX", 1 ] }`,
+		`{ "more" : { "a" : "XX" } }`,
+		`{ "x" : "XX" }`,
+	} {
+		checkValidateJson(ct, "sets8", doc, "ErrBadEnumValue", nil)
+	}
+	checkValidateJson(ct, "sets9", `{ "either" : "XX" }`, "ErrBadType", nil)
+	if _, err := cdl.Compile(cdl.Template{"/": "{}list", "list": "[]#countries"}); err == nil {
+		log.Fatalf("Compile with unknown inline set did not fail")
+	}
+}
+
+func TestBytes(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":    "{}blob",
+		"blob": "bytes",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var blob []byte
+	if err := ct.Validate(map[string]interface{}{"blob": []byte{0, 1, 255}}, cdl.Configurator{"blob": &blob}); err != nil {
+		log.Fatalf("Validate of bytes failed: %v", err)
+	}
+	if !reflect.DeepEqual(blob, []byte{0, 1, 255}) {
+		log.Fatalf("Configurator set blob to %v", blob)
+	}
+	if err := ct.Validate(map[string]interface{}{"blob": "abc"}, nil); err == nil {
+		log.Fatalf("Validate of string as bytes did not fail")
+	}
+	if err := ct.Validate(map[string]interface{}{"blob": []interface{}{1.0}}, nil); err == nil {
+		log.Fatalf("Validate of array as bytes did not fail")
+	}
+}
+
+func TestSizedNumbers(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}count? small? ratio?",
+		"count": "int32",
+		"small": "uint8",
+		"ratio": "float32",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var count int32
+	var got interface{}
+	c := cdl.Configurator{
+		"count": &count,
+		"small": func(o interface{}, p cdl.Path) *cdl.CdlError {
+			got = o
+			return nil
+		},
+	}
+	checkValidateJson(ct, "sized1", `{ "count" : 42 }`, "", c)
+	if count != 42 {
+		log.Fatalf("int32 configurator set %d", count)
+	}
+	checkValidateJson(ct, "sized2", `{ "count" : 4.5 }`, "ErrBadType", c)
+	checkValidateJson(ct, "sized3", `{ "count" : 3e9 }`, "ErrValueOutOfRange", c)
+	checkValidateJson(ct, "sized4", `{ "small" : 255 }`, "", c)
+	if got != uint8(255) {
+		log.Fatalf("uint8 configurator given %T %v", got, got)
+	}
+	checkValidateJson(ct, "sized5", `{ "small" : 256 }`, "ErrValueOutOfRange", c)
+	checkValidateJson(ct, "sized6", `{ "ratio" : 0.25 }`, "", c)
+	// values which float32 cannot represent exactly are rejected
+	checkValidateJson(ct, "sized6a", `{ "ratio" : 16777217 }`, "ErrBadValue", c)
+	checkValidateJson(ct, "sized6b", `{ "ratio" : 0.1 }`, "ErrBadValue", c)
+	if err := ct.Validate(map[string]interface{}{"ratio": int64(1<<24 + 1)}, nil); err == nil {
+		log.Fatalf("Validate of an inexact float32 succeeded")
+	}
+	checkValidateJson(ct, "sized7", `{ "count" : "42" }`, "ErrBadType", c)
+}
+
+func TestTransform(t *testing.T) {
+	lower := func(o interface{}) (interface{}, *cdl.CdlError) {
+		if s, ok := o.(string); ok {
+			return strings.ToLower(s), nil
+		}
+		return nil, cdl.NewError("ErrBadValue").SetSupplementary("is not a string")
+	}
+	ct, err := cdl.Compile(cdl.Template{
+		"/":    "{}name",
+		"name": lower,
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var name string
+	checkValidateJson(ct, "transform1", `{ "name" : "MiXeD" }`, "", cdl.Configurator{"name": &name})
+	if name != "mixed" {
+		log.Fatalf("Configurator given untransformed value '%s'", name)
+	}
+	checkValidateJson(ct, "transform2", `{ "name" : 7 }`, "ErrBadValue", nil)
+}
+
+func TestTypeValidator(t *testing.T) {
+	ct := checkCompile("example", "")
+	cdl.RegisterTypeValidator(reflect.TypeOf(""), func(o interface{}) *cdl.CdlError {
+		if o.(string) == "" {
+			return cdl.NewError("ErrEmptyValue")
+		}
+		return nil
+	})
+	defer cdl.RegisterTypeValidator(reflect.TypeOf(""), nil)
+	checkValidate(ct, "simple1", "", nil)
+	checkValidateJson(ct, "typevalidator1", `{ "apple" : 1, "plum" : [ 1 ], "raspberry" : [ "a" ], "strawberry" : "", "guava" : [ "c" ] }`, "ErrEmptyValue", nil)
+	checkValidateJson(ct, "typevalidator2", `{ "apple" : 1, "plum" : [ 1 ], "raspberry" : [ "a" ], "strawberry" : "x", "guava" : [ "" ] }`, "ErrEmptyValue", nil)
+	checkValidateJson(ct, "typevalidator3", `{ "apple" : 1, "plum" : [ 1 ], "raspberry" : [ "a" ], "strawberry" : "x", "guava" : [ "c" ], "mango" : [ { "earth" : "" }, { "earth" : 1 } ] }`, "ErrEmptyValue", nil)
+	// registration may race with validation
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			cdl.RegisterTypeValidator(reflect.TypeOf(true), func(o interface{}) *cdl.CdlError { return nil })
+			cdl.RegisterTypeValidator(reflect.TypeOf(true), nil)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		checkValidate(ct, "simple1", "", nil)
+	}
+	wg.Wait()
+
+	// structs may be leaves, but not when validated as maps
+	type point struct {
+		X int `json:"x"`
+	}
+	ct, err := cdl.Compile(cdl.Template{"/": "{}when? where?", "when": "timestamp", "where": "{}x", "x": "int"})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var checked []string
+	for _, typ := range []reflect.Type{reflect.TypeOf(time.Time{}), reflect.TypeOf(point{})} {
+		cdl.RegisterTypeValidator(typ, func(o interface{}) *cdl.CdlError {
+			checked = append(checked, fmt.Sprintf("%T", o))
+			if tm, ok := o.(time.Time); ok && tm.IsZero() {
+				return cdl.NewError("ErrEmptyValue")
+			}
+			return nil
+		})
+		defer cdl.RegisterTypeValidator(typ, nil)
+	}
+	if err := ct.Validate(map[string]interface{}{"when": time.Now(), "where": point{X: 1}}, nil); err != nil {
+		log.Fatalf("Validate failed: %v", err)
+	}
+	if !reflect.DeepEqual(checked, []string{"time.Time"}) {
+		log.Fatalf("Type validators called for %v", checked)
+	}
+	err = ct.Validate(map[string]interface{}{"when": time.Time{}}, nil)
+	if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrEmptyValue" {
+		log.Fatalf("Type validator for time.Time not called: %v", err)
+	}
+}
+
+func TestApproxEqual(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/": "{}ratio",
+		"ratio": cdl.ValidatorFunc(func(o interface{}) *cdl.CdlError {
+			return cdl.ApproxEqual(o, 1, 1e-6)
+		}),
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "approx1", `{ "ratio" : 1.0000001 }`, "", nil)
+	checkValidateJson(ct, "approx2", `{ "ratio" : 0.9999999 }`, "", nil)
+	checkValidateJson(ct, "approx3", `{ "ratio" : 1.001 }`, "ErrBadValue", nil)
+	checkValidateJson(ct, "approx4", `{ "ratio" : "1" }`, "ErrBadType", nil)
+	if err := cdl.ApproxEqual(int8(1), 1, 0); err != nil {
+		log.Fatalf("ApproxEqual of an exact integer failed: %v", err)
+	}
+}
+
+func TestValidatorTimeout(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/": "{}slow? fast? panicky?",
+		"slow": cdl.ValidatorFunc(func(o interface{}) *cdl.CdlError {
+			time.Sleep(200 * time.Millisecond)
+			return nil
+		}),
+		"panicky": cdl.ValidatorFunc(func(o interface{}) *cdl.CdlError {
+			panic("oops")
+		}),
+		"fast": cdl.ValidatorFunc(func(o interface{}) *cdl.CdlError {
+			if o == "bad" {
+				return cdl.NewError("ErrBadValue")
+			}
+			return nil
+		}),
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	opts := cdl.ValidateOptions{ValidatorTimeout: 10 * time.Millisecond}
+	start := time.Now()
+	_, err = ct.ValidateWithOptions(map[string]interface{}{"slow": 1}, nil, opts)
+	if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrValidatorTimeout" {
+		log.Fatalf("Slow validator returned unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		log.Fatalf("Validation with a timeout took %v", elapsed)
+	}
+	if _, err := ct.ValidateWithOptions(map[string]interface{}{"fast": "good"}, nil, opts); err != nil {
+		log.Fatalf("Fast validator failed: %v", err)
+	}
+	_, err = ct.ValidateWithOptions(map[string]interface{}{"fast": "bad"}, nil, opts)
+	if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrBadValue" {
+		log.Fatalf("Fast validator returned unexpected error %v", err)
+	}
+	_, err = ct.ValidateWithOptions(map[string]interface{}{"panicky": 1}, nil, opts)
+	if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrInternal" || !strings.Contains(me.Supplementary, "oops") {
+		log.Fatalf("Panicking validator returned unexpected error %v", err)
+	}
+}
+
+func TestOneOf(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}level mode?",
+		"level": func(o interface{}) *cdl.CdlError { return cdl.OneOf(o, 1, 2, 3) },
+		"mode":  func(o interface{}) *cdl.CdlError { return cdl.OneOf(o, "fast", "slow") },
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	checkValidateJson(ct, "oneof1", `{ "level" : 2, "mode" : "slow" }`, "", nil)
+	checkValidateJson(ct, "oneof2", `{ "level" : 4 }`, "ErrBadValue", nil)
+	e := checkValidateJson(ct, "oneof3", `{ "level" : 1, "mode" : "medium" }`, "ErrBadValue", nil)
+	if e.Supplementary != "got medium expected one of fast, slow" {
+		log.Fatalf("Unexpected supplementary '%s'", e.Supplementary)
+	}
+}
+
+func TestValidateCached(t *testing.T) {
+	ct := checkCompile("example", "")
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(checkJsons["simple1"]), &m); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := ct.ValidateCached(m); err != nil {
+			log.Fatalf("Cached validation failed: %v", err)
+		}
+	}
+	m["apple"] = "not a number"
+	for i := 0; i < 2; i++ {
+		err := ct.ValidateCached(m)
+		if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrBadType" {
+			log.Fatalf("Changed input did not invalidate the cache: %v", err)
+		}
+		me := err.(*cdl.CdlError)
+		if len(me.Context) != 1 {
+			log.Fatalf("Cached error has unexpected context %v", me.Context)
+		}
+		me.AddContext("caller")
+	}
+	m["apple"] = 3.0
+	if err := ct.ValidateCached(m); err != nil {
+		log.Fatalf("Cached validation failed: %v", err)
+	}
+
+	// documents differing only in the types or nesting of values are distinct
+	ct, err := cdl.Compile(cdl.Template{"/": "{}a b?", "a": "number", "b": "[]string"})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	for _, tc := range []struct {
+		o   interface{}
+		err bool
+	}{
+		{map[string]interface{}{"a": 1.0}, false},
+		{map[string]interface{}{"a": "1"}, true},
+		{map[string]interface{}{"a": 1.0, "b": []interface{}{"x"}}, false},
+		{map[string]interface{}{"a": 1.0, "b": []interface{}{[]interface{}{"x"}}}, true},
+		{map[string]interface{}{"a": 1.0, "b": "x"}, true},
+		{map[string]interface{}{"a": 1.0, "b": []string{"x"}}, false},
+		{map[string]interface{}{"a": int8(1)}, false},
+		{struct {
+			A float64 `json:"a"`
+		}{1}, false},
+		{struct {
+			A string `json:"a"`
+		}{"1"}, true},
+	} {
+		for i := 0; i < 2; i++ {
+			if err := ct.ValidateCached(tc.o); (err != nil) != tc.err {
+				log.Fatalf("Cached validation of %#v returned %v", tc.o, err)
+			}
+		}
+	}
+}
+
+func benchmarkDocument(b *testing.B) interface{} {
+	var m interface{}
+	if err := json.Unmarshal([]byte(checkJsons["jupiter"]), &m); err != nil {
+		b.Fatalf("JSON parse error: %v", err)
+	}
+	return m
+}
+
+func BenchmarkValidate(b *testing.B) {
+	ct := cdl.MustCompile(checkTemplates["example"])
+	m := benchmarkDocument(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ct.Validate(m, nil); err != nil {
+			b.Fatalf("Validation failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkValidateCached(b *testing.B) {
+	ct := cdl.MustCompile(checkTemplates["example"])
+	m := benchmarkDocument(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ct.ValidateCached(m); err != nil {
+			b.Fatalf("Validation failed: %v", err)
+		}
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	isSmall := func(o interface{}) *cdl.CdlError {
+		if v, ok := o.(float64); ok && v > 1000 {
+			return cdl.NewWarning("ErrBadValue").SetSupplementary("is unusually large")
+		}
+		return nil
+	}
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}sizes*",
+		"sizes": isSmall,
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var m interface{}
+	if err := json.Unmarshal([]byte(`{ "sizes" : [ 1, 20000, 3 ] }`), &m); err != nil {
+		log.Fatalf("JSON parse error: %v", err)
+	}
+	result, err := ct.ValidateWithWarnings(m, nil)
+	if err != nil {
+		log.Fatalf("Validation with a warning failed: %v", err)
+	}
+	if len(result.Warnings) != 1 {
+		log.Fatalf("Expected 1 warning, got %d", len(result.Warnings))
+	}
+	w := result.Warnings[0]
+	if w.Path.String() != "/sizes/1" || !w.Err.IsWarning() || w.Err.Supplementary != "is unusually large" {
+		log.Fatalf("Unexpected warning: %s", w.String())
+	}
+	if err := ct.Validate(m, nil); err != nil {
+		log.Fatalf("Validate failed on a warning: %v", err)
+	}
+}
+
+func Example_cdlCompile() {
+
+	// here's our template
+	template := cdl.Template{
+		"/":     "{}apple peach? pear* plum+ raspberry{1,3} strawberry! kiwi{1,4}? guava!{1,2} orange?{2,31}",
+		"apple": "float64",
+	}
+
+	if ct, err := cdl.Compile(template); err != nil {
+		log.Fatalf("Error on compile: %v", err)
+	} else {
+
+		// use ct here
+		_ = ct
+	}
+
+	fmt.Println("Success!")
+	// Output: Success!
+}
+
+func Example_cdlValidate() {
+
+	// here's our template
+	template := cdl.Template{
+		"/":     "{}apple peach? pear* plum+ raspberry{1,3} strawberry! kiwi{1,4}? guava!{1,2} orange?{2,31}",
+		"apple": "float64",
+		"peach": func(o interface{}) *cdl.CdlError {
+			if v, ok := o.(float64); !ok {
+				return cdl.NewError("ErrBadValue").SetSupplementary("is not a float64")
+			} else {
+				if v != 1 && v != 2 {
+					return cdl.NewError("ErrBadValue").SetSupplementary("is not 1 or 2")
+				}
+			}
+			return nil
+		},
+	}
+
+	if ct, err := cdl.Compile(template); err != nil {
+		log.Fatalf("Error on compile: %v", err)
+	} else {
+
+		var strawberry string
+
+		// here's our configurator
+		configurator := cdl.Configurator{
+
+			// First an easy example using a pointer
+			"strawberry": &strawberry,
+
+			// Now a more complex example using a string
+			"apple": func(o interface{}, p cdl.Path) *cdl.CdlError {
+				fmt.Printf("Apple is %1.0f - ", o.(float64))
+				return nil
+			},
+		}
+
+		// Unmarshal some JSON
+		var m interface{}
+
+		j := `
+		     {
+				"apple" : 3,
+				"pear" : [],
+				"peach" : 2,
+				"plum" : [ 1 ],
+				"raspberry" : [ "a", "b" ],
+				"strawberry" : "here",
+				"guava": [ "c", "d" ]
+		     }`
+
+		if err := json.Unmarshal([]byte(j), &m); err != nil {
+			log.Fatalf("Cannot unmarshal JSON: %v", err)
+		}
+
+		// Validate it
+		if err := ct.Validate(m, configurator); err != nil {
+			log.Fatalf("Validation error: %v", err)
+		}
+
+		if strawberry != "here" {
+			log.Fatal("Strawberry variable not set correctly")
+		}
+
+		fmt.Println("Success!")
+		// Output: Apple is 3 - Success!
+	}
+}
+
+// validateNoPanic validates an object against a compiled template, failing
+// if validation panics
+func validateNoPanic(ct *cdl.CompiledTemplate, name string, o interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Fatalf("Validation of %s panicked: %v", name, r)
+		}
+	}()
+	return ct.Validate(o, nil)
+}
+
+func TestMalformedInput(t *testing.T) {
+	ct := checkCompile("example", "")
+	deep := interface{}(1.0)
+	for i := 0; i < 10000; i++ {
+		deep = []interface{}{map[string]interface{}{"earth": deep}}
+	}
+	for name, o := range map[string]interface{}{
+		"nil":        nil,
+		"nilleaves":  map[string]interface{}{"apple": nil, "peach": nil, "pear": nil, "plum": nil, "cherry": nil, "tangerine": nil},
+		"nilmaps":    map[string]interface{}{"apple": 1.0, "mango": []interface{}{nil, nil}, "blueberry": nil},
+		"nilarray":   map[string]interface{}{"mango": []interface{}(nil), "raspberry": map[string]interface{}(nil)},
+		"mixed":      map[string]interface{}{"apple": "1", "peach": []interface{}{1.0}, "pear": map[string]interface{}{}, "plum": true},
+		"deep":       map[string]interface{}{"apple": 1.0, "mango": deep},
+		"deepnil":    map[string]interface{}{"mango": []interface{}{map[string]interface{}{"jupiter": []interface{}{nil, map[string]interface{}{"thor": nil}}}}},
+		"gotypes":    map[string]interface{}{"apple": 1, "peach": uint8(3), "pear": []byte("x"), "mango": []string{"a"}},
+		"nonstrkeys": map[interface{}]interface{}{1: 2, nil: nil},
+		"scalar":     "apple",
+	} {
+		if err := validateNoPanic(ct, name, o); err == nil {
+			log.Fatalf("Validation of %s did not fail", name)
+		}
+	}
+}
+
+func FuzzValidate(f *testing.F) {
+	for _, j := range checkJsons {
+		f.Add(j)
+	}
+	f.Add(`{ "apple" : null, "mango" : [ null, { "jupiter" : [ null ] } ] }`)
+	f.Add(`[ [ [ [ [ [ [ [ [ [ null ] ] ] ] ] ] ] ] ] ]`)
+	ct := checkCompile("example", "")
+	f.Fuzz(func(t *testing.T, s string) {
+		var o interface{}
+		if err := json.Unmarshal([]byte(s), &o); err != nil {
+			return
+		}
+		validateNoPanic(ct, s, o)
+	})
+}
+
+func TestNullValue(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":      "{}apple? peach? cherry?",
+		"apple":  "float64",
+		"peach":  "number",
+		"cherry": "ipport",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	for _, j := range []string{
+		`{ "apple" : null }`,
+		`{ "apple" : 1.5, "peach" : null }`,
+		`{ "cherry" : null }`,
+	} {
+		var o interface{}
+		if err := json.Unmarshal([]byte(j), &o); err != nil {
+			log.Fatalf("Cannot unmarshal JSON: %v", err)
+		}
+		err := validateNoPanic(ct, j, o)
+		if err == nil {
+			log.Fatalf("Validation of null did not fail: %s", j)
+		}
+		if me := err.(*cdl.CdlError); me.Type.String() != "ErrBadType" || !strings.HasPrefix(me.Supplementary, "got null") || me.Details["got"] != "null" {
+			log.Fatalf("Unexpected error for null: %v", err)
+		}
+	}
+}
+
+func TestOrderedMap(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":      "{}name version? (tag|label) deps? ...",
+		"name":   "string",
+		"deps":   "{}first second?",
+		"first":  "string",
+		"second": "string",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	for _, c := range []struct {
+		json string
+		err  string
+	}{
+		{`{ "name" : "a", "version" : 1, "tag" : "x", "deps" : { "first" : "b", "second" : "c" } }`, ""},
+		{`{ "name" : "a", "label" : "x" }`, ""},
+		{`{ "name" : "a", "extra" : 1, "tag" : "x", "other" : 2 }`, ""},
+		{`{ "version" : 1, "name" : "a", "tag" : "x" }`, "ErrBadOrder"},
+		{`{ "name" : "a", "tag" : "x", "version" : 1 }`, "ErrBadOrder"},
+		{`{ "name" : "a", "tag" : "x", "deps" : { "second" : "c", "first" : "b" } }`, "ErrBadOrder"},
+		{`{ "name" : 1, "version" : 1 }`, "ErrBadType"},
+	} {
+		m := cdl.NewOrderedMap()
+		if err := json.Unmarshal([]byte(c.json), m); err != nil {
+			log.Fatalf("Cannot unmarshal JSON: %v", err)
+		}
+		if err := ct.Validate(m, nil); (err == nil) != (c.err == "" || c.err == "ErrBadOrder") {
+			log.Fatalf("Unexpected result validating %s without EnforceOrder: %v", c.json, err)
+		}
+		_, err := ct.ValidateWithOptions(m, nil, cdl.ValidateOptions{EnforceOrder: true})
+		if c.err == "" {
+			if err != nil {
+				log.Fatalf("Validation of %s failed: %v", c.json, err)
+			}
+			b, merr := json.Marshal(m)
+			if merr != nil || !reflect.DeepEqual(strings.Fields(string(b)), strings.Fields(strings.NewReplacer(" ", "").Replace(c.json))) {
+				log.Fatalf("Ordered map %s did not round trip: %s %v", c.json, b, merr)
+			}
+			continue
+		}
+		if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != c.err {
+			log.Fatalf("Validation of %s returned unexpected error - expecting %s got %v", c.json, c.err, err)
+		}
+	}
+	// a plain map is not checked for order
+	checkValidateJson(ct, "ordered1", `{ "version" : 1, "name" : "a", "tag" : "x" }`, "", nil)
+
+	m := cdl.NewOrderedMap()
+	m.Set("tag", "x")
+	m.Set("name", "a")
+	_, err = ct.ValidateWithOptions(m, nil, cdl.ValidateOptions{EnforceOrder: true})
+	if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != "ErrBadOrder" || !strings.Contains(me.Supplementary, "'name' must precede 'tag'") {
+		log.Fatalf("Unexpected error for out of order keys: %v", err)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}size? small? any? sizes?",
+		"size":  "bytesize",
+		"small": "bytesize",
+		"any":   "bytesize",
+		"sizes": "[]bytesize sorted",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	var size int64
+	var small uint16
+	var anySize interface{}
+	c := cdl.Configurator{"size": &size, "small": &small, "any": &anySize}
+	for _, tc := range []struct {
+		json string
+		want int64
+	}{
+		{`"10MB"`, 10000000},
+		{`1048576`, 1048576},
+		{`"1GiB"`, 1 << 30},
+		{`"1.5kib"`, 1536},
+		{`" 512 B "`, 512},
+		{`"42"`, 42},
+	} {
+		checkValidateJson(ct, "bytesize "+tc.json, fmt.Sprintf(`{ "size" : %s, "any" : %s }`, tc.json, tc.json), "", c)
+		if size != tc.want || anySize != tc.want {
+			log.Fatalf("Configurator set size %d and %v for %s, expected %d", size, anySize, tc.json, tc.want)
+		}
+	}
+	checkValidateJson(ct, "bytesize1", `{ "small" : "2KiB" }`, "", c)
+	if small != 2048 {
+		log.Fatalf("Configurator set small %d", small)
+	}
+	checkValidateJson(ct, "bytesize2", `{ "small" : "1MiB" }`, "ErrValueOutOfRange", c)
+	if me := checkValidateJson(ct, "bytesize3", `{ "size" : "10XB" }`, "ErrBadType", c); !strings.Contains(me.Supplementary, "unknown size suffix 'XB'") {
+		log.Fatalf("Unexpected error for unknown suffix: %v", me)
+	}
+	checkValidateJson(ct, "bytesize4", `{ "size" : "ten" }`, "ErrBadType", c)
+	checkValidateJson(ct, "bytesize5", `{ "size" : true }`, "ErrBadType", c)
+	checkValidateJson(ct, "bytesize6", `{ "size" : -1 }`, "ErrBadValue", c)
+	checkValidateJson(ct, "bytesize7", `{ "size" : "0.5B" }`, "ErrBadValue", c)
+	checkValidateJson(ct, "bytesize8", `{ "size" : "100EiB" }`, "ErrValueOutOfRange", c)
+	checkValidateJson(ct, "bytesize8a", `{ "size" : 9223372036854775808 }`, "ErrValueOutOfRange", c)
+	checkValidateJson(ct, "bytesize8b", `{ "size" : "9223372036854775808" }`, "ErrValueOutOfRange", c)
+	checkValidateJson(ct, "bytesize8c", `{ "size" : 9223372036854774784 }`, "", c)
+	if size != 9223372036854774784 {
+		log.Fatalf("Configurator set size %d", size)
+	}
+	checkValidateJson(ct, "bytesize9", `{ "sizes" : [ 1000, "1kB", "1KiB", "1MB" ] }`, "", nil)
+	checkValidateJson(ct, "bytesize10", `{ "sizes" : [ "1KiB", 1000 ] }`, "ErrNotSorted", nil)
+}
+
+func TestReplacingConfigurator(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":       "{}servers? name? pair?",
+		"servers": "[]server{1,}",
+		"server":  "{}host port",
+		"host":    "string",
+		"port":    "integer",
+		"name":    "string",
+		"pair":    "(host,port)",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	type server struct {
+		addr string
+	}
+	var servers []server
+	var root map[string]interface{}
+	var pair []interface{}
+	c := cdl.Configurator{
+		"host": cdl.ReplacingConfiguratorFunc(func(o interface{}, p cdl.Path) (interface{}, *cdl.CdlError) {
+			return strings.ToUpper(o.(string)), nil
+		}),
+		"server": func(o interface{}, p cdl.Path) (interface{}, *cdl.CdlError) {
+			m := o.(map[string]interface{})
+			return server{addr: fmt.Sprintf("%s:%v", m["host"], m["port"])}, nil
+		},
+		"servers": func(o interface{}, p cdl.Path) *cdl.CdlError {
+			servers = nil
+			for _, s := range o.([]interface{}) {
+				servers = append(servers, s.(server))
+			}
+			return nil
+		},
+		"pair": &pair,
+		"/":    &root,
+	}
+	var o interface{}
+	if err := json.Unmarshal([]byte(`{ "servers" : [ { "host" : "a", "port" : 80 }, { "host" : "b", "port" : 443 } ], "name" : "x", "pair" : [ "c", 1 ] }`), &o); err != nil {
+		log.Fatalf("Cannot unmarshal JSON: %v", err)
+	}
+	if err := ct.Validate(o, c); err != nil {
+		log.Fatalf("Validation failed: %v", err)
+	}
+	if !reflect.DeepEqual(servers, []server{{"A:80"}, {"B:443"}}) {
+		log.Fatalf("Parent configurator observed %v", servers)
+	}
+	if !reflect.DeepEqual(pair, []interface{}{"C", float64(1)}) {
+		log.Fatalf("Tuple configurator observed %v", pair)
+	}
+	if root["name"] != "x" || !reflect.DeepEqual(root["servers"], []interface{}{server{"A:80"}, server{"B:443"}}) {
+		log.Fatalf("Root configurator observed %v", root)
+	}
+	// the object validated is not modified
+	if s := o.(map[string]interface{})["servers"].([]interface{})[0].(map[string]interface{}); s["host"] != "a" {
+		log.Fatalf("Replacing configurator modified object: %v", s)
+	}
+
+	c["host"] = cdl.ReplacingConfiguratorFunc(func(o interface{}, p cdl.Path) (interface{}, *cdl.CdlError) {
+		return nil, cdl.NewError("ErrBadValue")
+	})
+	checkValidateJson(ct, "replacing1", `{ "servers" : [ { "host" : "a", "port" : 80 } ] }`, "ErrBadValue", c)
+
+	// a value returned with a warning still replaces the value configured
+	c["host"] = cdl.ReplacingConfiguratorFunc(func(o interface{}, p cdl.Path) (interface{}, *cdl.CdlError) {
+		return strings.ToUpper(o.(string)), cdl.NewWarning("ErrBadValue")
+	})
+	r, err := ct.ValidateWithWarnings(o, c)
+	if err != nil || len(r.Warnings) != 3 {
+		log.Fatalf("Validation with warnings gave %v: %v", r, err)
+	}
+	if !reflect.DeepEqual(servers, []server{{"A:80"}, {"B:443"}}) || !reflect.DeepEqual(pair, []interface{}{"C", float64(1)}) {
+		log.Fatalf("Parent configurators observed %v and %v after warnings", servers, pair)
+	}
+}
+
+func TestEnumValues(t *testing.T) {
+	if v := fruitPart.Values(); !reflect.DeepEqual(v, []string{"flesh", "pips", "rind"}) {
+		log.Fatalf("Values returned %v", v)
+	}
+	ct := checkCompile("example", "")
+	me := checkValidateJson(ct, "badtangerine1", checkJsons["badtangerine1"], "ErrBadEnumValue", nil)
+	if !strings.Contains(me.Supplementary, "expected one of flesh, pips, rind") {
+		log.Fatalf("Error does not list allowed values: %v", me)
+	}
+	if allowed, ok := me.Details["allowed"].([]string); !ok || len(allowed) != 3 {
+		log.Fatalf("Error does not give allowed values: %v", me.Details)
+	}
+	e := fruitPart.New("flesh")
+	if err := e.UnmarshalText([]byte("stone")); err == nil || !strings.Contains(err.Error(), "expected one of flesh, pips, rind") {
+		log.Fatalf("UnmarshalText error does not list allowed values: %v", err)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	if cdl.Version == "" {
+		log.Fatalf("Version is empty")
+	}
+	features := cdl.Features()
+	if !sort.StringsAreSorted(features) {
+		log.Fatalf("Features are not sorted: %v", features)
+	}
+	for _, f := range []string{
+		"pseudotype:email",
+		"pseudotype:duration",
+		"pseudotype:bytesize",
+		"modifier:?",
+		"modifier:unique",
+		"option:EnforceOrder",
+		"option:MutateInPlace",
+		"compileoption:Sets",
+	} {
+		if i := sort.SearchStrings(features, f); i == len(features) || features[i] != f {
+			log.Fatalf("Features does not include %s: %v", f, features)
+		}
+	}
+}
+
+type hybridServer struct {
+	Host string   `json:"host"`
+	Port int      `json:"port"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+type hybridCluster struct {
+	Name    string         `json:"name"`
+	Servers []hybridServer `json:"servers"`
+}
+
+func TestHybridDecode(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":       "{}primary? cluster? servers? tags?",
+		"primary": "{}host port tags?",
+		"cluster": "{}name servers",
+		"name":    "string",
+		"servers": "[]server{1,}",
+		"server":  "{}host port tags?",
+		"host":    "string",
+		"port":    "integer",
+		"tags":    "[]string",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	// part of the document is decoded into typed values
+	var doc struct {
+		Primary hybridServer   `json:"primary"`
+		Cluster *hybridCluster `json:"cluster"`
+	}
+	j := `{ "primary" : { "host" : "a", "port" : 80, "tags" : [ "x" ] }, "cluster" : { "name" : "c", "servers" : [ { "host" : "b", "port" : 443 } ] } }`
+	if err := json.Unmarshal([]byte(j), &doc); err != nil {
+		log.Fatalf("Cannot unmarshal JSON: %v", err)
+	}
+	var hosts []string
+	c := cdl.Configurator{"host": func(o interface{}, p cdl.Path) *cdl.CdlError {
+		hosts = append(hosts, o.(string))
+		return nil
+	}}
+	for _, tc := range []struct {
+		name string
+		o    map[string]interface{}
+		err  string
+	}{
+		{"struct", map[string]interface{}{"primary": doc.Primary}, ""},
+		{"pointer", map[string]interface{}{"primary": &doc.Primary, "cluster": doc.Cluster}, ""},
+		{"slice", map[string]interface{}{"servers": doc.Cluster.Servers, "tags": []string{"y"}}, ""},
+		{"mixed", map[string]interface{}{"servers": []interface{}{doc.Primary, map[string]interface{}{"host": "d", "port": 1.0}}}, ""},
+		{"badtype", map[string]interface{}{"servers": []hybridServer{{Host: "", Port: 1}, {Host: "e", Port: 0, Tags: []string{}}}, "tags": []int{1}}, "ErrBadType"},
+		{"badrange", map[string]interface{}{"servers": []hybridServer{}}, "ErrOutOfRange"},
+		{"badmap", map[string]interface{}{"primary": []hybridServer{doc.Primary}}, "ErrExpectedMap"},
+		{"badarray", map[string]interface{}{"servers": doc.Primary}, "ErrExpectedArray"},
+		{"bytes", map[string]interface{}{"tags": []byte("x")}, "ErrExpectedArray"},
+	} {
+		hosts = nil
+		err := ct.Validate(tc.o, c)
+		if tc.err == "" {
+			if err != nil {
+				log.Fatalf("Validation of %s failed: %v", tc.name, err)
+			}
+			if len(hosts) == 0 {
+				log.Fatalf("Configurator not called for %s", tc.name)
+			}
+			continue
+		}
+		if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != tc.err {
+			log.Fatalf("Validation of %s returned unexpected error - expecting %s got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestAssert(t *testing.T) {
+	ct := checkCompile("example", "")
+	if err := ct.Assert([]byte(checkJsons["simple1"]), ""); err != nil {
+		log.Fatalf("Assert of valid example failed: %v", err)
+	}
+	if err := ct.Assert([]byte(checkJsons["badtangerine1"]), "ErrBadEnumValue"); err != nil {
+		log.Fatalf("Assert of invalid example failed: %v", err)
+	}
+	for _, tc := range []struct {
+		example string
+		wantErr string
+		err     string
+	}{
+		{checkJsons["simple1"], "ErrBadType", "ErrUnexpectedResult"},
+		{checkJsons["badtangerine1"], "", "ErrUnexpectedResult"},
+		{checkJsons["badtangerine1"], "ErrBadType", "ErrUnexpectedResult"},
+		{checkJsons["simple1"], "ErrNoSuchError", "ErrBadValue"},
+		{`{ "apple" : `, "", "ErrBadFile"},
+	} {
+		err := ct.Assert([]byte(tc.example), tc.wantErr)
+		if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != tc.err {
+			log.Fatalf("Assert expecting '%s' returned unexpected error - expecting %s got %v", tc.wantErr, tc.err, err)
+		}
+	}
+	err := ct.Assert([]byte(checkJsons["badtangerine1"]), "ErrBadType")
+	if me := err.(*cdl.CdlError); me.Details["got"] != "ErrBadEnumValue" || me.Details["expected"] != "ErrBadType" {
+		log.Fatalf("Assert error does not give outcome: %v", me.Details)
+	}
+}
+
+func TestDeepUnion(t *testing.T) {
+	calls := 0
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}tree",
+		"tree":  "oneof(leaf|pair)",
+		"leaf":  "{}value label?",
+		"pair":  "(tree,tree)",
+		"label": "string",
+		"value": cdl.ValidatorFunc(func(o interface{}) *cdl.CdlError {
+			calls++
+			return nil
+		}),
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	// a chain of pairs, each holding a leaf and a deeper tree
+	const depth = 40
+	var tree interface{} = map[string]interface{}{"value": 0.0, "label": "bottom"}
+	for i := 1; i <= depth; i++ {
+		tree = []interface{}{map[string]interface{}{"value": float64(i)}, tree}
+	}
+	o := map[string]interface{}{"tree": tree}
+
+	start := time.Now()
+	result, err := ct.ValidateWithOptions(o, nil, cdl.ValidateOptions{PresentOptional: true})
+	if err != nil {
+		log.Fatalf("Validation failed: %v", err)
+	}
+	if calls != depth+1 {
+		log.Fatalf("Validator called %d times for %d leaves", calls, depth+1)
+	}
+	if len(result.PresentOptional) != depth+2 {
+		log.Fatalf("PresentOptional has %d maps, expected %d: %v", len(result.PresentOptional), depth+2, result.PresentOptional)
+	}
+	labelled := 0
+	for _, present := range result.PresentOptional {
+		if reflect.DeepEqual(present, []string{"label"}) {
+			labelled++
+		}
+	}
+	if labelled != 1 {
+		log.Fatalf("PresentOptional has %d labelled leaves: %v", labelled, result.PresentOptional)
+	}
+
+	// with a configurator below the union, each alternative chosen is validated twice at most
+	calls = 0
+	var values []interface{}
+	c := cdl.Configurator{"value": func(o interface{}, p cdl.Path) *cdl.CdlError {
+		values = append(values, o)
+		return nil
+	}}
+	if err := ct.Validate(o, c); err != nil {
+		log.Fatalf("Validation with configurator failed: %v", err)
+	}
+	if calls > 2*(depth+1) || len(values) != depth+1 {
+		log.Fatalf("Validator called %d times and configurator %d times for %d leaves", calls, len(values), depth+1)
+	}
+	if time.Since(start) > 5*time.Second {
+		log.Fatalf("Validation of a deep union took %v", time.Since(start))
+	}
+
+	// a failed alternative leaves nothing in the result
+	ct, err = cdl.Compile(cdl.Template{
+		"/":       "{}item",
+		"item":    "oneof(a|b)",
+		"a":       "{}inner tag",
+		"a.inner": "{}label?",
+		"b":       "{}inner other",
+		"b.inner": cdl.ValidatorFunc(func(o interface{}) *cdl.CdlError { return nil }),
+		"tag":     "string",
+		"other":   "number",
+		"label":   "string",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	result, err = ct.ValidateWithOptions(map[string]interface{}{
+		"item": map[string]interface{}{"inner": map[string]interface{}{"label": "x"}, "other": 1.0},
+	}, nil, cdl.ValidateOptions{PresentOptional: true})
+	if err != nil {
+		log.Fatalf("Validation failed: %v", err)
+	}
+	for k := range result.PresentOptional {
+		if strings.Contains(k, "inner") {
+			log.Fatalf("PresentOptional includes a map from a failed alternative: %v", result.PresentOptional)
+		}
 	}
 }
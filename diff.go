@@ -0,0 +1,204 @@
+package cdl
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// type TemplateChange describes a difference between two compiled templates.
+//
+// Old and New are textual descriptions of the specification of the key
+// in each template; Old is empty if the key was added and New is empty
+// if the key was removed.
+type TemplateChange struct {
+	Key    string
+	Change Enum
+	Old    string
+	New    string
+}
+
+// var ChangeEnum is the Enum containing the kinds of template change.
+var (
+	ChangeEnum = NewEnumTypeWithText(map[string]string{
+		"KeyAdded":   "Key added",
+		"KeyRemoved": "Key removed",
+		"KeyChanged": "Key changed",
+	})
+)
+
+// func String produces a string representation of a template change
+func (tc TemplateChange) String() string {
+	switch tc.Change.String() {
+	case "KeyAdded":
+		return fmt.Sprintf("%s '%s': %s", tc.Change.Text(), tc.Key, tc.New)
+	case "KeyRemoved":
+		return fmt.Sprintf("%s '%s': %s", tc.Change.Text(), tc.Key, tc.Old)
+	default:
+		return fmt.Sprintf("%s '%s': %s -> %s", tc.Change.Text(), tc.Key, tc.Old, tc.New)
+	}
+}
+
+func (req requirement) String() string {
+	s := ""
+	if req.forbidden {
+		s += "-"
+	} else if !req.mandatory {
+		s += "?"
+	}
+	if req.nonzero {
+		s += "="
+	}
+	if req.array {
+		s += req.r.spec()
+	}
+	return s
+}
+
+func specString(v interface{}) string {
+	switch t := v.(type) {
+	case *options:
+		if t.shared {
+			return "{}:" + strings.TrimPrefix(t.extra.name, ":")
+		}
+		grouped := make(map[string]bool)
+		var groups []string
+		for _, g := range t.groups {
+			members := make([]string, len(g.keys))
+			for i, k := range g.keys {
+				grouped[k] = true
+				members[i] = k + strings.TrimPrefix(t.keys[k].String(), "?")
+			}
+			s := "(" + strings.Join(members, "|") + ")"
+			if g.optional {
+				s += "?"
+			}
+			groups = append(groups, s)
+		}
+		elements := make([]string, 0, len(t.keys))
+		for k, req := range t.keys {
+			if !grouped[k] {
+				elements = append(elements, k+req.String())
+			}
+		}
+		sort.Strings(elements)
+		elements = append(elements, groups...)
+		// patterns are matched in order, so are not sorted
+		for _, p := range t.patterns {
+			elements = append(elements, "/"+p.re.String()+"/"+p.name+p.req.String())
+		}
+		if t.ignore {
+			elements = append(elements, "...")
+		}
+		if t.extra != nil {
+			if t.extraType != "" {
+				elements = append(elements, "..."+t.extra.name+":"+t.extraType)
+			} else {
+				elements = append(elements, "..."+t.extra.name)
+			}
+		}
+		present := ""
+		if t.present.Min >= 0 || t.present.Max >= 0 {
+			present = "[" + strings.Trim(t.present.spec(), "{}") + "]"
+		}
+		return "{}" + present + strings.Join(elements, " ")
+	case *stringSpec:
+		return t.String()
+	case *literal:
+		if t.negate {
+			return "!=" + t.value
+		}
+		return "=" + t.value
+	case *stringSet:
+		return "#" + t.name
+	case *union:
+		names := make([]string, len(t.names))
+		for i, name := range t.names {
+			names[i] = strings.TrimPrefix(name, ":")
+		}
+		return "oneof(" + strings.Join(names, "|") + ")"
+	case *tuple:
+		names := make([]string, len(t.names))
+		for i, name := range t.names {
+			names[i] = strings.TrimPrefix(name, ":")
+		}
+		return "(" + strings.Join(names, ",") + ")"
+	case *array:
+		s := "[]" + strings.TrimPrefix(t.name, ":")
+		if t.r.Min >= 0 || t.r.Max >= 0 {
+			s += t.r.spec()
+		}
+		switch t.order {
+		case 1:
+			s += " sorted"
+		case -1:
+			s += " sorted-"
+		}
+		if t.unique {
+			s += " unique"
+		}
+		return s
+	case string:
+		return t
+	case EnumType:
+		return "enum(" + strings.Join(t.toString, "|") + ")"
+	case ValidatorFunc:
+		return fmt.Sprintf("validator(%#x)", reflect.ValueOf(t).Pointer())
+	case TransformFunc:
+		return fmt.Sprintf("transform(%#x)", reflect.ValueOf(t).Pointer())
+	case int:
+		return "autodiscovered"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// func Diff compares two compiled templates.
+//
+// A TemplateChange is returned for each key which has been added, removed or
+// changed in the other template relative to this one, in key order. Validator
+// functions compare equal only if they are the same function.
+func (ct *CompiledTemplate) Diff(other *CompiledTemplate) []TemplateChange {
+	keys := make(map[string]bool)
+	// keys starting ':' hold inline types, which are compared where they are used
+	for k := range ct.s {
+		if !strings.HasPrefix(k, ":") {
+			keys[k] = true
+		}
+	}
+	for k := range other.s {
+		if !strings.HasPrefix(k, ":") {
+			keys[k] = true
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	changes := []TemplateChange{}
+	for _, k := range sorted {
+		was, inOld := ct.s[k]
+		now, inNew := other.s[k]
+		switch {
+		case !inOld:
+			changes = append(changes, TemplateChange{Key: k, Change: ChangeEnum.New("KeyAdded"), New: specString(now)})
+		case !inNew:
+			changes = append(changes, TemplateChange{Key: k, Change: ChangeEnum.New("KeyRemoved"), Old: specString(was)})
+		default:
+			if o, n := specString(was), specString(now); o != n {
+				changes = append(changes, TemplateChange{Key: k, Change: ChangeEnum.New("KeyChanged"), Old: o, New: n})
+			}
+		}
+	}
+	return changes
+}
+
+// func Equal determines whether two compiled templates are equivalent
+//
+// returns true if Diff would return no changes, else false
+func (ct *CompiledTemplate) Equal(other *CompiledTemplate) bool {
+	return len(ct.Diff(other)) == 0
+}
@@ -25,6 +25,40 @@
 // If the validation fails, you will get an `error` return with a context
 // that will allow a user to discover the error in his file.
 //
+// Alternatively, a file may be read, decoded and validated using
+//     err := ct.ValidateFile("config.json", nil)
+//
+// The format is chosen by the file's extension. JSON (`.json`) is supported by
+// default. YAML (`.yaml`, `.yml`) and TOML (`.toml`) are supported by importing
+// a subpackage, which keeps cdl itself free of dependencies:
+//     import _ "github.com/abligh/cdl/yaml"
+//     import _ "github.com/abligh/cdl/toml"
+// Other formats may be added with `cdl.RegisterDecoder`, e.g.
+// `cdl.RegisterDecoder(".hcl", hclDecode)`.
+//
+// For golden tests of a template, an example JSON document may be checked to
+// be valid, or to fail with a particular error code, using
+//     err := ct.Assert(example, "")                // example must be valid
+//     err = ct.Assert(counterExample, "ErrBadType") // counterExample must fail with ErrBadType
+// which returns an `ErrUnexpectedResult` error if the outcome differs.
+//
+// A template itself may be kept in a `.cdl` file of lines of the form
+// `key = spec` (blank lines and lines starting with `#` being ignored, and a
+// `#` starting a later word of a spec beginning a comment), and read with
+//     template, err := cdl.ParseFile("config.cdl")
+// before being compiled as usual. Validator functions cannot be given in such
+// a file.
+//
+// Wherever a map is expected, a Go struct (or pointer to a struct) may be
+// validated instead. Its exported fields are treated as the keys of the map,
+// named by their `cdl` tag, or failing that their `json` tag, or failing that
+// the field name. This allows a configuration already unmarshalled into a
+// struct to be validated. Similarly, wherever an array is expected, any Go
+// slice or array (such as a `[]string`, or a slice of structs) may be
+// validated, save for a `[]byte`. Typed values may appear anywhere within a
+// tree of `map[string]interface{}` and `[]interface{}`, so a document partly
+// unmarshalled into typed fields may be validated as a whole.
+//
 // So what was that `nil` parameter to `cdt.Validate` about? cdl also
 // permits you to pass a configurator in, so that you can store the values
 // retrieved in appropriate places.
@@ -91,7 +125,9 @@
 // Template syntax in detail
 //
 // 1. Each key must either be `/` (for the root key) or consist of word characters
-// (i.e. matching `\w+` in regexp terms)
+// (i.e. matching `\w+` in regexp terms). A key may also be qualified by the key of
+// a map containing it, e.g. `planet.name`, in which case it takes precedence over
+// the unqualified key (`name`) for data within that map only.
 //
 // 2. Each key must have a value, which may be either:
 //   * A validator function;
@@ -106,8 +142,55 @@
 //     it's a `string`)
 //   * A pseudotype (e.g. `number`, `integer`) - see below
 //   * An array specifier, having a form beginning `[]`
+//   * A tuple specifier, having a form beginning `(`
+//   * A union, having the form `oneof(a|b|...)`, in which case the data must
+//     validate against at least one of the keys (or type names, pseudotypes or
+//     named enums) listed, e.g. `oneof(square|points)`. These are tried in turn;
+//     configurators are called only for the first that validates. If none does,
+//     the error found deepest within the data is returned. A union may not be
+//     one of its own alternatives (directly or through another union), though
+//     it may contain itself within a map, array or tuple
+//   * A bounded string, having the form `string` followed by one or more bounds
+//     such as `>=2021-01-01` or `<10` (using `>=`, `<=`, `>` or `<`). The data
+//     must be a string lying within the bounds, compared lexicographically even
+//     if the bound is a number (so `string>=2021` accepts `2021-06-30` but not
+//     `10000`)
+//   * A string with a length, having the form `string` followed by a range
+//     specifier such as `{1,32}`, in which case the data must be a string whose
+//     length in runes lies within the range, or, if the range is written
+//     `{b:1,32}`, whose length in bytes does. Bounds may follow, e.g.
+//     `string{2,}>=a`
+//   * A named enum, having the form `@name`, in which case the data will be
+//     validated against the `EnumType` registered as `name` in the `Enums` field
+//     of `CompileOptions`
+//   * A named set, having the form `#name`, in which case the data must be a
+//     string within the list of strings registered as `name` in the `Sets`
+//     field of `CompileOptions` (e.g. `#countries`). A value outside the set
+//     produces `ErrBadEnumValue`. Like a named enum, a named set may be given
+//     inline, e.g. `[]#countries`, `{}:#countries` or `oneof(#countries|integer)`.
+//     The validator function `InSet` performs the same check
+//   * A literal, having the form `=value`, in which case the data must equal
+//     `value` (e.g. `=circle` for a string, or `=2` for a number). A numeric
+//     literal matches only numbers, `true` and `false` only booleans, and
+//     anything else only strings; a value in double quotes (e.g. `="2"`) is a
+//     string
+//   * A negated literal, having the form `!=value`, in which case the data must
+//     not equal `value` (e.g. `!=admin`)
 //   * A map specifier, having a form beginning `{}`
 //
+// The sized numeric types (`int8`, `int16`, `int32`, `int64`, `uint8`, `uint16`,
+// `uint32`, `uint64` and `float32`) also accept any numerical value that can be
+// represented exactly in that type (e.g. a `float64` of `42` from `json/encoding`
+// for an `int32`, but not `0.1` for a `float32`), which is converted to that type
+// for the configurator.
+//
+// A type name which is not a pseudotype is matched literally against the Go type
+// of the data, so a misspelt pseudotype never matches. If the `Strict` field of
+// `CompileOptions` is set, `CompileWithOptions` instead rejects unknown type names
+// with an `ErrUnknownType` error, suggesting the nearest known name. A type name
+// may also be an alias resolved to a Go type by the `TypeResolver` field of
+// `CompileOptions`, e.g. `mytime` for `time.Time`.
+//
 // 5. Each pseudotype may be either
 //   * The word `number` which indicates any numerical type (not `bool`)
 //   * The word `integer` which indicates any numerical type where the value is an
@@ -115,32 +198,118 @@
 //     `float64`)
 //   * The word `ipport` for an IP port pair which is successfully decoded by
 //     `net.SplitHostPort`
+//   * The word `ipport_numeric`, which is like `ipport` save that the port must
+//     be a number between 1 and 65535
+//   * The word `ipport_host`, which is like `ipport` save that the host must
+//     not be empty
+//   * The word `ipport_host_numeric`, which combines both of the above
+//   * The word `ip` for an IPv4 or IPv6 address which is successfully decoded
+//     by `net.ParseIP`, which is delivered to the configurator as a `net.IP`
+//   * The word `url` for an absolute URL (having a scheme and a host) which is
+//     successfully decoded by `url.Parse`
+//   * The word `email` for a bare email address (such as `user@example.com`)
+//     which is successfully decoded by `mail.ParseAddress`
+//   * The word `duration` for a `time.Duration`, or a string which is successfully
+//     decoded by `time.ParseDuration`
+//   * The word `timestamp` for a `time.Time`, or an RFC 3339 timestamp as a string
+//   * The word `bytesize` for a number of bytes, given either as a non-negative
+//     whole number or as a string such as `"10MB"` or `"1GiB"` with an SI (`kB`,
+//     `MB`, `GB`, `TB`, `PB`, `EB`) or IEC (`KiB`, `MiB`, `GiB`, `TiB`, `PiB`,
+//     `EiB`) suffix. Suffixes are not case sensitive; an unknown suffix produces
+//     `ErrBadType`
+//   * The word `raw` for a `json.RawMessage`, or a `[]byte` containing a valid
+//     JSON object or array, which is not decoded (useful for deferring the
+//     parsing of an opaque section of a document)
+//   * The word `bytes` for a `[]byte` (as may be produced by decoders of binary
+//     formats); note `[]byte` would instead be an array specifier
 //
 // 6. An array specifier has the form `[]key` optionally followed by a range specifier
 //   * The key (`key` above) consists of word characters.
 //   * The key need not be specified within the template (if it isn't, no validation
 //     will be done on it).
+//   * If the key is a type name or pseudotype, e.g. `[]string` or `[]integer{1,3}`,
+//     each element is validated against that type. Similarly, if the key is a
+//     named enum, e.g. `[]@palette`, each element is validated against that enum.
+//   * The specifier may end with ` sorted` (or ` sorted-`), e.g.
+//     `[]number{1,} sorted`, in which case the elements must be in ascending (or
+//     descending) order, else an `ErrNotSorted` error is returned giving the
+//     index of the first element out of order. The elements must be of a type
+//     which can be ordered (a number, string, `duration`, `timestamp` or
+//     `bytesize`).
+//   * The specifier may also end with ` unique`, e.g. `[]@palette unique` or
+//     `[]number sorted unique`, in which case no element may be repeated (numbers
+//     being compared by value, and enums by their value), else an `ErrDuplicate`
+//     error is returned giving the index of the repeated element.
+//
+// Alternatively, a tuple specifier has the form `(a,b,...)`. The data must be an
+// array with exactly one element per position, each of which is validated against
+// its own key, or, if the position is a type name, pseudotype or named enum (e.g.
+// `(string,integer)` or `(@palette,number)`), against that type.
 //
 // 7. A range specifier takes the form
 //   * `{n,m}` (meaning between `n` and `m`) or
-//   * `{n,}` (meaning at least `n`).
+//   * `{n,}` (meaning at least `n`) or
+//   * `{,m}` (meaning at most `m`).
 //
 // 8. A map specifier has the form `{}` followed by zero or more space-separated
 //    map elements
+//   * The `{}` may be followed by a present range of the form `[n,m]`, `[n,]` or `[,m]`,
+//     in which case the number of keys present in the map must lie within that
+//     range, e.g. `{}[1,]a? b? c?` requires at least one of `a`, `b` and `c`.
+//   * Alternatively, a map specifier of the form `{}:key` means a map with any
+//     keys, every value of which is validated as `key` (which may be a type name,
+//     pseudotype or named enum), e.g. `{}:string` for a map of strings.
 //
 // 9. A map element consists of a key (`key`) followed by zero or more modifiers
 //   * The key consists of word characters.
 //   * The key need not be specified within the template (if it isn't, no validation
 //     will be done on it).
+//   * Alternatively, a map element may be a pattern element of the form
+//     `/regexp/key` followed by zero or more modifiers. Any key in the map which
+//     is not otherwise listed, but which matches `regexp`, is validated as `key`.
+//     If a map specifier has pattern elements, they are tried in order, and a
+//     key matching none of them causes an `ErrBadKey` error. For instance
+//     `{}/^[a-z][a-z0-9-]*$/server` permits any number of keys made of lower
+//     case letters, digits and hyphens, each being a `server`.
+//   * Finally, a map element may be a catch-all of the form `...key` or
+//     `...key:type`. Any key in the map which is neither listed nor matches a
+//     pattern element is validated as `key`; if `type` is given, `key` is
+//     specified to be of that type (which may be a named enum such as
+//     `@palette`). For instance `{}name ...labels:string`
+//     requires `name` and permits any other key provided its value is a string.
+//   * A map element of `...` alone permits any other keys in the map, which are
+//     ignored. For instance `{}apple peach? ...` requires `apple`, permits
+//     `peach`, and ignores anything else.
+//   * A map element may be a group of the form `(a|b|c)`, meaning exactly one of
+//     the keys `a`, `b` and `c` must be present, or `(a|b|c)?`, meaning at most
+//     one of them may be present. Two or more being present causes an
+//     `ErrExclusiveKeys` error. The keys of a group may have array modifiers,
+//     e.g. `(file|inline*)`.
+//   * A `#` at the start of an element begins a comment, which runs to the end
+//     of the line, e.g. `"{}apple # the quantity\n peach?"`.
 //
 // 10. Permitted modifiers are:
 //   * `?` means the key is optional
 //   * `!` means the key is mandatory (the default)
+//   * `-` means the key is forbidden, i.e. it must not be present
+//   * `=` means the key, if present, must not have an empty value (an empty
+//     string, zero, or an empty array or map), else an `ErrEmptyValue` error is
+//     returned
 //   * `*` means the key is an array of 0 or more elements
 //   * `+` means the key is an array of 1 or more elements
 //   * A range specifier (see above), i.e.
-//     * `{n,m}` (meaning between `n` and `m`) or
-//     * `{n,}` (meaning at least `n`)
+//     * `{n,m}` (meaning between `n` and `m`),
+//     * `{n,}` (meaning at least `n`) or
+//     * `{,m}` (meaning at most `m`)
+//   * A range specifier of `{0,0}` means the key must be an empty array
+//   * At most one of `?`, `!` and `-`, and at most one of `*`, `+` and a range
+//     specifier, may be given; conflicting modifiers such as `apple?!` or
+//     `apple*+` cause an `ErrBadOptionModifier` error
+//
+// 11. Templates may be recursive, i.e. a key's map or array specifier may refer
+// (directly or indirectly) to the key itself. The depth of nesting validated is
+// limited by the `MaxDepth` field of `ValidateOptions`, beyond which an
+// `ErrMaxDepth` error is returned.
 //
 // Validator Functions
 //
@@ -161,6 +330,48 @@
 //     	return nil
 //     }
 //
+// The helper `cdl.OneOf` checks that a value is one of a set of allowed values,
+// comparing numbers by value, e.g.
+//
+//     func isOneOrTwo(o interface{}) *cdl.CdlError {
+//     	return cdl.OneOf(o, 1, 2)
+//     }
+//
+// Similarly, `cdl.ApproxEqual` checks that a value is a number within a
+// tolerance of a target, e.g. `cdl.ApproxEqual(o, 1, 1e-6)`.
+//
+// A validator function may also be registered for a Go type with
+// `cdl.RegisterTypeValidator`, in which case it is called for every leaf of
+// that type in every document validated (after the checks made by the
+// template), e.g. `cdl.RegisterTypeValidator(reflect.TypeOf(""), isValidUTF8)`.
+//
+// The time each validator function may take can be limited by the
+// `ValidatorTimeout` field of `ValidateOptions`, in which case a slow validator
+// produces an `ErrValidatorTimeout` error. As a validator function cannot be
+// cancelled, it continues to run in the background after the timeout (with
+// `MutateInPlace`, on a copy of its object, which may otherwise be modified
+// meanwhile). A validator which panics produces an `ErrInternal` error.
+//
+// A validator function may instead return a warning created with
+// `cdl.NewWarning`. Warnings do not cause validation to fail; they are
+// collected together with the path at which they occurred, and returned
+// by `ValidateWithWarnings`:
+//
+//     func isSmall(o interface{}) *cdl.CdlError {
+//     	if v, ok := o.(float64); ok && v > 1000 {
+//     		return cdl.NewWarning("ErrBadValue").SetSupplementary("is unusually large")
+//     	}
+//     	return nil
+//     }
+//
+// A validator function may also transform the value, in which case it has the
+// signature:
+//     func (o interface{}) (interface{}, *cdl.CdlError)
+//
+// (or the type `cdl.TransformFunc`). The value returned replaces the original
+// value for any configurator, allowing values to be canonicalised (e.g.
+// lowercased) in one place.
+//
 // Configurators
 //
 // A cdl configurator may optionally be passed to the `Validate` function. The
@@ -172,8 +383,21 @@
 //   * a pointer to the variable to be set; or
 //   * a pointer to a configuration function.
 //
-// If a pointer to a variable is used, the variable must be of the same
-// type as the item in the configuration, or an error will be issued;
+// A key is normally the name of a template key, in which case the item is used
+// wherever that key is validated. Alternatively a key may be a path pattern
+// such as `/mango/*/earth`, in which case the item is used only for data at a
+// matching path; `*` matches any single map key or array index. A key may also
+// be qualified by the key of the map containing the data, e.g. `limits.min`, in
+// which case it is used only within that map. Where several keys apply, the
+// most specific is used: a path pattern (that with the fewest `*`, if several
+// match), then a qualified key, then the unqualified key (`min`). A key whose
+// item is nil is ignored.
+//
+// If a pointer to a variable is used, the item in the configuration must be
+// assignable to the variable, or an error will be issued. A number is converted
+// to the numeric type of the variable (e.g. a `type Celsius float64`) if it can be
+// represented exactly, and a value is converted to a named type of the same kind
+// (e.g. a `string` to a `type Colour string`);
 // therefore as a type check is performed here, it is unnecessary in this
 // case to require a specific type in the template. If a specific
 // type is require, a type check is done twice. Certain pseudo-types
@@ -183,9 +407,66 @@
 //
 // 2. If you required the pseudo-type `integer`, you will always be given an `int`
 //
+// 3. If you required the pseudo-type `duration`, you will always be given a `time.Duration`
+//
+// 4. If you required the pseudo-type `timestamp`, you will always be given a `time.Time`
+//
+// 5. If you required the pseudo-type `raw`, you will always be given a `json.RawMessage`
+//
+// 6. If you required the pseudo-type `ip`, you will always be given a `net.IP`
+//
+// 7. If you required the pseudo-type `bytesize`, you will always be given an
+// `int64` number of bytes
+//
+// However, if you required the pseudo-type `number`, `integer` or `bytesize` and
+// the pointer is to a variable of a specific numeric type (e.g. `uint16` or `float32`), the
+// value is converted to that type. An `ErrValueOutOfRange` error is issued if the
+// value does not fit, and an `ErrBadType` error if a value which is not a whole
+// number is assigned to an integer type.
+//
 // If a pointer to an `Enum` is given, a `string` value is expected in the data,
 // and it will be validated against that `Enum`.
 //
+// If a pointer to an `interface{}` is given, it is set to whatever value is in
+// the data (after any of the conversions above), including `nil`.
+//
+// If a pointer to a `HostPort` is given, a `string` value (e.g. an `ipport`) is
+// expected in the data, and it will be split into its host and port. The host of
+// an IPv6 literal such as `[::1]:8080` is given without brackets.
+// Alternatively, the host and port of a key (say `cherry`) of an `ipport` type
+// may be bound separately with the configurator keys `cherry.host` and
+// `cherry.port`; the host is given as a `string` and the port, if numeric, as
+// an `int`.
+//
+// Rather than listing each key and pointer, a configurator may be built from a
+// pointer to a struct with `cdl.ConfiguratorFromStruct`, which binds each field
+// with a `cdl:"key"` tag to that key:
+//
+//     var cfg struct {
+//         Timeout time.Duration `cdl:"timeout"`
+//         Name    string        `cdl:"name"`
+//     }
+//     c, err := cdl.ConfiguratorFromStruct(&cfg)
+//
+// A pointer field is set to a newly allocated value when its key is
+// configured. Each element of an array is appended to a slice field, which is
+// emptied at the start of each validation. The fields of a nested struct with a
+// tag (e.g. `cdl:"limits"`) are bound to keys qualified by its key (e.g.
+// `limits.min`), whereas those of an untagged or embedded struct are bound as if
+// they were fields of the outer struct.
+//
+// Conversely, a template may be derived from such a struct with
+// `cdl.CompileStruct`. Here the tag may also contain modifiers (e.g.
+// `cdl:"name?"` or `cdl:"tags{1,3}"`), and the specification is derived from
+// the field's type unless given in a `cdltype` tag (e.g. `cdltype:"ipport"`).
+// A field of a type with no such specification (e.g. a map, an interface or an
+// `Enum`) must have a `cdltype` tag.
+//
+// Alternatively, `Typed` validates a document and returns a copy of it in which
+// each item is replaced by the value a configurator would be given (e.g. a
+// `time.Duration` for a `duration` and an `Enum` for a named enum), giving a
+// ready-to-use configuration without a configurator.
+//
 // If a pointer configuration function is used, it has a `ConfiguratorFunc` type
 // (or a function with a similar signature), which looks like this:
 //
@@ -196,6 +477,16 @@
 // its children have been validated. It may return an error (just like
 // a validator function).
 //
+// A configurator function may instead have the `ReplacingConfiguratorFunc` type:
+//
+//     type ReplacingConfiguratorFunc func(obj interface{}, path Path) (result interface{}, err *CdlError)
+//
+// The value it returns replaces the object wherever it is passed to the
+// configurator of a map or array containing it, so values may be transformed
+// from the bottom up (e.g. a map describing a server turned into a `Server`
+// struct before the array of servers is configured). The object being
+// validated is not modified.
+//
 // The object passed will be the validated object from the configuration
 // tree. It is guaranteed to be of the correct type, which means the type
 // you asked for save for the following exceptions:
@@ -204,6 +495,14 @@
 //
 // 2. If you asked for the pseudo-type `integer`, you will always be given an `int`.
 //
+// 3. If you asked for the pseudo-type `duration`, you will always be given a `time.Duration`.
+//
+// 4. If you asked for the pseudo-type `timestamp`, you will always be given a `time.Time`.
+//
+// 5. If you asked for the pseudo-type `raw`, you will always be given a `json.RawMessage`.
+//
+// 6. If you asked for the pseudo-type `bytesize`, you will always be given an `int64`.
+//
 // As a trivial example:
 //
 //     var i int
@@ -216,4 +515,12 @@
 //
 // Here the parameter named `"i"` in the template will be stored in
 // variable `i`.
+//
+// Version and features
+//
+// `cdl.Version` gives the version of cdl, and `cdl.Features()` lists the
+// features it supports, such as `pseudotype:email`, `modifier:?`,
+// `option:MutateInPlace` (a field of `ValidateOptions`) or
+// `compileoption:Sets` (a field of `CompileOptions`), so that tools may
+// tailor themselves to the version linked.
 package cdl
@@ -1,6 +1,8 @@
 package cdl
 
 import (
+	"database/sql/driver"
+	"flag"
 	"fmt"
 	"sort"
 )
@@ -52,13 +54,46 @@ func NewEnumTypeWithText(values map[string]string) EnumType {
 	return et
 }
 
+// func Entries returns the enumeration constants of an EnumType with their text
+//
+// The map returned maps each constant to its text; if no text has been
+// specified, the text is the constant itself.
+func (et EnumType) Entries() map[string]string {
+	entries := make(map[string]string, et.items)
+	for i, v := range et.toString {
+		if t := et.toText[i]; t != "" {
+			entries[v] = t
+		} else {
+			entries[v] = v
+		}
+	}
+	return entries
+}
+
+// func Values returns the enumeration constants of an EnumType in order
+func (et EnumType) Values() []string {
+	return append([]string(nil), et.toString...)
+}
+
+// func NewEnumTypeFromEntries produces a new EnumType from the output of Entries
+//
+// The constants are ordered alphabetically, as for NewEnumTypeWithText.
+func NewEnumTypeFromEntries(entries map[string]string) EnumType {
+	return NewEnumTypeWithText(entries)
+}
+
 type Enum struct {
 	Type  *EnumType
 	value int
 }
 
 // func String produces the string representation of an Enum
+//
+// The zero value of an Enum, which has no Type, produces an empty string.
 func (e Enum) String() string {
+	if e.Type == nil {
+		return ""
+	}
 	if e.value >= 0 && e.value < e.Type.items {
 		return e.Type.toString[e.value]
 	}
@@ -113,3 +148,87 @@ func (et *EnumType) New(v string) Enum {
 		panic("Bad enum initialiser " + v)
 	}
 }
+
+// func MarshalText implements encoding.TextMarshaler
+//
+// The text produced is the string representation of the Enum.
+func (e Enum) MarshalText() ([]byte, error) {
+	if e.Type == nil || e.value < 0 || e.value >= e.Type.items {
+		return nil, NewError("ErrBadEnumValue").SetSupplementary(fmt.Sprintf("bad enum value %d", e.value))
+	}
+	return []byte(e.String()), nil
+}
+
+// func UnmarshalText implements encoding.TextUnmarshaler
+//
+// The Enum must already have a Type (e.g. be created with EnumType.New). An
+// error is returned if the text is not a member of that type.
+func (e *Enum) UnmarshalText(text []byte) error {
+	if e.Type == nil {
+		return NewError("ErrBadEnumValue").SetSupplementary("enum has no type")
+	}
+	if !e.Set(string(text)) {
+		return newBadEnumValueError(string(text), *e.Type)
+	}
+	return nil
+}
+
+// func Value implements database/sql/driver.Valuer
+//
+// The value produced is the string representation of the Enum, or nil for the
+// zero value of an Enum, which has no Type.
+func (e Enum) Value() (driver.Value, error) {
+	if e.Type == nil {
+		return nil, nil
+	}
+	b, err := e.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// func Scan implements database/sql.Scanner
+//
+// The Enum must already have a Type (e.g. be created with EnumType.New). The
+// source must be a string (or []byte) which is a member of that type, or nil
+// (as produced by Value for the zero value of an Enum), which resets the Enum
+// to its zero value while keeping its Type.
+func (e *Enum) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		*e = Enum{Type: e.Type}
+		return nil
+	case string:
+		return e.UnmarshalText([]byte(s))
+	case []byte:
+		return e.UnmarshalText(s)
+	default:
+		return NewError("ErrBadEnumValue").SetSupplementary(fmt.Sprintf("cannot scan %T", src))
+	}
+}
+
+type enumFlag struct {
+	e *Enum
+}
+
+func (f enumFlag) String() string {
+	if f.e == nil || f.e.Type == nil {
+		return ""
+	}
+	return f.e.String()
+}
+
+func (f enumFlag) Set(v string) error {
+	return f.e.UnmarshalText([]byte(v))
+}
+
+// func Flag returns a flag.Value which sets the Enum
+//
+// This allows an Enum to be used as a command line flag, for instance
+//
+//    part := myEnumType.New("DEFAULT_VALUE")
+//    flag.Var(part.Flag(), "part", "the part to use")
+func (e *Enum) Flag() flag.Value {
+	return enumFlag{e: e}
+}
@@ -1,7 +1,9 @@
 package cdl
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -9,6 +11,9 @@ type CdlError struct {
 	Type          Enum
 	Supplementary string
 	Context       []string
+	Details       map[string]interface{}
+	warning       bool
+	maxContext    int
 }
 
 // var ErrorEnum is the Enum containing cdl errors.
@@ -26,10 +31,23 @@ var (
 		"ErrExpectedMap":                 "Expected map",
 		"ErrExpectedArray":               "Expected array",
 		"ErrOutOfRange":                  "Number of array items outside permissible range",
+		"ErrValueOutOfRange":             "Value outside permissible range",
 		"ErrBadType":                     "Bad type",
 		"ErrMissingMandatory":            "Missing mandatory key",
 		"ErrBadConfigurator":             "Bad configurator",
 		"ErrBadEnumValue":                "Bad option",
+		"ErrMaxDepth":                    "Maximum nesting depth exceeded",
+		"ErrUndefinedVariable":           "Undefined variable",
+		"ErrUnknownType":                 "Unknown type",
+		"ErrBadFile":                     "Cannot read file",
+		"ErrEmptyValue":                  "Empty value",
+		"ErrExclusiveKeys":               "Mutually exclusive keys",
+		"ErrValidatorTimeout":            "Validator timed out",
+		"ErrNotSorted":                   "Array not sorted",
+		"ErrDuplicate":                   "Duplicate array element",
+		"ErrBadOrder":                    "Key out of order",
+		"ErrUnexpectedResult":            "Unexpected validation result",
+		"ErrSyntax":                      "Syntax error",
 	})
 )
 
@@ -43,11 +61,72 @@ func (e CdlError) Error() string {
 	}
 	if len(e.Context) == 0 {
 		return fmt.Sprintf("%s (code %s)", main, e.Type.String())
+	} else if e.maxContext > 0 && len(e.Context) > e.maxContext {
+		// context is leaf first, so keep the innermost frames
+		return fmt.Sprintf("%s (code %s) near %s at ...", main, e.Type.String(), strings.Join(e.Context[:e.maxContext], " at "))
 	} else {
 		return fmt.Sprintf("%s (code %s) near %s", main, e.Type.String(), strings.Join(e.Context, " at "))
 	}
 }
 
+// func MarshalJSON implements the json.Marshaler interface.
+//
+// The error is represented as an object with the fields `type` (the error code),
+// `message` (the text of the error code), `path` (as returned by ContextPath)
+// and `supplementary`.
+func (e CdlError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type          string `json:"type"`
+		Message       string `json:"message"`
+		Path          string `json:"path"`
+		Supplementary string `json:"supplementary"`
+	}{
+		Type:          e.Type.String(),
+		Message:       e.Type.Text(),
+		Path:          e.ContextPath(),
+		Supplementary: e.Supplementary,
+	})
+}
+
+// type MultiError is a list of errors, such as those of several documents
+// validated with ValidateEach
+type MultiError []*CdlError
+
+// func Error implements the error interface, joining the text of each error
+//
+// Nil errors are skipped.
+func (m MultiError) Error() string {
+	var s []string
+	for _, e := range m.errors() {
+		s = append(s, e.Error())
+	}
+	return strings.Join(s, "; ")
+}
+
+// func MarshalJSON implements the json.Marshaler interface.
+//
+// The errors are represented as an array of objects, each as encoded by
+// CdlError's MarshalJSON. Nil errors are skipped, and an empty list is
+// encoded as an empty array.
+func (m MultiError) MarshalJSON() ([]byte, error) {
+	errs := m.errors()
+	if len(errs) == 0 {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(errs)
+}
+
+// errors returns the errors which are not nil
+func (m MultiError) errors() []*CdlError {
+	errs := make([]*CdlError, 0, len(m))
+	for _, e := range m {
+		if e != nil {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
 // func NewError returns a new CdlError of a given type.
 //
 // The type should be a type starting with `Err` in the constants section.
@@ -55,6 +134,19 @@ func NewError(t string) *CdlError {
 	return &CdlError{Type: ErrorEnum.New(t)}
 }
 
+// func NewWarning returns a new CdlError of a given type marked as a warning.
+//
+// A validator function returning a warning does not cause validation to fail;
+// instead the warning is collected and returned by ValidateWithWarnings.
+func NewWarning(t string) *CdlError {
+	return &CdlError{Type: ErrorEnum.New(t), warning: true}
+}
+
+// func IsWarning returns true if the CdlError was created as a warning
+func (e *CdlError) IsWarning() bool {
+	return e.warning
+}
+
 // func NewErrorContext creates a new CdlError with the specified context string.
 //
 // The type should be a type starting with `Err` in the constants section.
@@ -83,19 +175,160 @@ func (e *CdlError) AddContextQuoted(c string) *CdlError {
 	return e.AddContext(fmt.Sprintf("'%s'", c))
 }
 
+// func TypedContext returns the context of a cdl error as a slice of objects.
+//
+// The objects are in document order, and are strings for map keys and integers
+// for array indices, e.g. ["mango", 1, "jupiter", 0, "wotan"]
+func (e *CdlError) TypedContext() []interface{} {
+	items := []interface{}{}
+	for i := len(e.Context) - 1; i >= 0; i-- {
+		c := e.Context[i]
+		if c == "/" || strings.HasPrefix(c, "file ") {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(c, "index ")); err == nil && strings.HasPrefix(c, "index ") {
+			items = append(items, n)
+		} else if len(c) >= 2 && strings.HasPrefix(c, "'") && strings.HasSuffix(c, "'") {
+			items = append(items, c[1:len(c)-1])
+		} else {
+			items = append(items, c)
+		}
+	}
+	return items
+}
+
+// func ContextPath returns the context of a cdl error as a path string.
+//
+// Context is accumulated leaf first; the path returned is in document order,
+// with elements separated by '/', e.g. "/mango/1/jupiter/0/wotan".
+func (e *CdlError) ContextPath() string {
+	return e.Path().String()
+}
+
+// func Path returns the context of a cdl error as a Path
+func (e *CdlError) Path() Path {
+	return Path{items: e.TypedContext()}
+}
+
 // func SetSupplementary adds the specified supplementary data to an existing cdl error.
 func (e *CdlError) SetSupplementary(s string) *CdlError {
 	e.Supplementary = s
 	return e
 }
 
-func (r *optrange) describeError(value int) string {
+// func WithField adds a structured detail to an existing cdl error.
+//
+// Details carry the same information as the supplementary data, but in a form
+// suitable for machine consumption; common keys are `expected`, `got`, `min`
+// and `max`. An error returned by validation also has the key `depth`, giving
+// the depth within the document at which it occurred.
+func (e *CdlError) WithField(k string, v interface{}) *CdlError {
+	if e.Details == nil {
+		e.Details = make(map[string]interface{})
+	}
+	e.Details[k] = v
+	return e
+}
+
+// redact removes anything which may reveal the value of a secret
+func (e *CdlError) redact() {
+	if e.Supplementary != "" {
+		e.Supplementary = "***"
+	}
+	if _, ok := e.Details["got"]; ok {
+		e.Details["got"] = "***"
+	}
+	// the values allowed for a secret enum are as secret as its value
+	delete(e.Details, "allowed")
+}
+
+// pseudoTypeMessages gives the requirements of pseudotypes for which a
+// generic type error would be unhelpful
+var pseudoTypeMessages = map[string]string{
+	"number":              "must be a number",
+	"integer":             "must be a whole number",
+	"ipport":              "must be host:port",
+	"ipport_numeric":      "must be host:port with a numeric port",
+	"ipport_host":         "must be host:port with a non-empty host",
+	"ipport_host_numeric": "must be host:port with a non-empty host and a numeric port",
+	"ip":                  "must be an IPv4 or IPv6 address",
+	"url":                 "must be an absolute URL such as https://example.com/",
+	"email":               "must be a valid email address such as user@example.com",
+	"bytes":               "must be a []byte",
+	"bytesize":            "must be a number of bytes or a size such as 10MB or 1GiB",
+}
+
+// typeName returns the name of the type of an object for use in error
+// messages, giving `null` for nil (e.g. from a JSON `null`)
+func typeName(o interface{}) string {
+	if o == nil {
+		return "null"
+	}
+	return fmt.Sprintf("%T", o)
+}
+
+// newPseudoTypeError returns an error for an object which is not of a type
+// given by name, with a tailored message for pseudotypes
+func newPseudoTypeError(o interface{}, t string) *CdlError {
+	msg, ok := pseudoTypeMessages[t]
+	if !ok {
+		return newBadTypeError(o, t)
+	}
+	supplementary := fmt.Sprintf("got %s, %s", typeName(o), msg)
+	if s, isString := o.(string); isString {
+		supplementary = fmt.Sprintf("got '%s', %s", s, msg)
+	}
+	return NewError("ErrBadType").SetSupplementary(supplementary).
+		WithField("got", typeName(o)).
+		WithField("expected", t)
+}
+
+// newBadEnumValueError returns an error for a value which is not one of the
+// constants of an enum type, listing those allowed
+func newBadEnumValueError(got string, et EnumType) *CdlError {
+	allowed := et.Values()
+	return NewError("ErrBadEnumValue").SetSupplementary(fmt.Sprintf("got '%s', expected one of %s", got, strings.Join(allowed, ", "))).
+		WithField("got", got).
+		WithField("allowed", allowed)
+}
+
+func newBadTypeError(o interface{}, expected string) *CdlError {
+	supplementary := fmt.Sprintf("got %s expected %s", typeName(o), expected)
+	if expected == "bool" {
+		// give a hint for the commonest ways of mistyping a boolean
+		if isNumber(o) {
+			supplementary = "got number, expected bool, did you quote a boolean?"
+		} else if s, ok := o.(string); ok && (s == "true" || s == "false") {
+			supplementary = "got string, expected bool, did you quote a boolean?"
+		}
+	}
+	return NewError("ErrBadType").SetSupplementary(supplementary).
+		WithField("got", typeName(o)).
+		WithField("expected", expected)
+}
+
+// newError returns an error with the given code (ErrOutOfRange for the number
+// of items in an array, else ErrValueOutOfRange) for a value outside the range
+func (r *OptRange) newError(code string, value int) *CdlError {
+	e := NewError(code).SetSupplementary(r.describeError(value)).WithField("got", value)
+	if r.Min >= 0 {
+		e.WithField("min", r.Min)
+	}
+	if r.Max >= 0 {
+		e.WithField("max", r.Max)
+	}
+	return e
+}
+
+func (r *OptRange) describeError(value int) string {
 	min := r.Min
 	if min < 0 {
 		min = 0
 	}
 	if r.Max < 0 {
 		return fmt.Sprintf("got %d, expecting at least %d", value, min)
+	} else if r.Min < 0 {
+		return fmt.Sprintf("got %d, expecting at most %d", value, r.Max)
 	} else {
 		return fmt.Sprintf("got %d, expecting between %d and %d", value, min, r.Max)
 	}
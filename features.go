@@ -0,0 +1,46 @@
+package cdl
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Version is the version of cdl
+const Version = "1.0.0"
+
+// modifiers lists the modifiers which may follow a key in a map specifier,
+// and the suffixes which may follow an array specifier
+var modifiers = []string{"?", "!", "-", "=", "*", "+", "{n,m}", "sorted", "sorted-", "unique"}
+
+// func Features returns the features supported by this version of cdl
+//
+// Each feature is a string giving its kind and name: `pseudotype:` followed by
+// the name of a pseudotype (e.g. `pseudotype:email`), `modifier:` followed by a
+// modifier (e.g. `modifier:?`), `option:` followed by the name of a field of
+// ValidateOptions (e.g. `option:MutateInPlace`) or `compileoption:` followed by
+// the name of a field of CompileOptions (e.g. `compileoption:Sets`). The
+// features are sorted.
+func Features() []string {
+	var features []string
+	for _, t := range pseudoTypes {
+		features = append(features, "pseudotype:"+t)
+	}
+	for _, m := range modifiers {
+		features = append(features, "modifier:"+m)
+	}
+	features = append(features, fieldFeatures("option:", reflect.TypeOf(ValidateOptions{}))...)
+	features = append(features, fieldFeatures("compileoption:", reflect.TypeOf(CompileOptions{}))...)
+	sort.Strings(features)
+	return features
+}
+
+// fieldFeatures returns the exported fields of a struct as features with a prefix
+func fieldFeatures(prefix string, t reflect.Type) []string {
+	var features []string
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.PkgPath == "" {
+			features = append(features, prefix+f.Name)
+		}
+	}
+	return features
+}
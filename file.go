@@ -0,0 +1,127 @@
+package cdl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// type Decoder unmarshals data in a particular format, e.g. json.Unmarshal.
+type Decoder func(data []byte, v interface{}) error
+
+var (
+	decoders = map[string]Decoder{
+		".json": json.Unmarshal,
+	}
+	decodersLock sync.RWMutex
+)
+
+// func RegisterDecoder registers a decoder for files with the specified extension.
+//
+// A decoder for ".json" is registered by default. Decoders for ".yaml" and
+// ".yml", and for ".toml", are registered by importing the subpackages
+// github.com/abligh/cdl/yaml and github.com/abligh/cdl/toml respectively, so
+// that cdl itself has no dependencies. Other formats may be registered by the
+// application, and the defaults replaced. A nil decoder removes the
+// registration. Maps with interface{}
+// keys, as produced by some YAML decoders, are accepted wherever a map is
+// expected. RegisterDecoder is safe for concurrent use.
+func RegisterDecoder(ext string, d Decoder) {
+	decodersLock.Lock()
+	defer decodersLock.Unlock()
+	if d == nil {
+		delete(decoders, strings.ToLower(ext))
+		return
+	}
+	decoders[strings.ToLower(ext)] = d
+}
+
+// decoderFor returns the decoder registered for an extension
+func decoderFor(ext string) (Decoder, bool) {
+	decodersLock.RLock()
+	defer decodersLock.RUnlock()
+	d, ok := decoders[strings.ToLower(ext)]
+	return d, ok
+}
+
+// func ValidateReader reads, decodes and validates an object against a cdl template.
+func (ct *CompiledTemplate) ValidateReader(r io.Reader, d Decoder, configurator Configurator) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return NewError("ErrBadFile").SetSupplementary(err.Error())
+	}
+	var o interface{}
+	if err := d(data, &o); err != nil {
+		return NewError("ErrBadFile").SetSupplementary(err.Error())
+	}
+	return ct.Validate(o, configurator)
+}
+
+// func ValidateFile reads, decodes and validates a file against a cdl template.
+//
+// The decoder is chosen by the extension of the file name; see RegisterDecoder.
+// Any error returned has the file name as its outermost context.
+func (ct *CompiledTemplate) ValidateFile(name string, configurator Configurator) error {
+	ext := strings.ToLower(filepath.Ext(name))
+	d, ok := decoderFor(ext)
+	if !ok {
+		return NewError("ErrBadFile").SetSupplementary(fmt.Sprintf("no decoder for extension '%s'", ext)).AddContext(fileContext(name))
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return NewError("ErrBadFile").SetSupplementary(err.Error()).AddContext(fileContext(name))
+	}
+	defer f.Close()
+	if err := ct.ValidateReader(f, d, configurator); err != nil {
+		if me, ok := err.(*CdlError); ok {
+			return me.AddContext(fileContext(name))
+		}
+		return err
+	}
+	return nil
+}
+
+// func Assert validates an example JSON document against a cdl template, checking the outcome is as expected.
+//
+// wantErr is the code of the error the example should produce (e.g.
+// "ErrBadType"), or "" if it should be valid. nil is returned if the outcome
+// is as expected, else ErrUnexpectedResult describing the actual outcome. An
+// example which cannot be decoded produces ErrBadFile, and an unknown error
+// code ErrBadValue. No configurator is called. This is intended for golden
+// tests of templates.
+func (ct *CompiledTemplate) Assert(example []byte, wantErr string) error {
+	if wantErr != "" && !ErrorEnum.Has(wantErr) {
+		return NewError("ErrBadValue").SetSupplementary(fmt.Sprintf("unknown error code '%s'", wantErr)).WithField("got", wantErr)
+	}
+	var o interface{}
+	if err := json.Unmarshal(example, &o); err != nil {
+		return NewError("ErrBadFile").SetSupplementary(err.Error())
+	}
+	err := ct.Validate(o, nil)
+	got := ""
+	if me, ok := err.(*CdlError); ok {
+		got = me.Type.String()
+	}
+	switch {
+	case got == wantErr:
+		return nil
+	case err == nil:
+		return NewError("ErrUnexpectedResult").SetSupplementary(fmt.Sprintf("expected %s, but example is valid", wantErr)).
+			WithField("expected", wantErr)
+	case wantErr == "":
+		return NewError("ErrUnexpectedResult").SetSupplementary(fmt.Sprintf("expected example to be valid, got %v", err)).
+			WithField("got", got)
+	}
+	return NewError("ErrUnexpectedResult").SetSupplementary(fmt.Sprintf("expected %s, got %v", wantErr, err)).
+		WithField("expected", wantErr).
+		WithField("got", got)
+}
+
+func fileContext(name string) string {
+	return "file " + name
+}
@@ -0,0 +1,32 @@
+package cdl
+
+import (
+	"net"
+)
+
+// type HostPort is an IP port pair split into its host and port.
+//
+// A pointer to a HostPort may be used in a configurator for a key whose value
+// is an ipport (or similar pseudotype). The host of an IPv6 literal such as
+// `[::1]:8080` is given without brackets.
+type HostPort struct {
+	Host string
+	Port string
+}
+
+// func String produces a string representation of a host port pair suitable for net.Dial
+func (hp HostPort) String() string {
+	return net.JoinHostPort(hp.Host, hp.Port)
+}
+
+func splitHostPort(o interface{}) (HostPort, *CdlError) {
+	s, ok := o.(string)
+	if !ok {
+		return HostPort{}, newBadTypeError(o, "ipport")
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return HostPort{}, NewError("ErrBadType").SetSupplementary(err.Error())
+	}
+	return HostPort{Host: host, Port: port}, nil
+}
@@ -0,0 +1,48 @@
+package cdl
+
+// func AddKey adds a key to a compiled template, or replaces its specification.
+//
+// The specification may be anything which may be given for a key in a
+// Template. The template is recompiled with the same options, so that (for
+// instance) keys referred to by the new specification are discovered. If
+// compilation fails, an error is returned and the template is unchanged.
+//
+// A template must not be altered while it is being used to validate.
+func (ct *CompiledTemplate) AddKey(key string, spec interface{}) error {
+	t := ct.copySource()
+	t[key] = spec
+	return ct.recompile(t)
+}
+
+// func RemoveKey removes a key from a compiled template.
+//
+// Any map element referring to the key remains, but its value is no longer
+// validated (as if the key had never been specified). The root key may not be
+// removed. A template must not be altered while it is being used to validate.
+func (ct *CompiledTemplate) RemoveKey(key string) error {
+	t := ct.copySource()
+	delete(t, key)
+	return ct.recompile(t)
+}
+
+// copySource returns a copy of the template from which ct was compiled
+func (ct *CompiledTemplate) copySource() Template {
+	t := make(Template, len(ct.source))
+	for k, v := range ct.source {
+		t[k] = v
+	}
+	return t
+}
+
+// recompile compiles t and, if it compiles, replaces the compiled template
+func (ct *CompiledTemplate) recompile(t Template) error {
+	nct, err := CompileWithOptions(t, ct.opts)
+	if err != nil {
+		return err
+	}
+	ct.s, ct.source, ct.qualified = nct.s, nct.source, nct.qualified
+	ct.cacheLock.Lock()
+	ct.cache = nil
+	ct.cacheLock.Unlock()
+	return nil
+}
@@ -0,0 +1,210 @@
+package cdl
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+// sizedNumericTypes maps the names of the sized numeric types to their types.
+//
+// Data of any numeric type may be validated against these, provided its value
+// can be represented exactly, and is converted to the named type.
+var sizedNumericTypes = map[string]reflect.Type{
+	"int8":    reflect.TypeOf(int8(0)),
+	"int16":   reflect.TypeOf(int16(0)),
+	"int32":   reflect.TypeOf(int32(0)),
+	"int64":   reflect.TypeOf(int64(0)),
+	"uint8":   reflect.TypeOf(uint8(0)),
+	"uint16":  reflect.TypeOf(uint16(0)),
+	"uint32":  reflect.TypeOf(uint32(0)),
+	"uint64":  reflect.TypeOf(uint64(0)),
+	"float32": reflect.TypeOf(float32(0)),
+}
+
+// exactNumericTypes maps the names of the numeric types which are otherwise
+// matched exactly to their types.
+//
+// Data of any numeric type may be validated against these if the WidenNumbers
+// validate option is set.
+var exactNumericTypes = map[string]reflect.Type{
+	"int":     reflect.TypeOf(int(0)),
+	"uint":    reflect.TypeOf(uint(0)),
+	"float64": reflect.TypeOf(float64(0)),
+}
+
+func isNumericKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func isNumber(o interface{}) bool {
+	return o != nil && isNumericKind(reflect.TypeOf(o).Kind())
+}
+
+// toFloat64 converts any numeric value to a float64
+func toFloat64(o interface{}) (float64, bool) {
+	if !isNumber(o) {
+		return 0, false
+	}
+	v := reflect.ValueOf(o)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	default:
+		return v.Float(), true
+	}
+}
+
+// toBigInt returns an integer as a big.Int, and whether it is an integer
+func toBigInt(o interface{}) (*big.Int, bool) {
+	if o == nil {
+		return nil, false
+	}
+	v := reflect.ValueOf(o)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return big.NewInt(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return new(big.Int).SetUint64(v.Uint()), true
+	}
+	return nil, false
+}
+
+// parseNumber parses a string given where the numeric type t is expected
+//
+// If t is not a numeric type, the string is returned unchanged. Integers are
+// parsed as Go integer literals, so a base prefix may be given. A value for
+// one of the exactly matched types int, uint or float64 is converted to that
+// type.
+func parseNumber(s string, t string) (interface{}, *CdlError) {
+	exact := exactNumericTypes[t]
+	integer := true
+	switch {
+	case t == "integer":
+	case t == "number":
+		integer = false
+	case exact != nil:
+		integer = exact.Kind() != reflect.Float64
+	default:
+		if st, ok := sizedNumericTypes[t]; !ok {
+			return s, nil
+		} else {
+			integer = st.Kind() != reflect.Float32
+		}
+	}
+	var o interface{}
+	if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+		o = int(i)
+	} else if u, err := strconv.ParseUint(s, 0, 64); err == nil {
+		o = u
+	} else if f, err := strconv.ParseFloat(s, 64); err == nil && !integer {
+		o = f
+	} else {
+		return nil, NewError("ErrBadValue").SetSupplementary(fmt.Sprintf("cannot parse '%s' as %s", s, t)).
+			WithField("got", s).
+			WithField("expected", t)
+	}
+	if exact != nil {
+		return convertNumber(o, exact)
+	}
+	return o, nil
+}
+
+// convertNumber converts a numeric value to the numeric type t
+//
+// An error is returned if the value is not a whole number but t is an integer
+// type, or if the value cannot be represented exactly in t.
+func convertNumber(o interface{}, t reflect.Type) (interface{}, *CdlError) {
+	if !isNumber(o) || !isNumericKind(t.Kind()) {
+		return nil, newBadTypeError(o, t.String())
+	}
+	v := reflect.ValueOf(o)
+	target := reflect.New(t).Elem()
+	outOfRange := func() *CdlError {
+		return NewError("ErrValueOutOfRange").SetSupplementary(fmt.Sprintf("%v does not fit in %s", o, t.String())).
+			WithField("got", o).
+			WithField("expected", t.String())
+	}
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f, _ := toFloat64(o)
+		if target.OverflowFloat(f) {
+			return nil, outOfRange()
+		}
+		target.SetFloat(f)
+		// the value must survive conversion back, e.g. 2^53+1 does not
+		exact := target.Float() == f
+		if n, ok := toBigInt(o); ok && exact {
+			back, _ := big.NewFloat(f).Int(nil)
+			exact = back.Cmp(n) == 0
+		}
+		if !exact {
+			return nil, NewError("ErrBadValue").SetSupplementary(fmt.Sprintf("%v cannot be represented exactly in %s", o, t.String())).
+				WithField("got", o).
+				WithField("expected", t.String())
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			i = v.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if v.Uint() > math.MaxInt64 {
+				return nil, outOfRange()
+			}
+			i = int64(v.Uint())
+		default:
+			f := v.Float()
+			if f != math.Trunc(f) {
+				return nil, NewError("ErrBadType").SetSupplementary(fmt.Sprintf("got %v expected a whole number for %s", o, t.String())).
+					WithField("got", o).
+					WithField("expected", t.String())
+			}
+			if f < math.MinInt64 || f >= math.MaxInt64 {
+				return nil, outOfRange()
+			}
+			i = int64(f)
+		}
+		if target.OverflowInt(i) {
+			return nil, outOfRange()
+		}
+		target.SetInt(i)
+	default:
+		var u uint64
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if v.Int() < 0 {
+				return nil, outOfRange()
+			}
+			u = uint64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			u = v.Uint()
+		default:
+			f := v.Float()
+			if f != math.Trunc(f) {
+				return nil, NewError("ErrBadType").SetSupplementary(fmt.Sprintf("got %v expected a whole number for %s", o, t.String())).
+					WithField("got", o).
+					WithField("expected", t.String())
+			}
+			if f < 0 || f >= math.MaxUint64 {
+				return nil, outOfRange()
+			}
+			u = uint64(f)
+		}
+		if target.OverflowUint(u) {
+			return nil, outOfRange()
+		}
+		target.SetUint(u)
+	}
+	return target.Interface(), nil
+}
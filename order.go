@@ -0,0 +1,156 @@
+package cdl
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// sortableTypes lists the type names whose values may be compared in order
+var sortableTypes = map[string]bool{
+	"number":    true,
+	"integer":   true,
+	"string":    true,
+	"duration":  true,
+	"timestamp": true,
+	"bytesize":  true,
+	"int":       true, "int8": true, "int16": true, "int32": true, "int64": true,
+	"uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+	"float32": true, "float64": true,
+}
+
+// sortType returns the type name by which the elements of an array are
+// compared, or false if they cannot be compared
+func (ct *CompiledTemplate) sortType(name string) (string, bool) {
+	switch t := ct.s[name].(type) {
+	case string:
+		return t, sortableTypes[t]
+	case *stringSpec:
+		return "string", true
+	}
+	return "", false
+}
+
+// checkSortable checks that the elements of each sorted array can be compared
+func (ct *CompiledTemplate) checkSortable() *CdlError {
+	for k, v := range ct.s {
+		if a, ok := v.(*array); ok && a.order != 0 {
+			if _, ok := ct.sortType(a.name); !ok {
+				return NewErrorContextQuoted("ErrBadOptionValue", k).
+					SetSupplementary(fmt.Sprintf("elements of type '%s' cannot be sorted", specString(ct.s[a.name])))
+			}
+		}
+	}
+	return nil
+}
+
+// compareItems returns -1, 0 or 1 as a is less than, equal to or greater than
+// b, where both have been validated against the type name t
+func compareItems(a interface{}, b interface{}, t string) int {
+	switch t {
+	case "duration":
+		da, _ := toDuration(a)
+		db, _ := toDuration(b)
+		a, b = int64(da), int64(db)
+	case "bytesize":
+		a, _ = toByteSize(a)
+		b, _ = toByteSize(b)
+	case "timestamp":
+		ta, _ := toTimestamp(a)
+		tb, _ := toTimestamp(b)
+		switch {
+		case ta.Before(tb):
+			return -1
+		case ta.After(tb):
+			return 1
+		}
+		return 0
+	}
+	if sa, ok := a.(string); ok {
+		sb, _ := b.(string)
+		switch {
+		case sa < sb:
+			return -1
+		case sa > sb:
+			return 1
+		}
+		return 0
+	}
+	return compareNumbers(a, b)
+}
+
+// compareNumbers returns -1, 0 or 1 as the number a is less than, equal to or
+// greater than b
+//
+// Two integers are compared exactly, rather than as float64s, which cannot
+// represent every int64 or uint64.
+func compareNumbers(a interface{}, b interface{}) int {
+	if ia, ok := toBigInt(a); ok {
+		if ib, ok := toBigInt(b); ok {
+			return ia.Cmp(ib)
+		}
+	}
+	fa, _ := toFloat64(a)
+	fb, _ := toFloat64(b)
+	switch {
+	case fa < fb:
+		return -1
+	case fa > fb:
+		return 1
+	}
+	return 0
+}
+
+// checkOrder checks the elements of a validated array are sorted, in
+// ascending order if order is positive or descending order if negative
+func (ct *CompiledTemplate) checkOrder(slice []interface{}, name string, order int) *CdlError {
+	t, _ := ct.sortType(name)
+	for i := 1; i < len(slice); i++ {
+		if compareItems(slice[i-1], slice[i], t)*order > 0 {
+			direction := "ascending"
+			if order < 0 {
+				direction = "descending"
+			}
+			return NewError("ErrNotSorted").SetSupplementary(fmt.Sprintf("element %d is not in %s order", i, direction)).
+				WithField("index", i).AddContext(fmt.Sprintf("index %d", i))
+		}
+	}
+	return nil
+}
+
+// uniqueKey returns a value by which an element of an array may be compared
+// for equality with others
+//
+// Numbers are compared by value, and enums by the value's string.
+func uniqueKey(o interface{}) interface{} {
+	switch n := o.(type) {
+	case Enum:
+		return n.String()
+	case string:
+		return n
+	}
+	if i, ok := toBigInt(o); ok {
+		if f, acc := new(big.Float).SetInt(i).Float64(); acc == big.Exact {
+			return f
+		}
+		// too large to be represented exactly as a float64
+		return i.String()
+	}
+	if f, ok := toFloat64(o); ok {
+		return f
+	}
+	return fmt.Sprintf("%T:%#v", o, o)
+}
+
+// checkUnique checks the elements of a validated array are not repeated
+func checkUnique(slice []interface{}) *CdlError {
+	seen := make(map[interface{}]int, len(slice))
+	for i, v := range slice {
+		k := uniqueKey(v)
+		if first, ok := seen[k]; ok {
+			return NewError("ErrDuplicate").SetSupplementary(fmt.Sprintf("element %d repeats element %d", i, first)).
+				WithField("index", i).WithField("first", first).AddContext(fmt.Sprintf("index %d", i))
+		}
+		seen[k] = i
+	}
+	return nil
+}
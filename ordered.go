@@ -0,0 +1,155 @@
+package cdl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// type OrderedMap is a map which records the order in which its keys appear
+//
+// An *OrderedMap may be validated wherever a map may be. With the EnforceOrder
+// validation option, its keys must appear in the order in which they are
+// declared in the template.
+type OrderedMap struct {
+	Keys   []string
+	Values map[string]interface{}
+}
+
+// func NewOrderedMap returns an empty ordered map
+func NewOrderedMap() *OrderedMap {
+	return &OrderedMap{Values: make(map[string]interface{})}
+}
+
+// func Set sets the value of a key, appending the key if it is not already present
+func (m *OrderedMap) Set(k string, v interface{}) {
+	if m.Values == nil {
+		m.Values = make(map[string]interface{})
+	}
+	if _, ok := m.Values[k]; !ok {
+		m.Keys = append(m.Keys, k)
+	}
+	m.Values[k] = v
+}
+
+// func Get returns the value of a key, and whether it is present
+func (m *OrderedMap) Get(k string) (interface{}, bool) {
+	v, ok := m.Values[k]
+	return v, ok
+}
+
+// func UnmarshalJSON decodes a JSON object preserving the order of its keys
+//
+// Objects nested within the object are decoded as *OrderedMap, and arrays as
+// []interface{}.
+func (m *OrderedMap) UnmarshalJSON(data []byte) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if t != json.Delim('{') {
+		return fmt.Errorf("cdl: cannot decode %v as an ordered map", t)
+	}
+	*m = OrderedMap{Values: make(map[string]interface{})}
+	return m.decode(d)
+}
+
+// decode decodes the members of a JSON object whose opening brace has been read
+func (m *OrderedMap) decode(d *json.Decoder) error {
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		k, _ := t.(string)
+		v, err := decodeOrdered(d)
+		if err != nil {
+			return err
+		}
+		m.Set(k, v)
+	}
+	_, err := d.Token() // closing brace
+	return err
+}
+
+// decodeOrdered decodes a JSON value, decoding objects as *OrderedMap
+func decodeOrdered(d *json.Decoder) (interface{}, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case json.Delim('{'):
+		m := NewOrderedMap()
+		return m, m.decode(d)
+	case json.Delim('['):
+		a := []interface{}{}
+		for d.More() {
+			v, err := decodeOrdered(d)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		_, err := d.Token() // closing bracket
+		return a, err
+	}
+	return t, nil
+}
+
+// func MarshalJSON encodes an ordered map as a JSON object with its keys in order
+func (m *OrderedMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range m.Keys {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		kj, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		vj, err := json.Marshal(m.Values[k])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(kj)
+		b.WriteByte(':')
+		b.Write(vj)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// position returns the position at which a key is declared in a map's
+// specifier, or -1 if it is not declared
+func (opts *options) position(k string) int {
+	for i, o := range opts.order {
+		if o == k {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkKeyOrder checks the keys of an ordered map appear in the order in which
+// they are declared in the template
+//
+// Keys not declared by name, such as those matching patterns, may appear anywhere.
+func (opts *options) checkKeyOrder(keys []string) *CdlError {
+	last, lastKey := -1, ""
+	for _, k := range keys {
+		i := opts.position(k)
+		if i < 0 {
+			continue
+		}
+		if i < last {
+			return NewErrorContextQuoted("ErrBadOrder", k).
+				SetSupplementary(fmt.Sprintf("key '%s' must precede '%s'", k, lastKey)).
+				WithField("after", lastKey)
+		}
+		last, lastKey = i, k
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package cdl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// func Parse reads a template in the line based cdl file format.
+//
+// Each line is either blank, a comment starting with '#', or of the form
+// `key = spec`, where the spec is everything after the first '=' (so that
+// `kind = =circle` gives the literal `=circle`). A '#' at the start of any word
+// of the spec but the first begins a comment, which runs to the end of the line;
+// a spec starting with '#' names a set. Only string specs may be given;
+// validator functions must be added to the template returned before it is
+// compiled. A line which is not of this form produces ErrSyntax.
+func Parse(r io.Reader) (Template, error) {
+	t := Template{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, NewError("ErrSyntax").SetSupplementary(fmt.Sprintf("got '%s' expected key = spec", line)).
+				AddContext(fmt.Sprintf("line %d", n))
+		}
+		k := strings.TrimSpace(line[:i])
+		if _, ok := t[k]; ok {
+			return nil, NewErrorContextQuoted("ErrBadKey", k).SetSupplementary("key already specified").
+				AddContext(fmt.Sprintf("line %d", n))
+		}
+		t[k] = stripComment(strings.TrimSpace(line[i+1:]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, NewError("ErrBadFile").SetSupplementary(err.Error())
+	}
+	return t, nil
+}
+
+// stripComment removes any comment from a spec, which begins with a '#' at the
+// start of any word but the first
+func stripComment(spec string) string {
+	for i := 1; i < len(spec); i++ {
+		if spec[i] == '#' && (spec[i-1] == ' ' || spec[i-1] == '\t') {
+			return strings.TrimSpace(spec[:i])
+		}
+	}
+	return spec
+}
+
+// func ParseFile reads a template from a file in the line based cdl file format.
+//
+// See Parse for the format. Any error returned has the file name as its
+// outermost context.
+func ParseFile(name string) (Template, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, NewError("ErrBadFile").SetSupplementary(err.Error()).AddContext(fileContext(name))
+	}
+	defer f.Close()
+	t, err := Parse(f)
+	if err != nil {
+		if me, ok := err.(*CdlError); ok {
+			return nil, me.AddContext(fileContext(name))
+		}
+		return nil, err
+	}
+	return t, nil
+}
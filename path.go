@@ -14,6 +14,53 @@ func (p *Path) push(o interface{}) Path {
 	return Path{items: append(p.items, o)}
 }
 
+// isPathPattern returns true if a configurator key is a path pattern rather than a name
+func isPathPattern(k string) bool {
+	return len(k) > 1 && strings.HasPrefix(k, "/")
+}
+
+// matches returns true if a path matches a path pattern
+//
+// A pattern consists of elements separated by '/', each of which matches an
+// element of the path with the same string representation, save that `*`
+// matches any single element, e.g. "/mango/*/earth".
+func (p *Path) matches(pattern string) bool {
+	elements := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	if len(elements) != len(p.items) {
+		return false
+	}
+	for i, s := range p.StringSlice() {
+		if elements[i] != "*" && elements[i] != s {
+			return false
+		}
+	}
+	return true
+}
+
+// parentKey returns the key of the map containing the item at a path, if any,
+// ignoring the indices of arrays, e.g. `limits` for /limits/tags/0
+func (p *Path) parentKey() (string, bool) {
+	keys := 0
+	for i := len(p.items) - 1; i >= 0; i-- {
+		if s, ok := p.items[i].(string); ok {
+			if keys++; keys == 2 {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
+
+// func IsRoot returns true if the path is the root of the object
+func (p *Path) IsRoot() bool {
+	return len(p.items) == 0
+}
+
+// func Depth returns the number of elements in the path; the root has depth 0
+func (p Path) Depth() int {
+	return len(p.items)
+}
+
 // func Slice returns a slice of objects representing the path.
 //
 // The objects may be strings or integers
@@ -43,3 +90,73 @@ func (p *Path) StringSlice() []string {
 func (p Path) String() string {
 	return "/" + strings.Join(p.StringSlice(), "/")
 }
+
+// func JSONPointer produces an RFC 6901 JSON Pointer to the item at a path
+//
+// Unlike String, '~' and '/' within map keys are escaped (as "~0" and "~1"),
+// and the root is the empty string.
+func (p Path) JSONPointer() string {
+	var sb strings.Builder
+	for _, s := range p.StringSlice() {
+		sb.WriteString("/")
+		sb.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(s))
+	}
+	return sb.String()
+}
+
+// func ExpectedType returns the specification the template gives for the item
+// at a path, as it would be written in a template, e.g. "float64" or
+// "[]string{1,3}"
+//
+// This may be used with the path of an error (see CdlError.Path) to find what
+// was expected where validation failed. False is returned if the path is not
+// within the template, or if the template does not specify the item.
+func (ct *CompiledTemplate) ExpectedType(path Path) (string, bool) {
+	pos := "/"
+	for i := 0; i < len(path.items); i++ {
+		switch t := ct.s[pos].(type) {
+		case *options:
+			k, ok := path.items[i].(string)
+			if !ok {
+				return "", false
+			}
+			req, ok := t.keys[k]
+			name := k
+			if !ok {
+				p := t.match(k)
+				if p == nil {
+					return "", false
+				}
+				req, name = p.req, p.name
+			}
+			pos = ct.qualify(pos, name)
+			if req.array {
+				if i == len(path.items)-1 {
+					return specString(&array{name: pos, r: req.r}), true
+				}
+				if _, ok := path.items[i+1].(int); !ok {
+					return "", false
+				}
+				i++
+			}
+		case *array:
+			if _, ok := path.items[i].(int); !ok {
+				return "", false
+			}
+			pos = t.name
+		case *tuple:
+			n, ok := path.items[i].(int)
+			if !ok || n < 0 || n >= len(t.names) {
+				return "", false
+			}
+			pos = t.names[n]
+		default:
+			return "", false
+		}
+	}
+	v, ok := ct.s[pos]
+	if !ok || v == 0 {
+		return "", false
+	}
+	return specString(v), true
+}
@@ -0,0 +1,44 @@
+package cdl
+
+import (
+	"fmt"
+)
+
+// stringSet is a set of permitted strings, given in a template as `#name`
+type stringSet struct {
+	name   string
+	values map[string]bool
+}
+
+func newStringSet(name string, values []string) *stringSet {
+	s := &stringSet{name: name, values: make(map[string]bool, len(values))}
+	for _, v := range values {
+		s.values[v] = true
+	}
+	return s
+}
+
+// validate checks an object is a string within the set
+func (s *stringSet) validate(o interface{}) *CdlError {
+	n, ok := o.(string)
+	if !ok {
+		return newBadTypeError(o, "string")
+	}
+	if !s.values[n] {
+		supplementary := fmt.Sprintf("unknown value '%s'", n)
+		if s.name != "" {
+			supplementary = fmt.Sprintf("unknown value '%s' in set '%s'", n, s.name)
+		}
+		return NewError("ErrBadEnumValue").SetSupplementary(supplementary).WithField("got", n)
+	}
+	return nil
+}
+
+// func InSet returns a validator function checking an object is one of a set of strings
+//
+// This is useful for large sets of values (such as country codes) loaded at
+// run time. A string not in the set produces ErrBadEnumValue, and anything
+// other than a string ErrBadType.
+func InSet(values []string) ValidatorFunc {
+	return newStringSet("", values).validate
+}
@@ -0,0 +1,103 @@
+package cdl
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// stringSpec is a string with constraints on its value
+type stringSpec struct {
+	bounds []stringBound
+	length OptRange // in runes, or if bytes is set, in bytes
+	bytes  bool
+}
+
+// stringBound constrains a string by lexicographic comparison with a bound
+type stringBound struct {
+	op    string
+	bound string
+}
+
+var stringSpecRegexp = regexp.MustCompile("^string(?:\\{(b:)?(\\d*),(\\d*)\\})?((?:(?:>=|<=|>|<)[^<>=]+)*)$")
+var stringBoundRegexp = regexp.MustCompile("(>=|<=|>|<)([^<>=]+)")
+
+// isStringSpec returns true if a specification is a string with constraints,
+// e.g. `string>=2021-01-01` or `string{1,32}`
+func isStringSpec(spec string) bool {
+	return spec != "string" && stringSpecRegexp.MatchString(spec)
+}
+
+// makeStringSpec parses a string specification, e.g. `string>=2021-01-01`
+func makeStringSpec(spec string) (*stringSpec, *CdlError) {
+	m := stringSpecRegexp.FindStringSubmatch(spec)
+	if m == nil {
+		return nil, NewErrorContextQuoted("ErrBadOptionValue", spec)
+	}
+	ss := &stringSpec{length: OptRange{-1, -1}, bytes: m[1] != ""}
+	if m[2] != "" || m[3] != "" {
+		r, ok := parseRange(m[2], m[3])
+		if !ok {
+			return nil, NewErrorContextQuoted("ErrBadRangeOptionModifierValue", spec)
+		}
+		ss.length = r
+	} else if strings.HasPrefix(spec, "string{") {
+		return nil, NewErrorContextQuoted("ErrBadRangeOptionModifierValue", spec)
+	}
+	for _, b := range stringBoundRegexp.FindAllStringSubmatch(m[4], -1) {
+		ss.bounds = append(ss.bounds, stringBound{op: b[1], bound: b[2]})
+	}
+	return ss, nil
+}
+
+func compare(op string, c int) bool {
+	switch op {
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c < 0
+	}
+}
+
+func (ss *stringSpec) validate(o interface{}) *CdlError {
+	s, ok := o.(string)
+	if !ok {
+		return newBadTypeError(o, "string")
+	}
+	length, unit := utf8.RuneCountInString(s), "runes"
+	if ss.bytes {
+		length, unit = len(s), "bytes"
+	}
+	if !ss.length.Contains(length) {
+		err := ss.length.newError("ErrValueOutOfRange", length)
+		return err.SetSupplementary(fmt.Sprintf("length in %s: %s", unit, err.Supplementary))
+	}
+	for _, b := range ss.bounds {
+		if !compare(b.op, strings.Compare(s, b.bound)) {
+			return NewError("ErrValueOutOfRange").SetSupplementary(fmt.Sprintf("got '%s', expecting %s %s", s, b.op, b.bound)).
+				WithField("got", s).
+				WithField("bound", b.op+b.bound)
+		}
+	}
+	return nil
+}
+
+func (ss *stringSpec) String() string {
+	s := "string"
+	if ss.length.Min >= 0 || ss.length.Max >= 0 {
+		r := ss.length.spec()
+		if ss.bytes {
+			r = "{b:" + strings.TrimPrefix(r, "{")
+		}
+		s += r
+	}
+	for _, b := range ss.bounds {
+		s += b.op + b.bound
+	}
+	return s
+}
@@ -0,0 +1,354 @@
+package cdl
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// asMap returns the map to be validated for an object
+//
+// A map[string]interface{} is returned unchanged. Any other map with string
+// keys (such as a map[interface{}]interface{}) is copied; if stringifyKeys is
+// set, keys of other types (such as numbers) are converted to their string
+// form, else they produce ErrBadKey. A struct (or a pointer to a
+// struct) is converted to a map of its exported fields, keyed by the name in
+// the field's `cdl` tag, or failing that its `json` tag, or failing that the
+// field name. Fields tagged "-", nil pointer fields, and empty fields tagged
+// "omitempty" are omitted.
+func asMap(o interface{}, stringifyKeys bool) (map[string]interface{}, *CdlError) {
+	switch n := o.(type) {
+	case map[string]interface{}:
+		return n, nil
+	case *OrderedMap:
+		return n.Values, nil
+	case map[interface{}]interface{}:
+		// as produced by some YAML decoders
+		m := make(map[string]interface{}, len(n))
+		for k, v := range n {
+			if s, ok := k.(string); ok {
+				m[s] = v
+			} else if stringifyKeys {
+				m[fmt.Sprintf("%v", k)] = v
+			} else {
+				return nil, NewErrorContext("ErrBadKey", fmt.Sprintf("%v", k)).SetSupplementary(fmt.Sprintf("got %T key expected string", k))
+			}
+		}
+		return m, nil
+	}
+	v := reflect.ValueOf(o)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Map && (v.Type().Key().Kind() == reflect.String || stringifyKeys) {
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[fmt.Sprintf("%v", iter.Key().Interface())] = iter.Value().Interface()
+		}
+		return m, nil
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, NewError("ErrExpectedMap")
+	}
+	m := make(map[string]interface{})
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		name, omitEmpty := fieldName(f)
+		if name == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+		if omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		m[name] = fv.Interface()
+	}
+	return m, nil
+}
+
+// asSlice returns the array to be validated for an object, and whether it is
+// an array
+//
+// A []interface{} is returned unchanged. Any other slice or array (or a
+// pointer to one), such as a []string or a slice of structs decoded into a
+// typed field, is copied, so is not modified by MutateInPlace. A []byte is not
+// an array, as it is validated as `bytes` or `raw`.
+func asSlice(o interface{}) ([]interface{}, bool) {
+	if slice, ok := o.([]interface{}); ok {
+		return slice, true
+	}
+	if o == nil {
+		return nil, false
+	}
+	v := reflect.ValueOf(o)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) || v.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	slice := make([]interface{}, v.Len())
+	for i := range slice {
+		slice[i] = v.Index(i).Interface()
+	}
+	return slice, true
+}
+
+var tagRegexp = regexp.MustCompile("^(-|\\w*)((?:[*+!?=-]|\\{\\d*,\\d*\\})*)(?:,(.*))?$")
+
+// splitTag splits a struct tag into the key, any map element modifiers
+// (as used by CompileStruct) and any comma separated options
+func splitTag(tag string) (string, string, []string) {
+	m := tagRegexp.FindStringSubmatch(tag)
+	if m == nil {
+		return tag, "", nil
+	}
+	var options []string
+	if m[3] != "" {
+		options = strings.Split(m[3], ",")
+	}
+	return m[1], m[2], options
+}
+
+func fieldName(f reflect.StructField) (string, bool) {
+	for _, key := range []string{"cdl", "json"} {
+		if tag, ok := f.Tag.Lookup(key); ok {
+			name, _, options := splitTag(tag)
+			omitEmpty := false
+			for _, p := range options {
+				if p == "omitempty" {
+					omitEmpty = true
+				}
+			}
+			if name == "" {
+				return f.Name, omitEmpty
+			}
+			return name, omitEmpty
+		}
+	}
+	return f.Name, false
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return v.IsZero()
+}
+
+// func ConfiguratorFromStruct builds a Configurator from a pointer to a struct.
+//
+// Each exported field with a `cdl` tag is bound to the key named in the tag.
+// A pointer field is set to a newly allocated value when its key is
+// configured. As the configurator is called for each element of an array, each
+// element is appended to a slice field; slice fields are emptied at the start of
+// each validation, so the configurator may be reused.
+//
+// The fields of a nested struct with a `cdl` tag (other than Enum, HostPort and
+// time.Time, which are bound as values) are bound to keys qualified by the key
+// of the nested struct, e.g. `limits.min`, as the nested struct is a map (see
+// CompileStruct). The fields of an untagged or embedded struct are bound as if
+// they were fields of the struct containing it.
+func ConfiguratorFromStruct(p interface{}) (Configurator, error) {
+	v := reflect.ValueOf(p)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil, NewError("ErrBadConfigurator").SetSupplementary(fmt.Sprintf("got %T expected a pointer to a struct", p))
+	}
+	c := make(Configurator)
+	if err := addStructFields(c, v.Elem(), ""); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var boundStructTypes = map[reflect.Type]bool{
+	reflect.TypeOf(Enum{}):      true,
+	reflect.TypeOf(HostPort{}):  true,
+	reflect.TypeOf(time.Time{}): true,
+}
+
+func addStructFields(c Configurator, v reflect.Value, parent string) *CdlError {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		tag, tagged := f.Tag.Lookup("cdl")
+		name, _, _ := splitTag(tag)
+		if tagged && name == "-" {
+			continue
+		}
+		if f.Type.Kind() == reflect.Struct && !boundStructTypes[f.Type] {
+			nested := parent
+			if tagged && name != "" {
+				nested = name
+			}
+			if err := addStructFields(c, v.Field(i), nested); err != nil {
+				return err
+			}
+			continue
+		}
+		if !tagged || name == "" {
+			continue
+		}
+		if parent != "" {
+			name = parent + "." + name
+		}
+		if _, ok := c[name]; ok {
+			return NewErrorContextQuoted("ErrBadConfigurator", name).SetSupplementary("key bound to more than one field")
+		}
+		fv := v.Field(i)
+		switch {
+		case fv.Kind() == reflect.Ptr:
+			if elem := fv.Type().Elem(); elem.Kind() == reflect.Struct && !boundStructTypes[elem] {
+				return NewErrorContextQuoted("ErrBadConfigurator", name).SetSupplementary("cannot bind a pointer to a struct")
+			}
+			c[name] = pointerField{field: fv}
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8:
+			c[name] = appendTo(fv)
+		default:
+			c[name] = fv.Addr().Interface()
+		}
+	}
+	return nil
+}
+
+// type pointerField is a configurator setting a pointer field to a newly
+// allocated value
+type pointerField struct {
+	field reflect.Value
+}
+
+// type sliceAppender is a configurator appending each element configured to a
+// slice
+type sliceAppender struct {
+	slice reflect.Value
+}
+
+// appendTo returns a configurator appending each element configured to a slice
+func appendTo(slice reflect.Value) sliceAppender {
+	return sliceAppender{slice: slice}
+}
+
+// reset empties the slice, without reusing its contents
+func (a sliceAppender) reset() {
+	a.slice.Set(reflect.Zero(a.slice.Type()))
+}
+
+// append appends an element to the slice
+func (a sliceAppender) append(obj interface{}) *CdlError {
+	elem := reflect.New(a.slice.Type().Elem())
+	if err := assign(elem.Interface(), obj); err != nil {
+		return err
+	}
+	a.slice.Set(reflect.Append(a.slice, elem.Elem()))
+	return nil
+}
+
+// func CompileStruct compiles a template derived from a pointer to a struct.
+//
+// Each exported field with a `cdl` tag becomes a key of the root map. The tag
+// holds the key followed by any modifiers, e.g. `cdl:"name?"` or
+// `cdl:"tags{1,3}"`. The specification of the key is derived from the type of
+// the field, or may be given explicitly in a `cdltype` tag, e.g.
+// `cdltype:"ipport_numeric"`. Slices are arrays of their element type, and
+// nested structs are maps. The fields of a struct may be bound to the template
+// using ConfiguratorFromStruct.
+func CompileStruct(p interface{}) (*CompiledTemplate, error) {
+	v := reflect.ValueOf(p)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, NewError("ErrBadConfigurator").SetSupplementary(fmt.Sprintf("got %T expected a pointer to a struct", p))
+	}
+	t := Template{}
+	if err := addStructTemplate(t, "/", v.Type()); err != nil {
+		return nil, err
+	}
+	return Compile(t)
+}
+
+// specForType returns the specification for a Go type, or "" if none is known
+func specForType(t reflect.Type) string {
+	switch t {
+	case reflect.TypeOf(time.Duration(0)):
+		return "duration"
+	case reflect.TypeOf(time.Time{}):
+		return "timestamp"
+	case reflect.TypeOf(HostPort{}):
+		return "ipport"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool"
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	return ""
+}
+
+func addStructTemplate(tmpl Template, key string, t reflect.Type) *CdlError {
+	var elements []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, tagged := f.Tag.Lookup("cdl")
+		if f.PkgPath != "" || !tagged {
+			continue
+		}
+		name, modifiers, _ := splitTag(tag)
+		if name == "" || name == "-" {
+			continue
+		}
+		if _, ok := tmpl[name]; ok {
+			return NewErrorContextQuoted("ErrBadKey", name).SetSupplementary("key used by more than one field")
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Slice {
+			// an array of the element type
+			if !strings.ContainsAny(modifiers, "*+{") {
+				modifiers += "*"
+			}
+			ft = ft.Elem()
+		}
+		elements = append(elements, name+modifiers)
+		if spec, ok := f.Tag.Lookup("cdltype"); ok {
+			tmpl[name] = spec
+		} else if spec := specForType(ft); spec != "" {
+			tmpl[name] = spec
+		} else if ft.Kind() == reflect.Struct && ft != reflect.TypeOf(Enum{}) {
+			if err := addStructTemplate(tmpl, name, ft); err != nil {
+				return err
+			}
+		} else {
+			return NewErrorContextQuoted("ErrBadConfigurator", name).SetSupplementary(fmt.Sprintf("no specification for %s; give one in a cdltype tag", ft))
+		}
+	}
+	tmpl[key] = "{}" + strings.Join(elements, " ")
+	return nil
+}
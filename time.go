@@ -0,0 +1,42 @@
+package cdl
+
+import (
+	"fmt"
+	"time"
+)
+
+// toDuration returns the time.Duration represented by an object
+//
+// A time.Duration is returned unchanged; a string is parsed by time.ParseDuration.
+func toDuration(o interface{}) (time.Duration, *CdlError) {
+	switch n := o.(type) {
+	case time.Duration:
+		return n, nil
+	case string:
+		d, err := time.ParseDuration(n)
+		if err != nil {
+			return 0, NewError("ErrBadValue").SetSupplementary(fmt.Sprintf("got '%s' expected a duration", n)).WithField("got", n)
+		}
+		return d, nil
+	default:
+		return 0, newBadTypeError(o, "duration")
+	}
+}
+
+// toTimestamp returns the time.Time represented by an object
+//
+// A time.Time is returned unchanged; a string is parsed as RFC 3339.
+func toTimestamp(o interface{}) (time.Time, *CdlError) {
+	switch n := o.(type) {
+	case time.Time:
+		return n, nil
+	case string:
+		t, err := time.Parse(time.RFC3339, n)
+		if err != nil {
+			return time.Time{}, NewError("ErrBadValue").SetSupplementary(fmt.Sprintf("got '%s' expected an RFC 3339 timestamp", n)).WithField("got", n)
+		}
+		return t, nil
+	default:
+		return time.Time{}, newBadTypeError(o, "timestamp")
+	}
+}
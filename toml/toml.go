@@ -0,0 +1,31 @@
+// Package toml registers a cdl decoder for TOML files.
+//
+// Importing it for its side effect
+//
+//	import _ "github.com/abligh/cdl/toml"
+//
+// allows files with the extension ".toml" to be validated with ValidateFile.
+package toml
+
+import (
+	"github.com/BurntSushi/toml"
+	"github.com/abligh/cdl"
+)
+
+func init() {
+	cdl.RegisterDecoder(".toml", Unmarshal)
+}
+
+// func Unmarshal unmarshals TOML, which always describes a table, so may also
+// be decoded into an interface{}
+func Unmarshal(data []byte, v interface{}) error {
+	if p, ok := v.(*interface{}); ok {
+		var m map[string]interface{}
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		*p = m
+		return nil
+	}
+	return toml.Unmarshal(data, v)
+}
@@ -0,0 +1,48 @@
+package toml_test
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abligh/cdl"
+	_ "github.com/abligh/cdl/toml"
+)
+
+func TestValidateFile(t *testing.T) {
+	ct, err := cdl.Compile(cdl.Template{
+		"/":     "{}name ratio tags*",
+		"name":  "string",
+		"ratio": "float64",
+		"tags":  "string",
+	})
+	if err != nil {
+		log.Fatalf("Compile failed: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "cdl")
+	if err != nil {
+		log.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, c := range []struct{ name, data, errcode string }{
+		{"good.toml", "name = 'x'\nratio = 0.5\ntags = ['a', 'b']\n", ""},
+		{"good.TOML", "name = 'x'\nratio = 0.5\ntags = []\n", ""},
+		{"bad.toml", "name = 'x'\nratio = 1\ntags = []\n", "ErrBadType"},
+		{"broken.toml", "name = 'x\n", "ErrBadFile"},
+	} {
+		path := filepath.Join(dir, c.name)
+		if err := ioutil.WriteFile(path, []byte(c.data), 0600); err != nil {
+			log.Fatalf("Cannot write %s: %v", path, err)
+		}
+		err := ct.ValidateFile(path, nil)
+		if c.errcode == "" {
+			if err != nil {
+				log.Fatalf("Unexpected error validating %s: %v", c.name, err)
+			}
+		} else if me, ok := err.(*cdl.CdlError); !ok || me.Type.String() != c.errcode {
+			log.Fatalf("Validating %s gave %v, expected %s", c.name, err, c.errcode)
+		}
+	}
+}
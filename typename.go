@@ -0,0 +1,100 @@
+package cdl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pseudoTypes lists the type names with a special meaning to cdl
+var pseudoTypes = []string{
+	"number",
+	"integer",
+	"ipport",
+	"ipport_numeric",
+	"ipport_host",
+	"ipport_host_numeric",
+	"ip",
+	"url",
+	"email",
+	"duration",
+	"timestamp",
+	"bytesize",
+	"raw",
+	"bytes",
+}
+
+// goTypes lists the names of the built-in Go types, as given by reflect
+var goTypes = []string{
+	"bool",
+	"string",
+	"int", "int8", "int16", "int32", "int64",
+	"uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
+	"float32", "float64",
+	"complex64", "complex128",
+}
+
+// isTypeName returns true if name is a pseudotype or the name of a built-in Go type
+func isTypeName(name string) bool {
+	for _, known := range append(append([]string{}, pseudoTypes...), goTypes...) {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTypeName checks a type name is known when compiling strictly
+//
+// Composite and package qualified type names cannot be checked, so are
+// assumed to be correct.
+func checkTypeName(name string) *CdlError {
+	if strings.ContainsAny(name, ".[]*{} ") {
+		return nil
+	}
+	best, bestDistance := "", 3
+	for _, known := range append(append([]string{}, pseudoTypes...), goTypes...) {
+		if name == known {
+			return nil
+		}
+		if d := levenshtein(name, known); d < bestDistance {
+			best, bestDistance = known, d
+		}
+	}
+	err := NewError("ErrUnknownType").WithField("got", name)
+	if best != "" {
+		return err.SetSupplementary(fmt.Sprintf("unknown type '%s', did you mean '%s'?", name, best)).WithField("suggestion", best)
+	}
+	return err.SetSupplementary(fmt.Sprintf("unknown type '%s'", name))
+}
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,188 @@
+package cdl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// union is a specification met by meeting any one of several others, given
+// as `oneof(a|b|c)`
+type union struct {
+	names []string
+	reach []string // the keys which may be validated within the union
+}
+
+// choice identifies a union validated at a path
+type choice struct {
+	u    *union
+	path string
+}
+
+// reachable returns the keys which may be validated within any of the keys
+// given, including those keys
+func (ct *CompiledTemplate) reachable(names []string) []string {
+	seen := make(map[string]bool)
+	var walk func(name string)
+	walk = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		switch t := ct.s[name].(type) {
+		case *options:
+			for k := range t.keys {
+				walk(k)
+				walk(ct.qualify(name, k))
+			}
+			for _, p := range t.patterns {
+				walk(p.name)
+			}
+			if t.extra != nil {
+				walk(t.extra.name)
+			}
+		case *array:
+			walk(t.name)
+		case *tuple:
+			for _, n := range t.names {
+				walk(n)
+			}
+		case *union:
+			for _, n := range t.names {
+				walk(n)
+			}
+		}
+	}
+	for _, name := range names {
+		walk(name)
+	}
+	reach := make([]string, 0, len(seen))
+	for name := range seen {
+		reach = append(reach, name)
+	}
+	sort.Strings(reach)
+	return reach
+}
+
+// checkUnions checks that no union is one of its own alternatives, directly or
+// through other unions, as validating it would never terminate
+//
+// A union may still contain itself within a map, array or tuple.
+func (ct *CompiledTemplate) checkUnions() *CdlError {
+	var keys []string
+	for k, v := range ct.s {
+		if _, ok := v.(*union); ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		seen := make(map[string]bool)
+		var cyclic func(name string) bool
+		cyclic = func(name string) bool {
+			if name == k {
+				return true
+			}
+			if seen[name] {
+				return false
+			}
+			seen[name] = true
+			if u, ok := ct.s[name].(*union); ok {
+				for _, n := range u.names {
+					if cyclic(n) {
+						return true
+					}
+				}
+			}
+			return false
+		}
+		for _, n := range ct.s[k].(*union).names {
+			if cyclic(n) {
+				return NewErrorContextQuoted("ErrBadOptionValue", k).
+					SetSupplementary("union is one of its own alternatives")
+			}
+		}
+	}
+	return nil
+}
+
+// hasEffects returns true if validating an object against a union may have
+// side effects (such as calling a configurator), and so must be done only
+// once an alternative has been chosen
+func (st *state) hasEffects(u *union) bool {
+	if st.opts.MutateInPlace || st.opts.OnEnter != nil || st.opts.OnExit != nil || st.opts.OnUnknownKey != nil {
+		return true
+	}
+	if len(st.configurator) == 0 {
+		return false
+	}
+	if len(st.patterns) != 0 {
+		return true
+	}
+	for _, name := range u.reach {
+		last := name[strings.LastIndex(name, ".")+1:]
+		for k := range st.configurator {
+			// a configurator for the key, or for part of it (e.g. `cherry.host`)
+			if k == name || k == last || strings.HasPrefix(k, name+".") || strings.HasPrefix(k, last+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateUnion validates an object against each alternative of a union in
+// turn, until one validates
+//
+// Alternatives are tried without configurators (or other side effects), each
+// with its own Result, which is kept only if the alternative validates. If
+// validating the union may have side effects, the alternative chosen is then
+// validated again in full. The alternative chosen for each union at each path
+// is remembered, so a union within a union is only tried once. If no
+// alternative validates, the error which occurred deepest within the object is
+// returned.
+func (ct *CompiledTemplate) validateUnion(o interface{}, u *union, st *state, path Path) *CdlError {
+	if st.chosen == nil {
+		st.chosen = make(map[choice]string)
+	}
+	c := choice{u: u, path: path.String()}
+	if name, ok := st.chosen[c]; ok {
+		return ct.validateAndConfigureItem(o, name, st, path)
+	}
+	effects := st.hasEffects(u)
+	var deepest *CdlError
+	for _, name := range u.names {
+		trial := *st
+		trial.result = Result{}
+		if effects {
+			trial.configurator = nil
+			trial.patterns = nil
+			trial.opts.MutateInPlace = false
+			trial.opts.OnEnter = nil
+			trial.opts.OnExit = nil
+			trial.opts.OnUnknownKey = nil
+		}
+		err := ct.validateAndConfigureItem(o, name, &trial, path)
+		if err == nil {
+			st.chosen[c] = name
+			if effects {
+				return ct.validateAndConfigureItem(o, name, st, path)
+			}
+			st.stats = trial.stats
+			st.result.merge(trial.result)
+			return nil
+		}
+		if deepest == nil || len(err.Context) > len(deepest.Context) {
+			deepest = err
+		}
+	}
+	if deepest == nil || len(deepest.Context) == 0 {
+		quoted := make([]string, len(u.names))
+		for i, name := range u.names {
+			quoted[i] = fmt.Sprintf("'%s'", strings.TrimPrefix(name, ":"))
+		}
+		return NewError("ErrBadType").SetSupplementary(fmt.Sprintf("matches none of %s", strings.Join(quoted, ", "))).
+			WithField("got", typeName(o))
+	}
+	return deepest
+}
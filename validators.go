@@ -0,0 +1,124 @@
+package cdl
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// func OneOf checks an object is one of the allowed values, for use within validator functions
+//
+// Numbers are compared by value, so a float64 from json/encoding matches an
+// allowed int. Returns ErrBadValue if the object is not allowed, else nil.
+func OneOf(obj interface{}, allowed ...interface{}) *CdlError {
+	for _, a := range allowed {
+		if equalValues(obj, a) {
+			return nil
+		}
+	}
+	options := make([]string, len(allowed))
+	for i, a := range allowed {
+		options[i] = fmt.Sprintf("%v", a)
+	}
+	return NewError("ErrBadValue").SetSupplementary(fmt.Sprintf("got %v expected one of %s", obj, strings.Join(options, ", "))).
+		WithField("got", obj).
+		WithField("allowed", allowed)
+}
+
+// run runs a validator function, subject to the ValidatorTimeout option
+func (st *state) run(v ValidatorFunc, o interface{}) *CdlError {
+	if st.opts.ValidatorTimeout <= 0 {
+		return v(o)
+	}
+	if st.opts.MutateInPlace {
+		// an abandoned validator must not see the object change
+		o = copyTree(o)
+	}
+	done := make(chan *CdlError, 1) // buffered so an abandoned validator can finish
+	go func() {
+		defer func() {
+			// a panic cannot reach the caller from here
+			if r := recover(); r != nil {
+				done <- NewError("ErrInternal").SetSupplementary(fmt.Sprintf("validator panicked: %v", r))
+			}
+		}()
+		done <- v(o)
+	}()
+	timer := time.NewTimer(st.opts.ValidatorTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return NewError("ErrValidatorTimeout").SetSupplementary(fmt.Sprintf("took longer than %v", st.opts.ValidatorTimeout)).
+			WithField("timeout", st.opts.ValidatorTimeout)
+	}
+}
+
+var (
+	typeValidators      = map[reflect.Type]ValidatorFunc{}
+	typeValidatorsLock  sync.RWMutex
+	typeValidatorsCount int32 // read without the lock, so leaves are cheap when none are registered
+)
+
+// func RegisterTypeValidator registers a validator for all leaves of the specified Go type.
+//
+// After a leaf (an item which is neither a map nor an array) passes the checks
+// made by its template, the validator registered for its type, if any, is
+// called, so invariants such as "no string may be empty" may be enforced across
+// the whole document. A leaf may be a struct such as a time.Time, but a struct
+// validated as a map is not a leaf. Passing a nil validator removes any
+// registration. RegisterTypeValidator is safe for concurrent use.
+func RegisterTypeValidator(t reflect.Type, v ValidatorFunc) {
+	typeValidatorsLock.Lock()
+	defer typeValidatorsLock.Unlock()
+	if v == nil {
+		delete(typeValidators, t)
+	} else {
+		typeValidators[t] = v
+	}
+	atomic.StoreInt32(&typeValidatorsCount, int32(len(typeValidators)))
+}
+
+// typeValidator returns the validator registered for a leaf object, if any
+func typeValidator(o interface{}) ValidatorFunc {
+	if o == nil || atomic.LoadInt32(&typeValidatorsCount) == 0 {
+		return nil
+	}
+	switch reflect.TypeOf(o).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array:
+		return nil
+	}
+	typeValidatorsLock.RLock()
+	defer typeValidatorsLock.RUnlock()
+	return typeValidators[reflect.TypeOf(o)]
+}
+
+// func ApproxEqual checks an object is a number within epsilon of a target, for use within validator functions
+//
+// Returns ErrBadType if the object is not a number, ErrBadValue if it is not
+// within epsilon of the target, else nil.
+func ApproxEqual(obj interface{}, target, epsilon float64) *CdlError {
+	f, ok := toFloat64(obj)
+	if !ok {
+		return newBadTypeError(obj, "number")
+	}
+	if math.Abs(f-target) > epsilon {
+		return NewError("ErrBadValue").SetSupplementary(fmt.Sprintf("got %v expected %v within %v", obj, target, epsilon)).
+			WithField("got", obj).
+			WithField("expected", target)
+	}
+	return nil
+}
+
+func equalValues(a, b interface{}) bool {
+	if fa, ok := toFloat64(a); ok {
+		fb, ok := toFloat64(b)
+		return ok && fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,19 @@
+// Package yaml registers a cdl decoder for YAML files.
+//
+// Importing it for its side effect
+//
+//	import _ "github.com/abligh/cdl/yaml"
+//
+// allows files with the extensions ".yaml" and ".yml" to be validated with
+// ValidateFile.
+package yaml
+
+import (
+	"github.com/abligh/cdl"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+func init() {
+	cdl.RegisterDecoder(".yaml", yamlv3.Unmarshal)
+	cdl.RegisterDecoder(".yml", yamlv3.Unmarshal)
+}